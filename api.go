@@ -1,31 +1,45 @@
 package xfbbroker
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yiffyi/xfbbroker/frontend"
 	"github.com/yiffyi/xfbbroker/xfb"
 )
 
 type ApiServer struct {
-	cfg *Config
+	cfg      *Config
+	started  time.Time
+	limiters map[string]routeLimiter
+	lookups  *failedLookups
+	site     *staticSite
+	upstream upstreamProbe
+	// serializes shared recharges, see handleSharedRecharge
+	rechargeLock sync.Mutex
 }
 
-func (s *ApiServer) probeSignPay(user *User) (string, error) {
-	payUrl, err := xfb.RechargeOnCard("10.0", user.OpenId, user.SessionId, user.YmUserId)
+func (s *ApiServer) probeSignPay(ctx context.Context, user *User) (string, error) {
+	payUrl, err := xfb.RechargeOnCard(ctx, s.cfg.SchoolOf(user), "10.0", user.OpenId, user.SessionId, user.YmUserId)
 	if err != nil {
 		return "", err
 	}
 
 	u, _ := url.Parse(payUrl)
 	tranNo := u.Query().Get("tran_no")
-	_, err = xfb.SignPayCheck(tranNo)
+	_, err = xfb.SignPayCheck(ctx, tranNo)
 	if err != nil {
-		_, jumpUrl, err := xfb.GetSignUrl(tranNo)
+		_, jumpUrl, err := xfb.GetSignUrl(ctx, tranNo)
 		if err != nil {
 			return "", err
 		}
@@ -35,74 +49,10 @@ func (s *ApiServer) probeSignPay(user *User) (string, error) {
 	return "", nil
 }
 
-func (s *ApiServer) handleAuth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-	q := r.URL.Query()
-	u, _ := url.Parse("https://auth.xiaofubao.com/auth/user/third/getCode")
-	{
-		q := u.Query()
-		q.Set("callBackUrl", s.cfg.AuthCallback)
-		u.RawQuery = q.Encode()
-	}
-
-	if q.Get("ymToken") == "" || q.Get("ymUserId") == "" {
-		loc, err := xfb.GetRedirectLocation(u.String()) // Get the location: compatible with WeCom
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		http.Redirect(w, r, loc, http.StatusTemporaryRedirect)
-	} else {
-		sess, data, err := xfb.GetUserById(q.Get("ymToken"), q.Get("ymUserId"))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		} else {
-			u, exist := s.cfg.GetUser(data["id"].(string))
-			if exist {
-				u.SessionId = sess
-				u.Failed = 0
-			} else {
-				u = User{
-					Name:      data["userName"].(string),
-					OpenId:    data["thirdOpenid"].(string),
-					SessionId: sess,
-					YmUserId:  data["id"].(string),
-					// Threshold: 100,
-					Enabled: false,
-				}
-			}
-			s.cfg.SetUser(u.YmUserId, u)
-			s.cfg.Save()
-
-			body, err := json.MarshalIndent(u, "", "    ")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			if exist {
-				w.WriteHeader(http.StatusOK)
-			} else {
-				w.WriteHeader(http.StatusCreated)
-			}
-			w.Write(body)
-		}
-	}
-}
-
 func (s *ApiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-	q := r.URL.Query()
-	sess := q.Get("sessionId")
+	sess := s.requestSession(r)
 	if len(sess) > 0 {
-		user := s.cfg.SelectUserFromSessionId(sess)
+		user := s.lookupSession(r, sess)
 		if user == nil {
 			http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
 			return
@@ -125,21 +75,58 @@ func (s *ApiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *ApiServer) handleSignpay(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
+type UserHealthResponse struct {
+	State         HealthState `json:"state"`
+	Failed        int         `json:"failed"`
+	LastError     string      `json:"lastError,omitempty"`
+	LastErrorAt   *time.Time  `json:"lastErrorAt,omitempty"`
+	LastSuccessAt *time.Time  `json:"lastSuccessAt,omitempty"`
+}
+
+func healthOf(user *User) UserHealthResponse {
+	res := UserHealthResponse{
+		State:     user.State(),
+		Failed:    user.Failed,
+		LastError: user.LastError,
+	}
+	if !user.LastErrorAt.IsZero() {
+		res.LastErrorAt = &user.LastErrorAt
+	}
+	if !user.LastSuccessAt.IsZero() {
+		res.LastSuccessAt = &user.LastSuccessAt
+	}
+	return res
+}
+
+func (s *ApiServer) handleUserHealth(w http.ResponseWriter, r *http.Request) {
+	sess := s.requestSession(r)
+	if sess == "" {
+		http.Error(w, "no sessionId provided", http.StatusBadRequest)
 		return
 	}
-	q := r.URL.Query()
-	sess := q.Get("sessionId")
+	user := s.lookupSession(r, sess)
+	if user == nil {
+		http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
+		return
+	}
+	if user.YmUserId != mux.Vars(r)["id"] {
+		http.Error(w, "sessionId does not belong to this user", http.StatusForbidden)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthOf(user))
+}
+
+func (s *ApiServer) handleSignpay(w http.ResponseWriter, r *http.Request) {
+	sess := s.requestSession(r)
 	if len(sess) > 0 {
-		user := s.cfg.SelectUserFromSessionId(sess)
+		user := s.lookupSession(r, sess)
 		if user == nil {
 			http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
 			return
 		}
 
-		jumpUrl, err := s.probeSignPay(user)
+		jumpUrl, err := s.probeSignPay(r.Context(), user)
 		if err != nil {
 			http.Error(w, "signPay check failed: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -156,68 +143,219 @@ func (s *ApiServer) handleSignpay(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *ApiServer) handleGetCards(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
+type CardInfo struct {
+	SchoolName string       `json:"schoolName"`
+	UserType   string       `json:"userType"`
+	Balance    string       `json:"balance"`
+	UserName   string       `json:"userName"`
+	Wallets    []WalletInfo `json:"wallets"`
+}
+
+// cards fetches the card of user, keeping a session rotated by xiaofubao.
+func (s *ApiServer) cards(ctx context.Context, user *User) ([]CardInfo, error) {
+	if !user.Enabled {
+		return nil, newApiError(http.StatusForbidden, ErrUserDisabled, "user disabled")
+	}
+
+	// get card info, balance
+	info, newSessionId, err := xfb.GetUserDefaultLoginInfo(ctx, s.cfg.SchoolOf(user), user.SessionId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get user default login info: %w", err)
+	}
+
+	if newSessionId != "" {
+		user.SessionId = newSessionId
+		s.cfg.UpdateUser(user.YmUserId, func(u *User) { u.SessionId = newSessionId })
+	}
+
+	balance, err := xfb.GetCardMoney(ctx, user.SessionId, user.YmUserId)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query card balance: %w", err)
+	}
+	if balance == "- - -" {
+		slog.InfoContext(ctx, `GetCardMoney returned "- - -"`)
+	}
+
+	// balances and transactions per wallet, falling back to the stored
+	// balances if today's transactions are unavailable
+	_, rows, err := xfb.CardQuerynoPage(ctx, user.SessionId, user.YmUserId, time.Now())
+	if err != nil {
+		slog.WarnContext(ctx, "unable to fetch transactions for wallets", "err", err)
 	}
+
+	slog.InfoContext(ctx, "Got user card info", "Username", user.Name, "Organization", info.SchoolName, "UserType", info.UserType, "Balance", balance)
+	return []CardInfo{{
+		SchoolName: info.SchoolName,
+		UserType:   info.UserType,
+		Balance:    balance,
+		UserName:   info.UserName,
+		Wallets:    walletInfos(user, s.cfg.AnnotateAll(rows)),
+	}}, nil
+}
+
+func (s *ApiServer) handleGetCards(w http.ResponseWriter, r *http.Request) {
 	// require sessionId
-	q := r.URL.Query()
-	sess := q.Get("sessionId")
+	sess := s.requestSession(r)
 	if len(sess) > 0 {
-		user := s.cfg.SelectUserFromSessionId(sess)
+		user := s.lookupSession(r, sess)
 		if user == nil {
 			http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
 			return
 		}
 
-		if !user.Enabled {
-			http.Error(w, "user disabled", http.StatusForbidden)
-			return
-		}
-		// get card info, balance
-		s, newSessionId, err := xfb.GetUserDefaultLoginInfo(user.SessionId)
+		res, err := s.cards(r.Context(), user)
 		if err != nil {
-			http.Error(w, "unable to get user default login info: "+err.Error(), http.StatusInternalServerError)
+			e := asApiError(err)
+			if e.Status >= http.StatusInternalServerError {
+				e.Status = http.StatusInternalServerError
+			}
+			http.Error(w, e.Message, e.Status)
 			return
 		}
 
-		if newSessionId != "" {
-			user.SessionId = newSessionId
-		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
 
-		balance, err := xfb.GetCardMoney(user.SessionId, user.YmUserId)
-		if err != nil {
-			http.Error(w, "unable to query card balance: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if balance == "- - -" {
-			slog.Info(`GetCardMoney returned "- - -"`)
-		}
+type codepayEntry struct {
+	*xfb.QrPayCode
+	// YmUserId of the card paying
+	user string
+	// set once the payment was booked and announced, see settleCodepay
+	settled bool
+}
 
-		slog.Info("Got user card info", "Username", user.Name, "Organization", s.SchoolName, "UserType", s.UserType, "Balance", balance)
-		res := map[string]any{
-			"schoolName": s.SchoolName,
-			"userType":   s.UserType,
-			"balance":    balance,
-			"userName":   s.UserName,
-		}
-		resArr := []map[string]any{}
-		resArr = append(resArr, res)
+var (
+	codepayLock      sync.Mutex
+	codepayInstances = make(map[string]codepayEntry)
+)
 
-		resBuf, err := json.MarshalIndent(resArr, "", "    ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "xfbbroker_codepay_outstanding",
+	Help: "Payment codes created and not yet paid or expired.",
+}, func() float64 {
+	codepayLock.Lock()
+	defer codepayLock.Unlock()
+	return float64(len(codepayInstances))
+})
+
+// payment codes are valid for 30s after creation
+const codepayLifetime = 30
+
+// codepayRetention is how long past its lifetime a code is kept so that
+// late queries still see it paid or expired, in seconds.
+const codepayRetention = 300
+
+type CodepayStatus int
+
+const (
+	CodepayPending CodepayStatus = iota
+	CodepayPaid
+	CodepayExpired
+)
+
+func (c CodepayStatus) String() string {
+	switch c {
+	case CodepayPaid:
+		return "paid"
+	case CodepayExpired:
+		return "expired"
+	default:
+		return "pending"
+	}
+}
+
+type CodepayResult struct {
+	Status CodepayStatus
+	Money  any
+}
+
+// createCodepay generates a payment code for user and remembers it for
+// queryCodepay.
+func createCodepay(ctx context.Context, user *User) (*xfb.QrPayCode, error) {
+	code, err := xfb.GenerateQrPayCode(ctx, user.SessionId)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to generate qr code", "error", err)
+		return nil, err
+	}
+
+	codepayLock.Lock()
+	expireCodepays(time.Now().Unix())
+	codepayInstances[code.QRCode] = codepayEntry{QrPayCode: code, user: user.YmUserId}
+	codepayLock.Unlock()
+	return code, nil
+}
+
+// expireCodepays forgets codes nobody asked about until well past their
+// lifetime. The caller holds codepayLock.
+func expireCodepays(now int64) {
+	for k, e := range codepayInstances {
+		if now-e.Creation > codepayLifetime+codepayRetention {
+			delete(codepayInstances, k)
+			delete(codepayGrants, k)
 		}
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(resBuf)
+// settleCodepay books a paid code on its grant, if shared, and emits
+// EventCodepayPaid. It does so once per code, whether the payment was
+// first seen by a query or by watchSharedCodepay.
+func (s *ApiServer) settleCodepay(code string, money any) {
+	codepayLock.Lock()
+	e, ok := codepayInstances[code]
+	if !ok || e.settled {
+		codepayLock.Unlock()
+		return
 	}
+	e.settled = true
+	codepayInstances[code] = e
+	codepayLock.Unlock()
+
+	s.chargeCodepay(code, money)
+	s.cfg.Emit(e.user, EventCodepayPaid, map[string]any{"qrCode": code, "money": money})
 }
 
-var codepayInstances = make(map[string]*xfb.QrPayCode)
+// queryCodepay checks whether the payment code was used. Paid and expired
+// codes are forgotten. Only the card owner and the grantee a shared code
+// was created for may query it, anyone else gets the same 404 as for an
+// unknown code.
+func (s *ApiServer) queryCodepay(ctx context.Context, user *User, code string) (*CodepayResult, error) {
+	codepayLock.Lock()
+	codepay, ok := codepayInstances[code]
+	ref, shared := codepayGrants[code]
+	codepayLock.Unlock()
+	if ok && codepay.user != user.YmUserId && !(shared && ref.grantee == user.YmUserId) {
+		ok = false
+	}
+	if !ok {
+		return nil, newApiError(http.StatusNotFound, ErrNotFound, "codepay instance not found")
+	}
+
+	res, err := codepay.GetResult(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query codepay: %w", err)
+	}
+
+	// check if monDealCur exists
+	if _, ok := res["monDealCur"]; ok {
+		// monDealCur exists, it's a completed deal
+		s.settleCodepay(code, res["monDealCur"])
+		codepayLock.Lock()
+		delete(codepayInstances, code)
+		codepayLock.Unlock()
+		return &CodepayResult{Status: CodepayPaid, Money: res["monDealCur"]}, nil
+	}
+
+	// monDealCur not exists, it's an unused payment code
+	if time.Now().Unix()-codepay.Creation > codepayLifetime {
+		codepayLock.Lock()
+		delete(codepayInstances, code)
+		delete(codepayGrants, code)
+		codepayLock.Unlock()
+		return &CodepayResult{Status: CodepayExpired}, nil
+	}
+	return &CodepayResult{Status: CodepayPending}, nil
+}
 
 type CodePayCreateResponse struct {
 	Success bool   `json:"success"`
@@ -228,61 +366,31 @@ type CodePayCreateResponse struct {
 }
 
 func (s *ApiServer) handleCodepayCreateHelper(sessionId string, w http.ResponseWriter, r *http.Request) {
-	user := s.cfg.SelectUserFromSessionId(sessionId)
+	user := s.lookupSession(r, sessionId)
 	if user == nil {
 		http.Error(w, "user with sessionId="+sessionId+" not found", http.StatusNotFound)
 		return
 	}
 
-	code, err := xfb.GenerateQrPayCode(user.SessionId)
+	code, err := createCodepay(r.Context(), user)
 	if err != nil {
-		// print error
-		slog.Error("failed to generate qr code", "error", err)
-		resBuf, err := json.MarshalIndent(map[string]any{
+		writeJSON(w, http.StatusInternalServerError, map[string]any{
 			"success": false,
 			"message": "failed to generate qr code: server internal error",
-		}, "", "    ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(resBuf)
+		})
 		return
 	}
 
 	res := CodePayCreateResponse{
 		Success: true,
 		Message: "success",
-		Data: struct {
-			QrCode string `json:"qrCode"`
-		}{
-			QrCode: code.QRCode,
-		},
-	}
-
-	resBuf, err := json.MarshalIndent(res, "", "    ")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resBuf)
-
-	codepayInstances[code.QRCode] = code
+	res.Data.QrCode = code.QRCode
+	writeJSON(w, http.StatusOK, res)
 }
 
 func (s *ApiServer) handleCodepayCreate(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-
-	sess := r.URL.Query().Get("sessionId")
+	sess := s.requestSession(r)
 	if sess == "" {
 		http.Error(w, "no sessionId provided", http.StatusBadRequest)
 		return
@@ -291,11 +399,6 @@ func (s *ApiServer) handleCodepayCreate(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *ApiServer) handleCodepayCreatePath(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	vars := mux.Vars(r)
 	sessionId := vars["sessionId"]
 	if sessionId == "" {
@@ -306,7 +409,7 @@ func (s *ApiServer) handleCodepayCreatePath(w http.ResponseWriter, r *http.Reque
 }
 
 func (s *ApiServer) handleCodepayQueryHelper(sessionId string, w http.ResponseWriter, r *http.Request) {
-	user := s.cfg.SelectUserFromSessionId(sessionId)
+	user := s.lookupSession(r, sessionId)
 	if user == nil {
 		http.Error(w, "user with sessionId="+sessionId+" not found", http.StatusNotFound)
 		return
@@ -318,65 +421,40 @@ func (s *ApiServer) handleCodepayQueryHelper(sessionId string, w http.ResponseWr
 		return
 	}
 
-	codepay, ok := codepayInstances[code]
-	if !ok {
-		http.Error(w, "codepay instance not found", http.StatusNotFound)
-		return
-	}
-
-	res, err := codepay.GetResult()
+	res, err := s.queryCodepay(r.Context(), user, code)
 	if err != nil {
-		http.Error(w, "failed to query codepay: "+err.Error(), http.StatusInternalServerError)
+		e := asApiError(err)
+		if e.Status >= http.StatusInternalServerError {
+			e.Status = http.StatusInternalServerError
+		}
+		http.Error(w, e.Message, e.Status)
 		return
 	}
 
 	var response map[string]any
-	// check if monDealCur exists
-	if _, ok := res["monDealCur"]; ok {
-		// monDealCur exists, it's a completed deal
-		delete(codepayInstances, code)
+	switch res.Status {
+	case CodepayPaid:
 		response = map[string]any{
 			"status":  1,
 			"message": "payment completed",
-			"money":   res["monDealCur"],
+			"money":   res.Money,
 		}
-	} else {
-		// monDealCur not exists, it's an unused payment code
-		// check 30s limit
-		if time.Now().Unix()-codepay.Creation > 30 {
-			// 30s limit exceeded, remove the codepay instance
-			delete(codepayInstances, code)
-			response = map[string]any{
-				"status":  2,
-				"message": "payment code expired",
-			}
-		} else {
-			// 30s limit not exceeded, keep the codepay instance
-			response = map[string]any{
-				"status":  0,
-				"message": "pending",
-			}
+	case CodepayExpired:
+		response = map[string]any{
+			"status":  2,
+			"message": "payment code expired",
+		}
+	default:
+		response = map[string]any{
+			"status":  0,
+			"message": "pending",
 		}
 	}
-
-	resBuf, err := json.MarshalIndent(response, "", "    ")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resBuf)
+	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *ApiServer) handleCodepayQuery(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-
-	sess := r.URL.Query().Get("sessionId")
+	sess := s.requestSession(r)
 	if sess == "" {
 		http.Error(w, "no sessionId provided", http.StatusBadRequest)
 		return
@@ -385,11 +463,6 @@ func (s *ApiServer) handleCodepayQuery(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *ApiServer) handleCodepayQueryPath(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	vars := mux.Vars(r)
 	sessionId := vars["sessionId"]
 	if sessionId == "" {
@@ -399,53 +472,46 @@ func (s *ApiServer) handleCodepayQueryPath(w http.ResponseWriter, r *http.Reques
 	s.handleCodepayQueryHelper(sessionId, w, r)
 }
 
-func (s *ApiServer) handleRecentTransactions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
+// recentTransactions returns at most n of the latest transactions of user.
+func (s *ApiServer) recentTransactions(ctx context.Context, user *User, n int) ([]Transaction, error) {
+	_, transactions, err := xfb.CardQuerynoPage(ctx, user.SessionId, user.YmUserId, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch recent transactions: %w", err)
 	}
 
-	vars := mux.Vars(r)
-	sessionId := vars["sessionId"]
+	if len(transactions) > n {
+		transactions = transactions[len(transactions)-n:]
+	}
+	return s.cfg.AnnotateAll(transactions), nil
+}
+
+func (s *ApiServer) handleRecentTransactions(w http.ResponseWriter, r *http.Request) {
+	sessionId := mux.Vars(r)["sessionId"]
 	if sessionId == "" {
-		http.Error(w, "sessionId required in path", http.StatusBadRequest)
+		sessionId = s.requestSession(r)
+	}
+	if sessionId == "" {
+		http.Error(w, "no sessionId provided", http.StatusBadRequest)
 		return
 	}
 
-	user := s.cfg.SelectUserFromSessionId(sessionId)
+	user := s.lookupSession(r, sessionId)
 	if user == nil {
 		http.Error(w, "user with sessionId="+sessionId+" not found", http.StatusNotFound)
 		return
 	}
 
-	_, transactions, err := xfb.CardQuerynoPage(user.SessionId, user.YmUserId, time.Now())
-	if err != nil {
-		http.Error(w, "unable to fetch recent transactions: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	// Limit to at most 3 transactions
-	if len(transactions) > 3 {
-		transactions = transactions[len(transactions)-3:]
-	}
-
-	resBuf, err := json.MarshalIndent(transactions, "", "    ")
+	transactions, err := s.recentTransactions(r.Context(), user, 3)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(resBuf)
+	writeJSON(w, http.StatusOK, transactions)
 }
 
 func (s *ApiServer) handleRecentTransactionsPath(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	if r.Method == http.MethodOptions {
-		return
-	}
-
 	vars := mux.Vars(r)
 	sessionId := vars["sessionId"]
 	if sessionId == "" {
@@ -459,16 +525,29 @@ func (s *ApiServer) handleRecentTransactionsPath(w http.ResponseWriter, r *http.
 func CreateApiServer(cfg *Config) *mux.Router {
 	r := mux.NewRouter()
 	s := &ApiServer{
-		cfg: cfg,
+		cfg:     cfg,
+		started: time.Now(),
+		site:    newStaticSite(frontend.Dist()),
 	}
+	s.setupRateLimits()
+
+	// For orchestration:
+	r.HandleFunc("/healthz", s.handleHealthz).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", s.handleReadyz).Methods(http.MethodGet)
 
 	// For human operations:
 	r.HandleFunc("/_/xfb/auth", s.handleAuth).Methods(http.MethodGet, http.MethodOptions)
 	r.HandleFunc("/_/xfb/signpay", s.handleSignpay).Methods(http.MethodGet, http.MethodOptions)
 	r.HandleFunc("/_/config", s.handleConfig).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+	r.HandleFunc("/_/users/{id}/health", s.handleUserHealth).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/_/bot/telegram", s.handleTelegramWebhook).Methods(http.MethodPost)
+	r.HandleFunc("/_/bot/wecom", s.handleWeComCallback).Methods(http.MethodGet, http.MethodPost)
 
 	// For integrations:
 	r.HandleFunc("/api/v1/cards", s.handleGetCards).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/api/v1/budgets", s.handleBudgets).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/api/v1/transactions/export", s.handleExportTransactions).Methods(http.MethodGet, http.MethodOptions)
+	r.HandleFunc("/api/v1/transactions.ics", s.handleFeed).Methods(http.MethodGet, http.MethodOptions)
 
 	// Codepay endpoints
 	r.HandleFunc("/api/v1/codepay/create", s.handleCodepayCreate).Methods(http.MethodPost, http.MethodOptions)
@@ -480,6 +559,16 @@ func CreateApiServer(cfg *Config) *mux.Router {
 	r.HandleFunc("/api/v1/codepay/{sessionId}/query", s.handleCodepayQueryPath).Methods(http.MethodGet, http.MethodOptions)
 	r.HandleFunc("/api/v1/codepay/{sessionId}/recentTransactions", s.handleRecentTransactionsPath).Methods(http.MethodGet, http.MethodOptions)
 
-	r.Use(mux.CORSMethodMiddleware(r))
+	s.routeV2(r)
+	r.HandleFunc("/api/openapi.json", handleOpenapi).Methods(http.MethodGet, http.MethodOptions)
+
+	r.Handle("/metrics", s.metricsAuth(promhttp.Handler())).Methods(http.MethodGet)
+
+	// The web UI, anything else is left to its router
+	r.HandleFunc("/config.js", s.handleFrontendConfig).Methods(http.MethodGet)
+	r.PathPrefix("/").Handler(s.site).Methods(http.MethodGet, http.MethodHead)
+
+	r.Use(requestIdMiddleware, accessLogMiddleware, recoveryMiddleware, tracingMiddleware)
+	r.Use(mux.CORSMethodMiddleware(r), s.corsMiddleware, s.rateLimitMiddleware)
 	return r
 }
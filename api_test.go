@@ -0,0 +1,50 @@
+package xfbbroker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestCodepayQueryChecksOwner(t *testing.T) {
+	users := append(grantUsers(), User{Name: "Other", YmUserId: "c", SessionId: "sc", Enabled: true})
+	c := newTestConfig(t, nil, users...)
+	h := CreateApiServer(c)
+	s := &ApiServer{cfg: c}
+
+	codepayLock.Lock()
+	codepayInstances["own"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "own", Creation: time.Now().Unix()}, user: "a"}
+	codepayInstances["shared"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "shared", Creation: time.Now().Unix()}, user: "a"}
+	codepayGrants["shared"] = grantRef{owner: "a", grantee: "b"}
+	codepayLock.Unlock()
+	t.Cleanup(func() {
+		codepayLock.Lock()
+		delete(codepayInstances, "own")
+		delete(codepayInstances, "shared")
+		delete(codepayGrants, "shared")
+		codepayLock.Unlock()
+	})
+
+	for _, tc := range []struct{ sess, code string }{{"sb", "own"}, {"sc", "own"}, {"sc", "shared"}} {
+		if w := serve(t, h, "GET", "/api/v2/codepay/"+tc.code, tc.sess, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s queried %s: %d", tc.sess, tc.code, w.Code)
+		}
+	}
+	if w := serve(t, h, "GET", "/api/v1/codepay/sc/query?code=own", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("v1 query of another user: %d", w.Code)
+	}
+
+	// allowed callers get as far as asking xiaofubao
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct{ user, code string }{{"a", "own"}, {"a", "shared"}, {"b", "shared"}} {
+		u, _ := c.GetUser(tc.user)
+		if _, err := s.queryCodepay(ctx, &u, tc.code); !errors.Is(err, xfb.ErrUpstream) {
+			t.Errorf("%s queried %s: %v", tc.user, tc.code, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package xfbbroker
+
+import (
+	_ "embed"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// openapi.json documents /api/v1 and /api/v2 and must be updated together
+// with the routes in CreateApiServer.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+func handleOpenapi(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openapiSpec)
+}
+
+// authenticate finds the user a /api/v2 request acts for, from an
+// "Authorization: Bearer <sessionId>" header, a sessionId query parameter
+// or the session cookie set by handleAuth.
+func (s *ApiServer) authenticate(r *http.Request) (*User, error) {
+	sess := explicitSession(r)
+	if sess == "" {
+		_, ws, err := s.cookieSession(r)
+		if err != nil {
+			return nil, err
+		}
+		user, ok := s.cfg.GetUser(ws.UserId)
+		if !ok {
+			return nil, newApiError(http.StatusUnauthorized, ErrUnauthorized, "user no longer exists")
+		}
+		return &user, nil
+	}
+
+	user := s.lookupSession(r, sess)
+	if user == nil {
+		return nil, newApiError(http.StatusUnauthorized, ErrUnauthorized, "unknown credentials")
+	}
+	return user, nil
+}
+
+// v2 wraps a handler that needs the authenticated user.
+func (s *ApiServer) v2(h func(w http.ResponseWriter, r *http.Request, user *User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.authenticate(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		h(w, r, user)
+	}
+}
+
+type UserView struct {
+	Name      string      `json:"name"`
+	YmUserId  string      `json:"ymUserId"`
+	School    string      `json:"schoolCode"`
+	Enabled   bool        `json:"enabled"`
+	Threshold float64     `json:"threshold"`
+	Health    HealthState `json:"health"`
+}
+
+func userView(user *User) UserView {
+	return UserView{
+		Name:      user.Name,
+		YmUserId:  user.YmUserId,
+		School:    user.SchoolCode,
+		Enabled:   user.Enabled,
+		Threshold: user.Threshold,
+		Health:    user.State(),
+	}
+}
+
+func (s *ApiServer) handleV2User(w http.ResponseWriter, r *http.Request, user *User) {
+	writeData(w, r, http.StatusOK, userView(user))
+}
+
+func (s *ApiServer) handleV2Health(w http.ResponseWriter, r *http.Request, user *User) {
+	writeData(w, r, http.StatusOK, healthOf(user))
+}
+
+func (s *ApiServer) handleV2Cards(w http.ResponseWriter, r *http.Request, user *User) {
+	res, err := s.cards(r.Context(), user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, res)
+}
+
+type CodepayView struct {
+	QrCode string `json:"qrCode"`
+	Status string `json:"status"`
+	Money  any    `json:"money,omitempty"`
+}
+
+func (s *ApiServer) handleV2CodepayCreate(w http.ResponseWriter, r *http.Request, user *User) {
+	if !user.Enabled {
+		writeError(w, r, newApiError(http.StatusForbidden, ErrUserDisabled, "user disabled"))
+		return
+	}
+	code, err := createCodepay(r.Context(), user)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusCreated, CodepayView{
+		QrCode: code.QRCode,
+		Status: CodepayPending.String(),
+	})
+}
+
+func (s *ApiServer) handleV2CodepayQuery(w http.ResponseWriter, r *http.Request, user *User) {
+	code := mux.Vars(r)["code"]
+	res, err := s.queryCodepay(r.Context(), user, code)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, CodepayView{
+		QrCode: code,
+		Status: res.Status.String(),
+		Money:  res.Money,
+	})
+}
+
+func (s *ApiServer) handleV2Transactions(w http.ResponseWriter, r *http.Request, user *User) {
+	n := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		v, err := strconv.Atoi(l)
+		if err != nil || v <= 0 {
+			writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "limit must be a positive integer"))
+			return
+		}
+		n = v
+	}
+
+	transactions, err := s.recentTransactions(r.Context(), user, n)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, transactions)
+}
+
+func (s *ApiServer) routeV2(r *mux.Router) {
+	v2 := r.PathPrefix("/api/v2").Subrouter()
+	v2.HandleFunc("/session", s.handleV2Session).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/session", s.handleV2Logout).Methods(http.MethodDelete)
+	v2.HandleFunc("/user", s.v2(s.handleV2User)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/user/health", s.v2(s.handleV2Health)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/cards", s.v2(s.handleV2Cards)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/codepay", s.v2(s.handleV2CodepayCreate)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/codepay/{code}", s.v2(s.handleV2CodepayQuery)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/transactions", s.v2(s.handleV2Transactions)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/user/bot-link", s.v2(s.handleV2BotLink)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/user/feed-token", s.v2(s.handleV2FeedToken)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/budgets", s.v2(s.handleV2Budgets)).Methods(http.MethodGet, http.MethodOptions)
+	s.routeGrants(v2)
+	s.routeWebhooks(v2)
+}
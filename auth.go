@@ -0,0 +1,285 @@
+package xfbbroker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+const (
+	// time a user has to finish authorizing on xiaofubao
+	authStateLifetime = 10 * time.Minute
+	authStateCookie   = "xfb_auth_state"
+)
+
+// newAuthKey derives the key signing auth states from AuthSecret. Without
+// one, a random key is used and pending authorizations fail after a
+// restart.
+func newAuthKey(secret string) []byte {
+	if secret != "" {
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:]
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// sign returns payload and its MAC for purpose, so that a token made for
+// one purpose is never accepted for another.
+func (c *Config) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, c.authKey)
+	mac.Write([]byte(purpose + "\n" + payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the fields of a token made by sign if it is genuine and
+// its expiry, the second to last field, has not passed.
+func (c *Config) verify(purpose, token string, now time.Time) ([]string, error) {
+	p, m, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(c.sign(purpose, string(payload))), []byte(p+"."+m)) {
+		return nil, errors.New("bad signature")
+	}
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) < 2 {
+		return nil, errors.New("malformed token")
+	}
+	exp, err := strconv.ParseInt(fields[len(fields)-2], 10, 64)
+	if err != nil || now.After(time.Unix(exp, 0)) {
+		return nil, errors.New("expired")
+	}
+	return fields, nil
+}
+
+// newAuthState returns the state to pass through xiaofubao for school and
+// the nonce that binds it to the browser through authStateCookie.
+func (c *Config) newAuthState(school string) (state, nonce string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce = hex.EncodeToString(b)
+	exp := time.Now().Add(authStateLifetime).Unix()
+	return c.sign("auth-state", school+"\n"+strconv.FormatInt(exp, 10)+"\n"+nonce), nonce
+}
+
+// checkAuthState returns the school of a state made by newAuthState for
+// the browser holding nonce.
+func (c *Config) checkAuthState(state, nonce string) (string, error) {
+	f, err := c.verify("auth-state", state, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if len(f) != 3 || nonce == "" || !hmac.Equal([]byte(f[2]), []byte(nonce)) {
+		return "", errors.New("state was issued to another browser")
+	}
+	return f[0], nil
+}
+
+// authUrl is where users of school are sent to authorize the broker. The
+// state, if any, comes back on the callback next to ymToken and ymUserId.
+func authUrl(school School, state string) string {
+	callback := school.AuthCallback
+	if c, err := url.Parse(callback); err == nil && state != "" {
+		q := c.Query()
+		q.Set("state", state)
+		c.RawQuery = q.Encode()
+		callback = c.String()
+	}
+
+	u, _ := url.Parse("https://auth.xiaofubao.com/auth/user/third/getCode")
+	q := u.Query()
+	q.Set("callBackUrl", callback)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// isSecure reports whether r reached the broker over HTTPS, so that
+// cookies are only marked Secure where the browser will send them back.
+func (s *ApiServer) isSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return s.cfg.TrustProxyHeaders && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+var authPage = template.Must(template.New("auth").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>body{font-family:sans-serif;max-width:32em;margin:3em auto;padding:0 1em;color:#333}small{color:#888}</style>
+</head>
+<body>
+<h2>{{.Title}}</h2>
+<p>{{.Message}}</p>
+{{if .Retry}}<p><a href="{{.Retry}}">重新授权</a></p>{{end}}
+{{if .RequestId}}<p><small>请求编号 {{.RequestId}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+type authPageData struct {
+	Title     string
+	Message   string
+	Retry     string
+	RequestId string
+}
+
+// authError shows a page explaining what went wrong during authorization.
+// Upstream errors are only logged, they may contain tokens.
+func authError(w http.ResponseWriter, r *http.Request, status int, msg, retry string, err error) {
+	if err != nil {
+		slog.WarnContext(r.Context(), "authorization failed", "status", status, "err", err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	authPage.Execute(w, authPageData{Title: "授权失败", Message: msg, Retry: retry, RequestId: RequestId(r.Context())})
+}
+
+// handleAuth starts the authorization on xiaofubao, then takes the
+// callback carrying ymToken and ymUserId. The callback is only accepted
+// with a state issued to the same browser less than authStateLifetime
+// ago; it then saves the session of the user, sets the broker session
+// cookie and sends the browser to FrontendUrl.
+func (s *ApiServer) handleAuth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("ymToken") == "" || q.Get("ymUserId") == "" {
+		school, ok := s.cfg.School(q.Get("school"))
+		if !ok {
+			authError(w, r, http.StatusBadRequest, "未知的学校代码。", "", nil)
+			return
+		}
+
+		state, nonce := s.cfg.newAuthState(school.Code)
+		loc, err := xfb.GetRedirectLocation(r.Context(), authUrl(school, state)) // Get the location: compatible with WeCom
+		if err != nil {
+			authError(w, r, http.StatusBadGateway, "无法连接校园卡服务，请稍后再试。", r.URL.String(), err)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     authStateCookie,
+			Value:    nonce,
+			Path:     r.URL.Path,
+			MaxAge:   int(authStateLifetime.Seconds()),
+			HttpOnly: true,
+			Secure:   s.isSecure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, loc, http.StatusTemporaryRedirect)
+		return
+	}
+
+	var nonce string
+	if c, err := r.Cookie(authStateCookie); err == nil {
+		nonce = c.Value
+	}
+	code, err := s.cfg.checkAuthState(q.Get("state"), nonce)
+	if err != nil {
+		// the school parameter cannot be trusted without the state, start
+		// over without one if that is possible
+		retry := ""
+		if _, ok := s.cfg.School(""); ok {
+			retry = r.URL.Path
+		}
+		authError(w, r, http.StatusBadRequest, "授权链接无效或已过期，请重新授权。", retry, err)
+		return
+	}
+	retry := r.URL.Path + "?school=" + url.QueryEscape(code)
+	// the state is used up
+	http.SetCookie(w, &http.Cookie{Name: authStateCookie, Path: r.URL.Path, MaxAge: -1})
+
+	school, ok := s.cfg.School(code)
+	if !ok {
+		authError(w, r, http.StatusBadRequest, "未知的学校代码。", "", nil)
+		return
+	}
+	sess, data, err := xfb.GetUserById(r.Context(), school.School, q.Get("ymToken"), q.Get("ymUserId"))
+	if err != nil {
+		authError(w, r, http.StatusBadGateway, "校园卡服务未能确认你的身份，请重新授权。", retry, err)
+		return
+	}
+	id, _ := data["id"].(string)
+	if id == "" {
+		authError(w, r, http.StatusBadGateway, "校园卡服务返回了无效的用户信息。", retry, errors.New("no id in user info"))
+		return
+	}
+
+	// the school the user actually belongs to, the callback only tells
+	// which one they came from
+	schoolCode := school.Code
+	info, newSessionId, err := xfb.GetUserDefaultLoginInfo(r.Context(), school.School, sess)
+	if err != nil {
+		slog.WarnContext(r.Context(), "unable to get school of user", "err", err)
+	} else {
+		schoolCode = info.SchoolCode
+		if newSessionId != "" {
+			sess = newSessionId
+		}
+	}
+	if _, ok := s.cfg.School(schoolCode); !ok {
+		slog.WarnContext(r.Context(), "user belongs to a school that is not configured", "schoolCode", schoolCode)
+	}
+
+	u, exist := s.cfg.GetUser(id)
+	if exist {
+		u.SessionId = sess
+		u.SchoolCode = schoolCode
+		u.Reauthorized()
+	} else {
+		name, _ := data["userName"].(string)
+		openId, _ := data["thirdOpenid"].(string)
+		u = User{
+			Name:       name,
+			SchoolCode: schoolCode,
+			OpenId:     openId,
+			SessionId:  sess,
+			YmUserId:   id,
+			// Threshold: 100,
+			Enabled: false,
+		}
+	}
+	s.cfg.SetUser(u.YmUserId, u)
+	token, ws := s.cfg.NewWebSession(u.YmUserId, r.UserAgent(), time.Now())
+	s.cfg.Save()
+	slog.InfoContext(r.Context(), "user authorized", "name", u.Name, "new", !exist)
+
+	s.setSessionCookies(w, r, token, ws)
+	if s.cfg.FrontendUrl != "" {
+		http.Redirect(w, r, s.cfg.FrontendUrl, http.StatusSeeOther)
+		return
+	}
+	if s.site.built() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if exist {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	authPage.Execute(w, authPageData{Title: "授权成功", Message: u.Name + "，你的校园卡已连接，可以关闭此页面。"})
+}
@@ -0,0 +1,91 @@
+package xfbbroker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"AuthSecret": "s3cret"})
+	now := time.Now()
+	exp := strconv.FormatInt(now.Add(time.Minute).Unix(), 10)
+	token := c.sign("test", "a\n"+exp+"\nb")
+
+	f, err := c.verify("test", token, now)
+	if err != nil || len(f) != 3 || f[0] != "a" || f[2] != "b" {
+		t.Fatalf("verify = %q, %v", f, err)
+	}
+	if _, err := c.verify("other", token, now); err == nil {
+		t.Error("token accepted for another purpose")
+	}
+	if _, err := c.verify("test", token, now.Add(2*time.Minute)); err == nil {
+		t.Error("expired token accepted")
+	}
+	p, m, _ := strings.Cut(token, ".")
+	forged := c.sign("test", "x\n"+exp+"\nb")
+	fp, _, _ := strings.Cut(forged, ".")
+	for _, bad := range []string{"", "nodot", p, p + ".", fp + "." + m, "!!." + m} {
+		if _, err := c.verify("test", bad, now); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+
+	// the key comes from AuthSecret, so tokens survive a restart
+	same := newTestConfig(t, map[string]any{"AuthSecret": "s3cret"})
+	if _, err := same.verify("test", token, now); err != nil {
+		t.Errorf("same AuthSecret: %v", err)
+	}
+	for _, cfg := range []map[string]any{{"AuthSecret": "other"}, nil} {
+		if _, err := newTestConfig(t, cfg).verify("test", token, now); err == nil {
+			t.Errorf("config %v accepted the token", cfg)
+		}
+	}
+}
+
+func TestAuthState(t *testing.T) {
+	c := newTestConfig(t, nil)
+	state, nonce := c.newAuthState("10001")
+	if school, err := c.checkAuthState(state, nonce); err != nil || school != "10001" {
+		t.Errorf("checkAuthState = %q, %v", school, err)
+	}
+	other, _ := c.newAuthState("10001")
+	for _, tc := range []struct{ state, nonce string }{{state, ""}, {state, "0123"}, {other, nonce}} {
+		if _, err := c.checkAuthState(tc.state, tc.nonce); err == nil {
+			t.Errorf("state %q with nonce %q accepted", tc.state, tc.nonce)
+		}
+	}
+	// a token signed for another purpose is not a state
+	if _, err := c.checkAuthState(c.sign("session", "10001\n9999999999\n"+nonce), nonce); err == nil {
+		t.Error("token of another purpose accepted as state")
+	}
+}
+
+func TestAuthUrlCarriesState(t *testing.T) {
+	school, _ := newTestConfig(t, nil).School("")
+	school.AuthCallback = "https://broker.example.com/_/xfb/auth?school=1"
+	u, err := url.Parse(authUrl(school, "st.ate"))
+	if err != nil || u.Host != "auth.xiaofubao.com" {
+		t.Fatalf("authUrl: %v", u)
+	}
+	cb, _ := url.Parse(u.Query().Get("callBackUrl"))
+	if cb.Query().Get("state") != "st.ate" || cb.Query().Get("school") != "1" || cb.Host != "broker.example.com" {
+		t.Errorf("callBackUrl %s", cb)
+	}
+}
+
+func TestAuthCallbackNeedsCookie(t *testing.T) {
+	c := newTestConfig(t, nil)
+	h := CreateApiServer(c)
+	state, _ := c.newAuthState("")
+	q := url.Values{"state": {state}, "ymToken": {"t"}, "ymUserId": {"u"}}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/_/xfb/auth?"+q.Encode(), nil))
+	if w.Code != http.StatusBadRequest || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("callback without the state cookie: %d %v", w.Code, w.Header())
+	}
+}
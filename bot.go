@@ -0,0 +1,316 @@
+package xfbbroker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+const (
+	// how long a code from /api/v2/user/bot-link can be used
+	botLinkLifetime = 10 * time.Minute
+	// how long /recharge waits for /confirm
+	botConfirmLifetime = 2 * time.Minute
+)
+
+// botChat is a conversation with the bot: a Telegram chat id or a WeCom
+// user id.
+type botChat struct {
+	channel string
+	id      string
+}
+
+type botLink struct {
+	user    string
+	expires time.Time
+}
+
+type botRecharge struct {
+	amount  float64
+	expires time.Time
+}
+
+// BotReply is the answer to a bot command, an optional PNG image with a
+// caption.
+type BotReply struct {
+	Text  string
+	Image []byte
+}
+
+// chatBot keeps the state of bot conversations shared by all channels.
+type chatBot struct {
+	lock    sync.Mutex
+	links   map[string]botLink
+	pending map[string]botRecharge
+	wecom   wecomToken
+}
+
+func newChatBot() *chatBot {
+	return &chatBot{
+		links:   make(map[string]botLink),
+		pending: make(map[string]botRecharge),
+	}
+}
+
+// Muted reports whether u asked not to be notified about transactions and
+// alerts at now.
+func (u *User) Muted(now time.Time) bool {
+	return now.Before(u.MutedUntil)
+}
+
+// userOfChat finds the user linked to chat.
+func (c *Config) userOfChat(chat botChat) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for k, u := range c.Users {
+		switch {
+		case chat.channel == "telegram" && u.TelegramChatId != 0 && strconv.FormatInt(u.TelegramChatId, 10) == chat.id:
+			return k, true
+		case chat.channel == "wecom" && u.WeComUserId != "" && u.WeComUserId == chat.id:
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// newBotLink returns a one-time code linking a chat to user k with
+// "/start <code>".
+func (c *Config) newBotLink(k string) (string, time.Time) {
+	code := strings.ToUpper(randomId(4))
+	expires := time.Now().Add(botLinkLifetime)
+	c.bot.lock.Lock()
+	defer c.bot.lock.Unlock()
+	for code, l := range c.bot.links {
+		if time.Now().After(l.expires) {
+			delete(c.bot.links, code)
+		}
+	}
+	c.bot.links[code] = botLink{user: k, expires: expires}
+	return code, expires
+}
+
+func (c *Config) linkChat(chat botChat, code string) BotReply {
+	c.bot.lock.Lock()
+	l, ok := c.bot.links[strings.ToUpper(code)]
+	delete(c.bot.links, strings.ToUpper(code))
+	c.bot.lock.Unlock()
+	if !ok || time.Now().After(l.expires) {
+		return BotReply{Text: "绑定码无效或已过期"}
+	}
+
+	var name string
+	found := c.UpdateUser(l.user, func(u *User) {
+		name = u.Name
+		switch chat.channel {
+		case "telegram":
+			u.TelegramChatId, _ = strconv.ParseInt(chat.id, 10, 64)
+		case "wecom":
+			u.WeComUserId = chat.id
+		}
+	})
+	if !found {
+		return BotReply{Text: "绑定码无效或已过期"}
+	}
+	if err := c.Save(); err != nil {
+		slog.Error("unable to save config", "err", err)
+	}
+	slog.Info("bot chat linked", "channel", chat.channel, "name", name)
+	return BotReply{Text: "已绑定 " + name + "\n" + botHelp}
+}
+
+const botHelp = `/balance 查询余额
+/today 今日账单
+/pay 付款码
+/recharge 50 充值 50 元
+/mute 2h 静音通知 2 小时，/mute off 取消`
+
+// botCommand runs a command sent in chat and returns the reply.
+func (c *Config) botCommand(ctx context.Context, chat botChat, text string) BotReply {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return BotReply{Text: botHelp}
+	}
+	// Telegram appends the bot name in groups: /balance@somebot
+	cmd, _, _ := strings.Cut(strings.ToLower(fields[0]), "@")
+	args := fields[1:]
+
+	if cmd == "/start" && len(args) == 1 {
+		return c.linkChat(chat, args[0])
+	}
+	k, ok := c.userOfChat(chat)
+	if !ok {
+		return BotReply{Text: "尚未绑定，请在网页中获取绑定码后发送 /start <绑定码>"}
+	}
+	u, ok := c.GetUser(k)
+	if !ok {
+		return BotReply{Text: "用户不存在"}
+	}
+	slog.InfoContext(ctx, "bot command", "channel", chat.channel, "name", u.Name, "command", cmd)
+
+	var reply BotReply
+	var err error
+	switch cmd {
+	case "/balance":
+		reply, err = c.botBalance(ctx, &u)
+	case "/today":
+		reply, err = c.botToday(ctx, &u)
+	case "/pay":
+		reply, err = c.botPay(ctx, &u)
+	case "/recharge":
+		reply = c.botRecharge(&u, args)
+	case "/confirm":
+		reply, err = c.botConfirm(ctx, &u)
+	case "/cancel":
+		c.bot.lock.Lock()
+		delete(c.bot.pending, k)
+		c.bot.lock.Unlock()
+		reply = BotReply{Text: "已取消"}
+	case "/mute":
+		reply = c.botMute(k, args)
+	default:
+		reply = BotReply{Text: botHelp}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "bot command failed", "err", err, "command", cmd, "name", u.Name)
+		return BotReply{Text: "请求失败: " + asApiError(err).Message}
+	}
+	return reply
+}
+
+func (c *Config) botBalance(ctx context.Context, u *User) (BotReply, error) {
+	balance, err := xfb.GetCardMoney(ctx, u.SessionId, u.YmUserId)
+	if err != nil {
+		return BotReply{}, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "余额 ￥%s", balance)
+	for _, w := range walletInfos(u, nil) {
+		if w.BalanceAt != nil {
+			fmt.Fprintf(&b, "\n%s ￥%.2f", w.Name, w.Balance)
+		}
+	}
+	return BotReply{Text: b.String()}, nil
+}
+
+func (c *Config) botToday(ctx context.Context, u *User) (BotReply, error) {
+	_, rows, err := xfb.CardQuerynoPage(ctx, u.SessionId, u.YmUserId, time.Now())
+	if err != nil {
+		return BotReply{}, err
+	}
+	if len(rows) == 0 {
+		return BotReply{Text: "今日暂无交易"}, nil
+	}
+
+	var b strings.Builder
+	spent := 0.0
+	for _, t := range c.AnnotateAll(rows) {
+		if cost, ok := expense(&t.Trans); ok {
+			spent += cost
+		}
+		dt, _ := t.DealTime()
+		fmt.Fprintf(&b, "%s %s %s\n", dt.Format("15:04"), payee(&t.Trans), formatMoney(t.Money))
+	}
+	fmt.Fprintf(&b, "共 %d 笔，支出 ￥%.2f", len(rows), spent)
+	return BotReply{Text: b.String()}, nil
+}
+
+func (c *Config) botPay(ctx context.Context, u *User) (BotReply, error) {
+	if !u.Enabled {
+		return BotReply{Text: "用户已停用"}, nil
+	}
+	code, err := createCodepay(ctx, u)
+	if err != nil {
+		return BotReply{}, err
+	}
+	png, err := code.GetQrPngBuf(256)
+	if err != nil {
+		return BotReply{}, err
+	}
+	return BotReply{Text: fmt.Sprintf("付款码 %d 秒内有效", codepayLifetime), Image: png}, nil
+}
+
+// botRecharge asks for confirmation before recharging with /confirm.
+func (c *Config) botRecharge(u *User, args []string) BotReply {
+	if !u.Enabled {
+		return BotReply{Text: "用户已停用"}
+	}
+	if len(args) != 1 {
+		return BotReply{Text: "用法: /recharge 50"}
+	}
+	amount, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || amount <= 0 || amount > maxRecharge {
+		return BotReply{Text: fmt.Sprintf("金额须在 0 到 %d 元之间", maxRecharge)}
+	}
+
+	c.bot.lock.Lock()
+	c.bot.pending[u.YmUserId] = botRecharge{amount: amount, expires: time.Now().Add(botConfirmLifetime)}
+	c.bot.lock.Unlock()
+	return BotReply{Text: fmt.Sprintf("确认充值 ￥%.2f？%d 分钟内回复 /confirm 确认，/cancel 取消", amount, int(botConfirmLifetime.Minutes()))}
+}
+
+func (c *Config) botConfirm(ctx context.Context, u *User) (BotReply, error) {
+	c.bot.lock.Lock()
+	p, ok := c.bot.pending[u.YmUserId]
+	delete(c.bot.pending, u.YmUserId)
+	c.bot.lock.Unlock()
+	if !ok || time.Now().After(p.expires) {
+		return BotReply{Text: "没有待确认的充值"}, nil
+	}
+
+	tranNo, err := c.Recharge(ctx, u, p.amount)
+	if err != nil {
+		return BotReply{}, err
+	}
+	if c.dryRun {
+		return BotReply{Text: fmt.Sprintf("演练模式，未充值 ￥%.2f", p.amount)}, nil
+	}
+	return BotReply{Text: fmt.Sprintf("已充值 ￥%.2f，订单号 %s", p.amount, tranNo)}, nil
+}
+
+func (c *Config) botMute(k string, args []string) BotReply {
+	var until time.Time
+	if len(args) == 1 && args[0] != "off" {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return BotReply{Text: "用法: /mute 2h 或 /mute off"}
+		}
+		until = time.Now().Add(d)
+	} else if len(args) != 1 {
+		return BotReply{Text: "用法: /mute 2h 或 /mute off"}
+	}
+
+	c.UpdateUser(k, func(u *User) {
+		u.MutedUntil = until
+	})
+	if err := c.Save(); err != nil {
+		slog.Error("unable to save config", "err", err)
+	}
+	if until.IsZero() {
+		return BotReply{Text: "已取消静音"}
+	}
+	return BotReply{Text: "已静音至 " + until.In(xfb.Location).Format("01-02 15:04")}
+}
+
+type BotLinkView struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// deep link starting the Telegram bot with the code
+	Telegram string `json:"telegram,omitempty"`
+}
+
+// handleV2BotLink issues a code to send as "/start <code>" to a bot.
+func (s *ApiServer) handleV2BotLink(w http.ResponseWriter, r *http.Request, user *User) {
+	code, expires := s.cfg.newBotLink(user.YmUserId)
+	v := BotLinkView{Code: code, ExpiresAt: expires}
+	if s.cfg.Telegram.Username != "" {
+		v.Telegram = "https://t.me/" + s.cfg.Telegram.Username + "?start=" + code
+	}
+	writeData(w, r, http.StatusOK, v)
+}
@@ -0,0 +1,304 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var telegramChat = botChat{channel: "telegram", id: "42"}
+
+func botUsers() []User {
+	return []User{
+		{Name: "A", YmUserId: "a", Enabled: true, TelegramChatId: 42},
+		{Name: "B", YmUserId: "b", Enabled: false, TelegramChatId: 43},
+	}
+}
+
+func TestBotCommandNeedsLink(t *testing.T) {
+	c := newTestConfig(t, nil, botUsers()...)
+	ctx := context.Background()
+	chat := botChat{channel: "wecom", id: "zhangsan"}
+
+	if r := c.botCommand(ctx, chat, "/mute 1h"); !strings.Contains(r.Text, "尚未绑定") {
+		t.Errorf("unlinked chat: %q", r.Text)
+	}
+	if r := c.botCommand(ctx, chat, "/start NOPE"); !strings.Contains(r.Text, "无效") {
+		t.Errorf("unknown code: %q", r.Text)
+	}
+	code, _ := c.newBotLink("a")
+	if r := c.botCommand(ctx, chat, "/start "+strings.ToLower(code)); !strings.Contains(r.Text, "已绑定 A") {
+		t.Errorf("link: %q", r.Text)
+	}
+	if u, _ := c.GetUser("a"); u.WeComUserId != "zhangsan" {
+		t.Errorf("WeComUserId = %q", u.WeComUserId)
+	}
+	// codes work once
+	if r := c.botCommand(ctx, botChat{channel: "wecom", id: "lisi"}, "/start "+code); !strings.Contains(r.Text, "无效") {
+		t.Errorf("reused code: %q", r.Text)
+	}
+	if r := c.botCommand(ctx, chat, "/what@xfbbot"); r.Text != botHelp {
+		t.Errorf("unknown command: %q", r.Text)
+	}
+}
+
+func TestBotMute(t *testing.T) {
+	c := newTestConfig(t, nil, botUsers()...)
+	ctx := context.Background()
+
+	r := c.botCommand(ctx, telegramChat, "/MUTE@xfbbot 2h")
+	u, _ := c.GetUser("a")
+	if !strings.Contains(r.Text, "已静音") || !u.Muted(time.Now().Add(119*time.Minute)) || u.Muted(time.Now().Add(121*time.Minute)) {
+		t.Errorf("/mute 2h: %q, until %v", r.Text, u.MutedUntil)
+	}
+	for _, text := range []string{"/mute", "/mute soon", "/mute -1h", "/mute 1h 2h"} {
+		if r := c.botCommand(ctx, telegramChat, text); !strings.Contains(r.Text, "用法") {
+			t.Errorf("%s: %q", text, r.Text)
+		}
+	}
+	if u, _ := c.GetUser("a"); !u.Muted(time.Now()) {
+		t.Error("bad /mute unmuted")
+	}
+	c.botCommand(ctx, telegramChat, "/mute off")
+	if u, _ := c.GetUser("a"); u.Muted(time.Now()) {
+		t.Error("/mute off did not unmute")
+	}
+}
+
+func TestBotRecharge(t *testing.T) {
+	c := newTestConfig(t, nil, botUsers()...)
+	ctx := context.Background()
+
+	for _, text := range []string{"/recharge 0", "/recharge -5", "/recharge 100.01", "/recharge fifty"} {
+		if r := c.botCommand(ctx, telegramChat, text); !strings.Contains(r.Text, "金额须在") {
+			t.Errorf("%s: %q", text, r.Text)
+		}
+	}
+	if r := c.botCommand(ctx, telegramChat, "/recharge"); !strings.Contains(r.Text, "用法") {
+		t.Errorf("/recharge: %q", r.Text)
+	}
+	if r := c.botCommand(ctx, botChat{channel: "telegram", id: "43"}, "/recharge 10"); !strings.Contains(r.Text, "停用") {
+		t.Errorf("disabled user: %q", r.Text)
+	}
+
+	if r := c.botCommand(ctx, telegramChat, "/recharge 100"); !strings.Contains(r.Text, "100.00") {
+		t.Errorf("/recharge 100: %q", r.Text)
+	}
+	c.botCommand(ctx, telegramChat, "/cancel")
+	if r := c.botCommand(ctx, telegramChat, "/confirm"); !strings.Contains(r.Text, "没有待确认") {
+		t.Errorf("/confirm after /cancel: %q", r.Text)
+	}
+
+	c.botCommand(ctx, telegramChat, "/recharge 50")
+	c.bot.lock.Lock()
+	p := c.bot.pending["a"]
+	if p.amount != 50 {
+		t.Errorf("pending %v", p.amount)
+	}
+	p.expires = time.Now().Add(-time.Second)
+	c.bot.pending["a"] = p
+	c.bot.lock.Unlock()
+	if r := c.botCommand(ctx, telegramChat, "/confirm"); !strings.Contains(r.Text, "没有待确认") {
+		t.Errorf("expired /confirm: %q", r.Text)
+	}
+}
+
+// The example of the WeCom callback documentation.
+func TestWeComCrypto(t *testing.T) {
+	a := WeComAppConfig{
+		CorpId:         "wx5823bf96d3bd56c7",
+		Token:          "QDG6eK",
+		EncodingAESKey: "jWmYm7qr5nMoAUwZRjGtBxmz3KA1tkAj3ykkR6q2B2C",
+	}
+	echostr := "P9nAzCzyDtyTWESHep1vC5X9xho/qYX3Zpb4yKa9SKld1DsH3Iyt3tP3zNdtp+4RPcs8TgAE7OaBO+FZXvnaqQ=="
+	if sig := a.signature("1409659589", "263014780", echostr); sig != "5c45ff5e21c57e6ad56bac8758b79b1d9ac89fd3" {
+		t.Errorf("signature = %s", sig)
+	}
+	msg, err := a.decrypt(echostr)
+	if err != nil || string(msg) != "1616140317555161061" {
+		t.Errorf("decrypt = %q, %v", msg, err)
+	}
+
+	a.CorpId = "other"
+	if _, err := a.decrypt(echostr); err == nil {
+		t.Error("message for another corp accepted")
+	}
+}
+
+// wecomEncrypt is the inverse of decrypt.
+func wecomEncrypt(t *testing.T, a WeComAppConfig, msg string) string {
+	key, err := a.aesKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 16))
+	binary.Write(&buf, binary.BigEndian, uint32(len(msg)))
+	buf.WriteString(msg + a.CorpId)
+	pad := 32 - buf.Len()%32
+	buf.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+	data := buf.Bytes()
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, key[:16]).CryptBlocks(data, data)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestWeComCallback(t *testing.T) {
+	sent := make(chan map[string]any, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/gettoken":
+			w.Write([]byte(`{"errcode":0,"access_token":"tok","expires_in":7200}`))
+		case "/cgi-bin/message/send":
+			var msg map[string]any
+			json.NewDecoder(r.Body).Decode(&msg)
+			sent <- msg
+			w.Write([]byte(`{"errcode":0}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	a := WeComAppConfig{
+		CorpId:         "corp",
+		AgentId:        1,
+		Secret:         "secret",
+		Token:          "token",
+		EncodingAESKey: "jWmYm7qr5nMoAUwZRjGtBxmz3KA1tkAj3ykkR6q2B2C",
+		ApiUrl:         api.URL,
+	}
+	c := newTestConfig(t, map[string]any{"WeComApp": a}, botUsers()...)
+	h := CreateApiServer(c)
+
+	encrypted := wecomEncrypt(t, a, "<xml><FromUserName>zhangsan</FromUserName><MsgType>text</MsgType><Content>/balance</Content></xml>")
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"xml"`
+		Encrypt string
+	}{Encrypt: encrypted})
+	post := func(sig string) int {
+		q := url.Values{"msg_signature": {sig}, "timestamp": {"1"}, "nonce": {"2"}}
+		req := httptest.NewRequest("POST", "/_/bot/wecom?"+q.Encode(), bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post("bad"); code != http.StatusUnauthorized {
+		t.Errorf("bad signature: %d", code)
+	}
+	if code := post(a.signature("1", "2", encrypted)); code != http.StatusOK {
+		t.Fatalf("callback: %d", code)
+	}
+	select {
+	case msg := <-sent:
+		text, _ := msg["text"].(map[string]any)
+		if msg["touser"] != "zhangsan" || !strings.Contains(text["content"].(string), "尚未绑定") {
+			t.Errorf("reply = %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply sent")
+	}
+}
+
+func TestTelegramWebhook(t *testing.T) {
+	sent := make(chan map[string]any, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottok/sendMessage" {
+			http.NotFound(w, r)
+			return
+		}
+		var msg map[string]any
+		json.NewDecoder(r.Body).Decode(&msg)
+		sent <- msg
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer api.Close()
+
+	c := newTestConfig(t, map[string]any{"Telegram": TelegramConfig{
+		Token:         "tok",
+		WebhookUrl:    "https://example.com/_/bot/telegram",
+		WebhookSecret: "s3cret",
+		ApiUrl:        api.URL,
+	}}, botUsers()...)
+	h := CreateApiServer(c)
+	code, _ := c.newBotLink("a")
+
+	post := func(secret string) int {
+		body := `{"update_id":1,"message":{"chat":{"id":7,"type":"private"},"from":{"id":7},"text":"/start ` + code + `"}}`
+		req := httptest.NewRequest("POST", "/_/bot/telegram", strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, secret := range []string{"", "wrong"} {
+		if code := post(secret); code != http.StatusUnauthorized {
+			t.Errorf("secret %q: %d", secret, code)
+		}
+	}
+	if code := post("s3cret"); code != http.StatusOK {
+		t.Fatalf("webhook: %d", code)
+	}
+	select {
+	case msg := <-sent:
+		if msg["chat_id"] != float64(7) || !strings.Contains(msg["text"].(string), "已绑定 A") {
+			t.Errorf("reply = %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply sent")
+	}
+	if u, _ := c.GetUser("a"); u.TelegramChatId != 7 {
+		t.Errorf("TelegramChatId = %d", u.TelegramChatId)
+	}
+}
+
+func TestTelegramPrivateChatsOnly(t *testing.T) {
+	sent := make(chan map[string]any, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]any
+		json.NewDecoder(r.Body).Decode(&msg)
+		sent <- msg
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer api.Close()
+
+	c := newTestConfig(t, map[string]any{"Telegram": TelegramConfig{Token: "tok", ApiUrl: api.URL}}, botUsers()...)
+	code, _ := c.newBotLink("a")
+
+	var u telegramUpdate
+	body := `{"update_id":1,"message":{"chat":{"id":-100,"type":"group"},"from":{"id":42},"text":"/start ` + code + `"}}`
+	if err := json.Unmarshal([]byte(body), &u); err != nil {
+		t.Fatal(err)
+	}
+	c.handleTelegramUpdate(context.Background(), u)
+	select {
+	case msg := <-sent:
+		if msg["chat_id"] != float64(-100) || !strings.Contains(msg["text"].(string), "私聊") {
+			t.Errorf("reply = %v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply sent")
+	}
+	if u, _ := c.GetUser("a"); u.TelegramChatId != 42 {
+		t.Errorf("group linked: TelegramChatId = %d", u.TelegramChatId)
+	}
+	// the code was not used up
+	if r := c.linkChat(botChat{channel: "telegram", id: "7"}, code); !strings.Contains(r.Text, "已绑定") {
+		t.Errorf("link after the group attempt: %q", r.Text)
+	}
+}
@@ -0,0 +1,244 @@
+package xfbbroker
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+type BudgetPeriod string
+
+const (
+	BudgetDaily   BudgetPeriod = "day"
+	BudgetWeekly  BudgetPeriod = "week"
+	BudgetMonthly BudgetPeriod = "month"
+)
+
+// Budget limits spending per period, in yuan. Periods start at midnight,
+// on Monday and on the first of the month in xfb.Location. Spent and
+// Alerted are kept up to date by the transaction poller.
+type Budget struct {
+	Period BudgetPeriod
+	// only transactions of this category count, all if empty
+	Category string
+	Limit    float64
+	// percentages of Limit to alert at, the global BudgetAlerts apply if empty
+	Alerts []int
+
+	Spent       float64
+	PeriodStart time.Time
+	// highest percentage already alerted in this period
+	Alerted int
+}
+
+// BudgetAlert is a budget that crossed one of its alert percentages.
+type BudgetAlert struct {
+	Budget  Budget
+	Percent int
+}
+
+func periodStart(p BudgetPeriod, t time.Time) time.Time {
+	t = t.In(xfb.Location)
+	y, m, d := t.Date()
+	switch p {
+	case BudgetWeekly:
+		// weeks start on Monday
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, xfb.Location)
+	case BudgetMonthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, xfb.Location)
+	default:
+		return time.Date(y, m, d, 0, 0, 0, 0, xfb.Location)
+	}
+}
+
+func periodEnd(p BudgetPeriod, start time.Time) time.Time {
+	switch p {
+	case BudgetWeekly:
+		return start.AddDate(0, 0, 7)
+	case BudgetMonthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// expense is what t cost, payments have a negative Money.
+func expense(t *xfb.Trans) (float64, bool) {
+	m, err := strconv.ParseFloat(t.Money, 64)
+	if err != nil || m >= 0 {
+		return 0, false
+	}
+	return -m, true
+}
+
+func (c *Config) BudgetAlertsOrDefault() []int {
+	if len(c.BudgetAlerts) == 0 {
+		return []int{50, 80, 100}
+	}
+	return c.BudgetAlerts
+}
+
+// current returns b as of now, emptied if a new period has begun.
+func (b Budget) current(now time.Time) Budget {
+	if start := periodStart(b.Period, now); start.After(b.PeriodStart) {
+		b.PeriodStart = start
+		b.Spent = 0
+		b.Alerted = 0
+	}
+	return b
+}
+
+// ApplyBudgets counts t toward the budgets and monthly spending of u and
+// returns the budgets that crossed an alert percentage with it. Every
+// transaction must be applied once, in order.
+func (c *Config) ApplyBudgets(u *User, t *xfb.Trans) []BudgetAlert {
+	cost, ok := expense(t)
+	if !ok {
+		return nil
+	}
+	dt, err := t.DealTime()
+	if err != nil {
+		return nil
+	}
+
+	if month := periodStart(BudgetMonthly, dt); month.After(u.MonthStart) {
+		u.MonthStart = month
+		u.MonthSpent = 0
+	}
+	if !dt.Before(u.MonthStart) {
+		u.MonthSpent += cost
+	}
+
+	var alerts []BudgetAlert
+	category := c.Categorize(t)
+	// replaced as a whole, copies of u taken earlier keep their budgets
+	budgets := slices.Clone(u.Budgets)
+	for i, b := range budgets {
+		if b.Category != "" && b.Category != category {
+			continue
+		}
+		b = b.current(dt)
+		if dt.Before(b.PeriodStart) {
+			continue
+		}
+		b.Spent += cost
+
+		levels := b.Alerts
+		if len(levels) == 0 {
+			levels = c.BudgetAlertsOrDefault()
+		}
+		reached := 0
+		for _, p := range levels {
+			if p > b.Alerted && p > reached && b.Spent >= b.Limit*float64(p)/100 {
+				reached = p
+			}
+		}
+		if reached > 0 {
+			b.Alerted = reached
+			alerts = append(alerts, BudgetAlert{Budget: b, Percent: reached})
+		}
+		budgets[i] = b
+	}
+	u.Budgets = budgets
+	return alerts
+}
+
+type BudgetView struct {
+	Period      BudgetPeriod `json:"period"`
+	Category    string       `json:"category,omitempty"`
+	Limit       float64      `json:"limit"`
+	Spent       float64      `json:"spent"`
+	Remaining   float64      `json:"remaining"`
+	Percent     float64      `json:"percent"`
+	Projected   float64      `json:"projected"`
+	PeriodStart time.Time    `json:"periodStart"`
+	PeriodEnd   time.Time    `json:"periodEnd"`
+}
+
+type BudgetsResponse struct {
+	MonthSpent        float64      `json:"monthSpent"`
+	ProjectedMonthEnd float64      `json:"projectedMonthEnd"`
+	Budgets           []BudgetView `json:"budgets"`
+}
+
+// project extrapolates spent over [start, now) linearly to end. At least
+// an hour is assumed to have passed, so the first deal of a period does
+// not project to a fortune.
+func project(spent float64, start, end, now time.Time) float64 {
+	elapsed := math.Max(now.Sub(start).Hours(), 1)
+	total := end.Sub(start).Hours()
+	if elapsed >= total {
+		return spent
+	}
+	return math.Round(spent*total/elapsed*100) / 100
+}
+
+func budgetsOf(u *User, now time.Time) BudgetsResponse {
+	month := periodStart(BudgetMonthly, now)
+	res := BudgetsResponse{Budgets: []BudgetView{}}
+	if !month.After(u.MonthStart) {
+		res.MonthSpent = u.MonthSpent
+	}
+	res.ProjectedMonthEnd = project(res.MonthSpent, month, periodEnd(BudgetMonthly, month), now)
+
+	for _, b := range u.Budgets {
+		b = b.current(now)
+		end := periodEnd(b.Period, b.PeriodStart)
+		v := BudgetView{
+			Period:      b.Period,
+			Category:    b.Category,
+			Limit:       b.Limit,
+			Spent:       math.Round(b.Spent*100) / 100,
+			Remaining:   math.Round(math.Max(b.Limit-b.Spent, 0)*100) / 100,
+			Projected:   project(b.Spent, b.PeriodStart, end, now),
+			PeriodStart: b.PeriodStart,
+			PeriodEnd:   end,
+		}
+		if b.Limit > 0 {
+			v.Percent = math.Round(b.Spent/b.Limit*1000) / 10
+		}
+		res.Budgets = append(res.Budgets, v)
+	}
+	return res
+}
+
+func validateBudget(b Budget) error {
+	switch b.Period {
+	case BudgetDaily, BudgetWeekly, BudgetMonthly:
+	default:
+		return fmt.Errorf("Period must be day, week or month, got %q", b.Period)
+	}
+	if b.Limit <= 0 {
+		return fmt.Errorf("%s budget: Limit must be greater than 0", b.Period)
+	}
+	for _, p := range b.Alerts {
+		if p <= 0 {
+			return fmt.Errorf("%s budget: Alerts must be greater than 0", b.Period)
+		}
+	}
+	return nil
+}
+
+func (s *ApiServer) handleBudgets(w http.ResponseWriter, r *http.Request) {
+	sess := s.requestSession(r)
+	if sess == "" {
+		http.Error(w, "no sessionId provided", http.StatusBadRequest)
+		return
+	}
+	user := s.lookupSession(r, sess)
+	if user == nil {
+		http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, budgetsOf(user, time.Now()))
+}
+
+func (s *ApiServer) handleV2Budgets(w http.ResponseWriter, r *http.Request, user *User) {
+	writeData(w, r, http.StatusOK, budgetsOf(user, time.Now()))
+}
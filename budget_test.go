@@ -0,0 +1,108 @@
+package xfbbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestApplyBudgetsAlertsOncePerLevel(t *testing.T) {
+	c := newTestConfig(t, nil)
+	u := &User{Budgets: []Budget{{Period: BudgetDaily, Limit: 100}}}
+	steps := []struct {
+		dt    string
+		money float64
+		want  int
+	}{
+		{"2024-05-06 08:00:00", -40, 0},
+		{"2024-05-06 12:00:00", -20, 50},
+		{"2024-05-06 13:00:00", -5, 0},
+		{"2024-05-06 18:00:00", -40, 100}, // 80 is skipped, only the highest level
+		{"2024-05-06 19:00:00", -10, 0},
+		{"2024-05-06 20:00:00", 50, 0}, // a recharge is no expense
+		{"2024-05-07 08:00:00", -55, 50},
+	}
+	for i, s := range steps {
+		tr := deal(i, s.dt, s.money, 0, "食堂")
+		alerts := c.ApplyBudgets(u, &tr)
+		got := 0
+		if len(alerts) == 1 {
+			got = alerts[0].Percent
+		} else if len(alerts) > 1 {
+			t.Fatalf("step %d: %d alerts", i, len(alerts))
+		}
+		if got != s.want {
+			t.Errorf("step %d: alert at %d%%, want %d%%", i, got, s.want)
+		}
+	}
+	if b := u.Budgets[0]; b.Spent != 55 || !b.PeriodStart.Equal(time.Date(2024, 5, 7, 0, 0, 0, 0, xfb.Location)) {
+		t.Errorf("budget after rollover = %+v", b)
+	}
+	if u.MonthSpent != 170 {
+		t.Errorf("MonthSpent = %v, want 170", u.MonthSpent)
+	}
+}
+
+func TestApplyBudgetsCategoryAndCustomLevels(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"BudgetAlerts": []int{90}})
+	u := &User{Budgets: []Budget{
+		{Period: BudgetWeekly, Category: CategoryCanteen, Limit: 10},
+		{Period: BudgetMonthly, Limit: 100, Alerts: []int{25}},
+	}}
+	shop := deal(1, "2024-05-06 08:00:00", -30, 0, "超市")
+	if alerts := c.ApplyBudgets(u, &shop); len(alerts) != 1 || alerts[0].Budget.Period != BudgetMonthly || alerts[0].Percent != 25 {
+		t.Errorf("supermarket deal: %+v", alerts)
+	}
+	food := deal(2, "2024-05-08 12:00:00", -9.5, 0, "一食堂")
+	if alerts := c.ApplyBudgets(u, &food); len(alerts) != 1 || alerts[0].Budget.Category != CategoryCanteen || alerts[0].Percent != 90 {
+		t.Errorf("canteen deal: %+v", alerts)
+	}
+	if u.Budgets[0].Spent != 9.5 || u.Budgets[1].Spent != 39.5 {
+		t.Errorf("spent = %v, %v", u.Budgets[0].Spent, u.Budgets[1].Spent)
+	}
+	// the week starts on Monday
+	if want := time.Date(2024, 5, 6, 0, 0, 0, 0, xfb.Location); !u.Budgets[0].PeriodStart.Equal(want) {
+		t.Errorf("week starts %v", u.Budgets[0].PeriodStart)
+	}
+}
+
+func TestApplyBudgetsLeavesEarlierCopies(t *testing.T) {
+	c := newTestConfig(t, nil)
+	u := &User{Budgets: []Budget{{Period: BudgetDaily, Limit: 100}}}
+	before := *u
+	tr := deal(1, "2024-05-06 08:00:00", -40, 0, "食堂")
+	c.ApplyBudgets(u, &tr)
+	if before.Budgets[0].Spent != 0 {
+		t.Error("ApplyBudgets wrote to the slice of an earlier copy")
+	}
+}
+
+func TestBudgetsOfProjects(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, xfb.Location)
+	u := &User{
+		MonthStart: time.Date(2024, 5, 1, 0, 0, 0, 0, xfb.Location),
+		MonthSpent: 100,
+		Budgets: []Budget{
+			{Period: BudgetDaily, Limit: 40, Spent: 30, PeriodStart: time.Date(2024, 5, 6, 0, 0, 0, 0, xfb.Location)},
+			// from a past day, shown as a fresh period
+			{Period: BudgetDaily, Limit: 40, Spent: 30, PeriodStart: time.Date(2024, 5, 5, 0, 0, 0, 0, xfb.Location)},
+		},
+	}
+	res := budgetsOf(u, now)
+	// 5.5 of 31 days have passed
+	if res.MonthSpent != 100 || res.ProjectedMonthEnd != 563.64 {
+		t.Errorf("month = %+v", res)
+	}
+	b := res.Budgets[0]
+	if b.Remaining != 10 || b.Percent != 75 || b.Projected != 60 {
+		t.Errorf("today = %+v", b)
+	}
+	if old := res.Budgets[1]; old.Spent != 0 || old.Remaining != 40 {
+		t.Errorf("stale period = %+v", old)
+	}
+	u.MonthStart = time.Date(2024, 4, 1, 0, 0, 0, 0, xfb.Location)
+	if res := budgetsOf(u, now); res.MonthSpent != 0 {
+		t.Errorf("spending of last month counted: %v", res.MonthSpent)
+	}
+}
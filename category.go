@@ -0,0 +1,175 @@
+package xfbbroker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// Merchant categories used by budgets.
+const (
+	CategoryCanteen     = "canteen"
+	CategorySupermarket = "supermarket"
+	CategoryLaundry     = "laundry"
+	CategoryUtilities   = "utilities"
+	CategoryPrinting    = "printing"
+	CategoryShower      = "shower"
+	CategoryTopUp       = "top-up"
+	CategoryOther       = "other"
+)
+
+const (
+	MealBreakfast = "breakfast"
+	MealLunch     = "lunch"
+	MealDinner    = "dinner"
+)
+
+// CategoryRule assigns Category to the transactions it matches. Exactly
+// one of BusinessNum, Merchant and Pattern is set.
+type CategoryRule struct {
+	Category string
+	// upstream merchant number
+	BusinessNum string
+	// exact merchant name or address
+	Merchant string
+	// regular expression matched against the fee name, merchant name and
+	// address
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+func (r *CategoryRule) validate() error {
+	n := 0
+	for _, m := range []string{r.BusinessNum, r.Merchant, r.Pattern} {
+		if m != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of BusinessNum, Merchant and Pattern must be set")
+	}
+	if r.Category == "" {
+		return errors.New("Category is required")
+	}
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileCategoryRules prepares the patterns of CategoryRules. Invalid
+// ones never match and are reported by Validate.
+func (c *Config) compileCategoryRules() {
+	for i := range c.CategoryRules {
+		if c.CategoryRules[i].Pattern != "" {
+			c.CategoryRules[i].re, _ = regexp.Compile(c.CategoryRules[i].Pattern)
+		}
+	}
+}
+
+func (c *Config) validateCategoryRules() []error {
+	var errs []error
+	for i := range c.CategoryRules {
+		if err := c.CategoryRules[i].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("CategoryRules[%d]: %w", i, err))
+		}
+	}
+	return errs
+}
+
+func (r *CategoryRule) matches(t *xfb.Trans) bool {
+	switch {
+	case r.BusinessNum != "":
+		return t.BusinessNum == r.BusinessNum
+	case r.Merchant != "":
+		return t.BusinessName == r.Merchant || t.Address == r.Merchant
+	case r.re != nil:
+		return r.re.MatchString(t.FeeName) || r.re.MatchString(t.BusinessName) || r.re.MatchString(t.Address)
+	}
+	return false
+}
+
+// categoryKeywords are tried after the configured rules.
+var categoryKeywords = []struct {
+	keyword  string
+	category string
+}{
+	{"充值", CategoryTopUp},
+	{"写卡", CategoryTopUp},
+	{"食堂", CategoryCanteen},
+	{"餐厅", CategoryCanteen},
+	{"超市", CategorySupermarket},
+	{"洗衣", CategoryLaundry},
+	{"电费", CategoryUtilities},
+	{"水费", CategoryUtilities},
+	{"打印", CategoryPrinting},
+	{"淋浴", CategoryShower},
+	{"浴室", CategoryShower},
+}
+
+// Categorize tells what kind of merchant t was paid to, by the first
+// matching CategoryRules entry or else by keywords in its fee name,
+// merchant and address.
+func (c *Config) Categorize(t *xfb.Trans) string {
+	for i := range c.CategoryRules {
+		if c.CategoryRules[i].matches(t) {
+			return c.CategoryRules[i].Category
+		}
+	}
+	for _, s := range []string{t.FeeName, t.BusinessName, t.Address} {
+		for _, k := range categoryKeywords {
+			if strings.Contains(s, k.keyword) {
+				return k.category
+			}
+		}
+	}
+	return CategoryOther
+}
+
+// MealType tells which meal a canteen deal at t was, or "" outside of
+// meal times.
+func MealType(t *xfb.Trans) string {
+	dt, err := t.DealTime()
+	if err != nil {
+		return ""
+	}
+	m := dt.Hour()*60 + dt.Minute()
+	switch {
+	case m >= 5*60 && m < 10*60+30:
+		return MealBreakfast
+	case m >= 10*60+30 && m < 15*60:
+		return MealLunch
+	case m >= 16*60 && m < 22*60:
+		return MealDinner
+	}
+	return ""
+}
+
+// Transaction is an xfb.Trans with what the broker infers about it.
+type Transaction struct {
+	xfb.Trans
+	Category string `json:"category"`
+	MealType string `json:"mealType,omitempty"`
+}
+
+func (c *Config) Annotate(t *xfb.Trans) Transaction {
+	res := Transaction{Trans: *t, Category: c.Categorize(t)}
+	if res.Category == CategoryCanteen {
+		res.MealType = MealType(t)
+	}
+	return res
+}
+
+func (c *Config) AnnotateAll(rows []xfb.Trans) []Transaction {
+	res := make([]Transaction, 0, len(rows))
+	for i := range rows {
+		res = append(res, c.Annotate(&rows[i]))
+	}
+	return res
+}
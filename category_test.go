@@ -0,0 +1,76 @@
+package xfbbroker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestCategorize(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"CategoryRules": []CategoryRule{
+		{Category: "coffee", BusinessNum: "B42"},
+		{Category: CategorySupermarket, Merchant: "北门小卖部"},
+		{Category: "books", Pattern: "^书店|图书"},
+	}})
+	for _, tc := range []struct {
+		trans xfb.Trans
+		want  string
+	}{
+		{xfb.Trans{BusinessNum: "B42", BusinessName: "一食堂咖啡"}, "coffee"},
+		{xfb.Trans{BusinessName: "北门小卖部"}, CategorySupermarket},
+		{xfb.Trans{Address: "北门小卖部"}, CategorySupermarket},
+		{xfb.Trans{BusinessName: "书店二楼"}, "books"},
+		{xfb.Trans{Address: "南区图书馆打印"}, "books"},
+		{xfb.Trans{FeeName: "充值", BusinessName: "一食堂"}, CategoryTopUp},
+		{xfb.Trans{BusinessName: "二食堂"}, CategoryCanteen},
+		{xfb.Trans{Address: "5号楼洗衣房"}, CategoryLaundry},
+		{xfb.Trans{BusinessName: "北门小卖部二店"}, CategoryOther},
+	} {
+		if got := c.Categorize(&tc.trans); got != tc.want {
+			t.Errorf("%+v: %s, want %s", tc.trans, got, tc.want)
+		}
+	}
+}
+
+func TestValidateCategoryRules(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"CategoryRules": []CategoryRule{
+		{Category: "a", Merchant: "x"},
+		{Category: "b"},
+		{Category: "c", Merchant: "x", Pattern: "y"},
+		{Merchant: "x"},
+		{Category: "d", Pattern: "("},
+	}})
+	errs := c.validateCategoryRules()
+	if len(errs) != 4 {
+		t.Fatalf("%d errors: %v", len(errs), errs)
+	}
+	for i, want := range []string{"[1]: exactly one", "[2]: exactly one", "[3]: Category is required", "[4]: error parsing regexp"} {
+		if !strings.Contains(errs[i].Error(), want) {
+			t.Errorf("error %d: %v", i, errs[i])
+		}
+	}
+	// an invalid pattern never matches
+	if got := c.Categorize(&xfb.Trans{BusinessName: "("}); got != CategoryOther {
+		t.Errorf("invalid pattern matched: %s", got)
+	}
+}
+
+func TestAnnotateMealType(t *testing.T) {
+	c := newTestConfig(t, nil)
+	for _, tc := range []struct {
+		dt, business, category, meal string
+	}{
+		{"2024-05-06 04:59:00", "一食堂", CategoryCanteen, ""},
+		{"2024-05-06 07:30:00", "一食堂", CategoryCanteen, MealBreakfast},
+		{"2024-05-06 10:30:00", "一食堂", CategoryCanteen, MealLunch},
+		{"2024-05-06 15:30:00", "一食堂", CategoryCanteen, ""},
+		{"2024-05-06 18:00:00", "一食堂", CategoryCanteen, MealDinner},
+		{"2024-05-06 12:00:00", "超市", CategorySupermarket, ""},
+	} {
+		got := c.Annotate(&xfb.Trans{Dealtime: tc.dt, BusinessName: tc.business})
+		if got.Category != tc.category || got.MealType != tc.meal {
+			t.Errorf("%s at %s: %s/%s", tc.business, tc.dt, got.Category, got.MealType)
+		}
+	}
+}
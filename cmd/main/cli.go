@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/yiffyi/gorad"
+	"github.com/yiffyi/xfbbroker"
+	"github.com/yiffyi/xfbbroker/telemetry"
+)
+
+var (
+	configPath string
+	dryRun     bool
+	// flushes pending spans, set by setup
+	shutdownTracing func(context.Context) error
+)
+
+const usage = `Usage: %s [flags] <command>
+
+Commands:
+  serve          run the polling loops and the HTTP server (default)
+  check-config   validate the config file and exit
+  poll-once      run a single balance and transaction check for all users
+  healthcheck    exit 0 if the running server reports ready, for containers
+  version        print build information
+
+Flags:
+`
+
+func main() {
+	flag.StringVar(&configPath, "config", "config.json", "path to the config file")
+	flag.BoolVar(&dryRun, "dry-run", false, "skip recharges, notifications and config writes")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd := flag.Arg(0)
+	if cmd == "" {
+		cmd = "serve"
+	}
+
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe()
+	case "check-config":
+		err = runCheckConfig()
+	case "poll-once":
+		err = runPollOnce()
+	case "healthcheck":
+		err = runHealthcheck()
+	case "version":
+		printVersion()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func printVersion() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Println("xfbbroker (no build info)")
+		return
+	}
+
+	fmt.Printf("%s %s\n", info.Main.Path, info.Main.Version)
+	fmt.Printf("go: %s\n", info.GoVersion)
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH":
+			fmt.Printf("%s: %s\n", s.Key, s.Value)
+		}
+	}
+}
+
+// setup loads and validates the config, then installs the slog handler.
+func setup() error {
+	var err error
+	cfg, err = xfbbroker.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if err = cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s:\n%w", configPath, err)
+	}
+
+	level := slog.LevelInfo
+	if cfg.Debug {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(telemetry.SlogHandler{Handler: gorad.NewTextFileSlogHandler(cfg.LogFileName, level)}))
+
+	shutdownTracing, err = telemetry.Setup(context.Background(), cfg.TraceExporter, cfg.TraceEndpoint)
+	if err != nil {
+		return fmt.Errorf("unable to set up tracing: %w", err)
+	}
+	cfg.SetDryRun(dryRun)
+	if dryRun {
+		slog.Warn("dry-run enabled: no payments, notifications or config writes")
+	}
+	return nil
+}
+
+func runCheckConfig() error {
+	c, err := xfbbroker.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if err = c.Validate(); err != nil {
+		return fmt.Errorf("invalid config %s:\n%w", configPath, err)
+	}
+	fmt.Printf("%s: ok, %d users\n", configPath, len(c.UserIds()))
+	return nil
+}
+
+func runHealthcheck() error {
+	c, err := xfbbroker.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	return c.ProbeReady(context.Background())
+}
+
+func runPollOnce() error {
+	if err := setup(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pollOnce(ctx)
+	cfg.CloseWebhooks(cfg.ShutdownTimeoutDuration())
+	return shutdownTracing(context.Background())
+}
+
+func runServe() error {
+	if err := setup(); err != nil {
+		return err
+	}
+	slog.Warn("Program started")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx)
+}
+
+// serve runs the polling loops and the HTTP server until ctx is cancelled
+// or a listener fails, then shuts everything down within ShutdownTimeout.
+func serve(ctx context.Context) error {
+	tlsConfig, challenge, err := cfg.ServerTLS()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	sched := newScheduler()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sched.Run(ctx)
+	}()
+
+	if mq = xfbbroker.NewMQTT(cfg); mq != nil {
+		mq.Refresh = func(k string) {
+			sched.Trigger(jobBalance, k)
+			sched.Trigger(jobTrans, k)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mq.Run(ctx)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cfg.RunTelegram(ctx)
+	}()
+
+	srv := &http.Server{
+		Addr:      cfg.ListenAddr,
+		Handler:   xfbbroker.CreateApiServer(cfg),
+		TLSConfig: tlsConfig,
+	}
+	srvErr := make(chan error, 2)
+	go func() {
+		if tlsConfig != nil {
+			// the certificate comes from TLSConfig
+			srvErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			srvErr <- srv.ListenAndServe()
+		}
+	}()
+	// answers ACME HTTP-01 challenges, redirects anything else to HTTPS
+	var challengeSrv *http.Server
+	if challenge != nil {
+		challengeSrv = &http.Server{Addr: cfg.ACME.HTTPAddr, Handler: challenge}
+		go func() {
+			srvErr <- challengeSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		slog.Warn("shutting down", "timeout", cfg.ShutdownTimeoutDuration())
+	case err = <-srvErr:
+		// the listener failed, bring the loops down as well
+		slog.Error("HTTP server failed", "err", err)
+		stop()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeoutDuration())
+	defer cancel()
+
+	if e := srv.Shutdown(shutdownCtx); e != nil {
+		slog.Error("HTTP server shutdown", "err", e)
+	}
+	if challengeSrv != nil {
+		challengeSrv.Shutdown(shutdownCtx)
+	}
+
+	loopsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-shutdownCtx.Done():
+		slog.Error("polling loops did not finish before shutdown timeout")
+	}
+	// give webhook deliveries what is left of the timeout
+	deadline, _ := shutdownCtx.Deadline()
+	cfg.CloseWebhooks(time.Until(deadline))
+
+	saveConfig()
+	if e := shutdownTracing(shutdownCtx); e != nil {
+		slog.Error("unable to flush traces", "err", e)
+	}
+	slog.Warn("Program stopped")
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
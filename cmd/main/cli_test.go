@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker"
+)
+
+// writeConfig writes a config file and points configPath at it.
+func writeConfig(t *testing.T, data string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	orig := configPath
+	configPath = path
+	t.Cleanup(func() { configPath = orig })
+}
+
+// loadConfig writes data as the config and loads it into cfg.
+func loadConfig(t *testing.T, data string) {
+	t.Helper()
+	writeConfig(t, data)
+	var err error
+	if cfg, err = xfbbroker.LoadConfig(configPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cfg = nil })
+}
+
+const validConfig = `{"CheckTransInterval":60,"CheckBalanceInterval":60,"ListenAddr":":8000",
+"Users":{"a":{"Name":"A","YmUserId":"a"}}}`
+
+func TestCheckConfig(t *testing.T) {
+	writeConfig(t, validConfig)
+	if err := runCheckConfig(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+
+	writeConfig(t, `{"CheckBalanceInterval":60,"Users":{"a":{"YmUserId":"a"}}}`)
+	err := runCheckConfig()
+	if err == nil || !strings.Contains(err.Error(), "CheckTransInterval") || !strings.Contains(err.Error(), "Name is required") {
+		t.Errorf("invalid config: %v", err)
+	}
+}
+
+func TestSaveConfigDryRun(t *testing.T) {
+	loadConfig(t, validConfig)
+	cfg.UpdateUser("a", func(u *xfbbroker.User) { u.LastSerial = 987654 })
+
+	cfg.SetDryRun(true)
+	saveConfig()
+	if data, _ := os.ReadFile(configPath); strings.Contains(string(data), "987654") {
+		t.Error("dry run saved the config")
+	}
+	cfg.SetDryRun(false)
+	saveConfig()
+	if data, _ := os.ReadFile(configPath); !strings.Contains(string(data), "987654") {
+		t.Error("config not saved")
+	}
+}
+
+// serveInBackground runs serve until the test ends and returns its result.
+func serveInBackground(t *testing.T, ctx context.Context) <-chan error {
+	orig := shutdownTracing
+	shutdownTracing = func(context.Context) error { return nil }
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx) }()
+	t.Cleanup(func() { shutdownTracing = orig })
+	return done
+}
+
+func TestServeShutsDown(t *testing.T) {
+	loadConfig(t, `{"CheckTransInterval":60,"CheckBalanceInterval":60,"ListenAddr":"127.0.0.1:0","ShutdownTimeout":5,
+"Users":{"a":{"Name":"A","YmUserId":"a"}}}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serveInBackground(t, ctx)
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestServeStopsWhenListenerFails(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	loadConfig(t, `{"CheckTransInterval":60,"CheckBalanceInterval":60,"ListenAddr":"`+l.Addr().String()+`","ShutdownTimeout":5}`)
+
+	select {
+	case err := <-serveInBackground(t, context.Background()):
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept running without its listener")
+	}
+}
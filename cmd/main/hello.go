@@ -1,54 +1,34 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"runtime/debug"
 
 	"log/slog"
-	"net/http"
-	"net/url"
 	"strconv"
 	"time"
 
-	"github.com/yiffyi/gorad"
 	"github.com/yiffyi/gorad/notification"
 	"github.com/yiffyi/xfbbroker"
+	"github.com/yiffyi/xfbbroker/telemetry"
 	"github.com/yiffyi/xfbbroker/xfb"
+	"go.opentelemetry.io/otel/codes"
 )
 
 var cfg *xfbbroker.Config
 
-func rechargeToThreshold(curBalance float64, u *xfbbroker.User) error {
+// mq is nil unless MQTT is configured and serving
+var mq *xfbbroker.MQTT
+
+func rechargeToThreshold(ctx context.Context, curBalance float64, u *xfbbroker.User) error {
 	if u.Threshold-curBalance >= 10 {
 		delta := u.Threshold - curBalance
 		if delta > 100 {
 			delta = 100.0
 		}
 
-		payUrl, err := xfb.RechargeOnCard(strconv.FormatFloat(delta, 'f', 2, 64), u.OpenId, u.SessionId, u.YmUserId)
-		if err != nil {
-			slog.Error("unable to recharge", "err", err)
-			return err
-		}
-		url, _ := url.Parse(payUrl)
-		tranNo := url.Query().Get("tran_no")
-
-		_, err = xfb.SignPayCheck(tranNo)
-		if err != nil {
-			slog.Error("signpay check failed", "err", err)
-			return err
-		}
-		err = xfb.PayChoose(tranNo)
-		if err != nil {
-			slog.Error("choose signpay failed", "err", err)
-			return err
-		}
-		err = xfb.DoPay(tranNo)
-		if err != nil {
-			slog.Error("unable to pay", "err", err)
-			return err
-		}
-		slog.Info("recharge to balance", "name", u.Name, "delta", delta, "tranNo", tranNo)
+		_, err := cfg.Recharge(ctx, u, delta)
+		return err
 	}
 	return nil
 }
@@ -75,10 +55,48 @@ func needNotify(feeName string) bool {
 	return true
 }
 
-func sendNotify(key string, t *xfb.Trans) error {
+var categoryNames = map[string]string{
+	xfbbroker.CategoryCanteen:     "餐饮",
+	xfbbroker.CategorySupermarket: "超市",
+	xfbbroker.CategoryLaundry:     "洗衣",
+	xfbbroker.CategoryUtilities:   "水电",
+	xfbbroker.CategoryPrinting:    "打印",
+	xfbbroker.CategoryShower:      "淋浴",
+	xfbbroker.CategoryTopUp:       "充值",
+	xfbbroker.CategoryOther:       "其他",
+}
+
+// categoryName shows configured categories without a translation as is.
+func categoryName(c string) string {
+	if n, ok := categoryNames[c]; ok {
+		return n
+	}
+	return c
+}
+
+var mealNames = map[string]string{
+	xfbbroker.MealBreakfast: "早餐",
+	xfbbroker.MealLunch:     "午餐",
+	xfbbroker.MealDinner:    "晚餐",
+}
+
+func sendNotify(ctx context.Context, key string, t *xfb.Trans) error {
 	if len(key) == 0 {
 		return nil
 	}
+	if dryRun {
+		slog.InfoContext(ctx, "dry-run: notification skipped", "serial", t.Serialno)
+		return nil
+	}
+	ctx, span := telemetry.Tracer.Start(ctx, "notify wecom")
+	defer span.End()
+
+	tx := cfg.Annotate(t)
+	category := categoryName(tx.Category)
+	if meal := mealNames[tx.MealType]; meal != "" {
+		category += " · " + meal
+	}
+
 	bot := notification.WeComBot{Key: key}
 	msg := map[string]any{
 		"msgtype": "template_card",
@@ -99,6 +117,10 @@ func sendNotify(key string, t *xfb.Trans) error {
 					"keyname": "余额",
 					"value":   t.AfterMon,
 				},
+				{
+					"keyname": "分类",
+					"value":   category,
+				},
 				{
 					"keyname": "流水号",
 					"value":   t.Serialno,
@@ -118,13 +140,136 @@ func sendNotify(key string, t *xfb.Trans) error {
 			},
 		},
 	}
-	return bot.SendMessage(msg)
+	err := bot.SendMessage(msg)
+	xfbbroker.ObserveNotification("wecom", err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// sendLowBalance warns that wallet w fell below its threshold. Only the
+// main balance is recharged automatically, so this is the only signal for
+// the other wallets.
+func sendLowBalance(ctx context.Context, key string, w *xfbbroker.Wallet) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if dryRun {
+		slog.InfoContext(ctx, "dry-run: low balance notification skipped", "wallet", w.Name, "balance", w.Balance)
+		return nil
+	}
+	ctx, span := telemetry.Tracer.Start(ctx, "notify wecom")
+	defer span.End()
+
+	bot := notification.WeComBot{Key: key}
+	msg := map[string]any{
+		"msgtype": "template_card",
+		"template_card": map[string]any{
+			"card_type": "text_notice",
+			"source": map[string]any{
+				"desc": "校园卡账单",
+			},
+			"main_title": map[string]any{
+				"title": "余额不足",
+				"desc":  w.Name,
+			},
+			"emphasis_content": map[string]any{
+				"title": fmt.Sprintf("￥%.2f", w.Balance),
+			},
+			"horizontal_content_list": []map[string]string{
+				{
+					"keyname": "提醒阈值",
+					"value":   fmt.Sprintf("￥%.2f", w.Threshold),
+				},
+				{
+					"keyname": "账号",
+					"value":   w.AccNum,
+				},
+			},
+			"card_action": map[string]any{
+				"type": 1,
+				"url":  cfg.AuthLocalUrl,
+			},
+		},
+	}
+	err := bot.SendMessage(msg)
+	xfbbroker.ObserveNotification("wecom", err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+var budgetPeriodNames = map[xfbbroker.BudgetPeriod]string{
+	xfbbroker.BudgetDaily:   "今日",
+	xfbbroker.BudgetWeekly:  "本周",
+	xfbbroker.BudgetMonthly: "本月",
+}
+
+// sendBudgetAlert tells the user a budget reached one of its alert
+// percentages.
+func sendBudgetAlert(ctx context.Context, key string, a *xfbbroker.BudgetAlert) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if dryRun {
+		slog.InfoContext(ctx, "dry-run: budget alert skipped", "period", a.Budget.Period, "percent", a.Percent)
+		return nil
+	}
+	ctx, span := telemetry.Tracer.Start(ctx, "notify wecom")
+	defer span.End()
+
+	title := budgetPeriodNames[a.Budget.Period] + "预算"
+	if a.Budget.Category != "" {
+		title += " (" + categoryName(a.Budget.Category) + ")"
+	}
+	bot := notification.WeComBot{Key: key}
+	msg := map[string]any{
+		"msgtype": "template_card",
+		"template_card": map[string]any{
+			"card_type": "text_notice",
+			"source": map[string]any{
+				"desc": "校园卡账单",
+			},
+			"main_title": map[string]any{
+				"title": title,
+				"desc":  fmt.Sprintf("已使用 %d%%", a.Percent),
+			},
+			"emphasis_content": map[string]any{
+				"title": fmt.Sprintf("￥%.2f", a.Budget.Spent),
+				"desc":  fmt.Sprintf("预算 ￥%.2f", a.Budget.Limit),
+			},
+			"card_action": map[string]any{
+				"type": 1,
+				"url":  cfg.AuthLocalUrl,
+			},
+		},
+	}
+	err := bot.SendMessage(msg)
+	xfbbroker.ObserveNotification("wecom", err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
 }
 
-func sendError(key string, err error, u *xfbbroker.User) error {
+// sendError tells the user polling stopped or slowed down; hint explains
+// what happens next. The card links to AuthLocalUrl for re-authorization.
+func sendError(ctx context.Context, key string, hint string, err error, u *xfbbroker.User) error {
 	if len(key) == 0 {
 		return nil
 	}
+	if dryRun {
+		slog.InfoContext(ctx, "dry-run: error notification skipped", "name", u.Name, "err", err)
+		return nil
+	}
+	ctx, span := telemetry.Tracer.Start(ctx, "notify wecom")
+	defer span.End()
+
 	bot := notification.WeComBot{Key: key}
 	msg := map[string]any{
 		"msgtype": "template_card",
@@ -137,7 +282,7 @@ func sendError(key string, err error, u *xfbbroker.User) error {
 				"title": "请求错误",
 				"desc":  u.Name,
 			},
-			"sub_title_text": "自动轮询已取消，点击重新授权\n" + err.Error(),
+			"sub_title_text": hint + "\n" + err.Error(),
 			"horizontal_content_list": []map[string]string{
 				{
 					"keyname": "ymId",
@@ -150,167 +295,202 @@ func sendError(key string, err error, u *xfbbroker.User) error {
 			},
 		},
 	}
-	return bot.SendMessage(msg)
+	e := bot.SendMessage(msg)
+	xfbbroker.ObserveNotification("wecom", e)
+	if e != nil {
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+	}
+	return e
 }
 
-func checkTransLoop() {
-	ticker := time.NewTicker(time.Duration(cfg.CheckTransInterval) * time.Second)
-	for {
-		// select {
-		// case <-ticker.C:
-		needSave := false
-		for k := range cfg.Users {
-			u, _ := cfg.GetUser(k) // ensure locking
-			if u.Enabled && u.Failed < 3 {
-				total, rows, err := xfb.CardQuerynoPage(u.SessionId, u.YmUserId, time.Now())
-				if err != nil {
-					slog.Error("CardQuerynoPage failed", "err", err)
-					goto fail
-				} else {
-					updated := false
-					slog.Debug("check trans", "name", u.Name, "total", total)
-
-					for i := len(rows) - 1; i >= 0; i-- {
-						v := rows[i]
-						s, err := strconv.Atoi(v.Serialno)
-						if err != nil {
-							slog.Error("bad Serialno", "err", err, "name", u.Name, "serial", v.Serialno)
-							continue
-						}
-						if s > u.LastSerial {
-							slog.Info("New transaction", "detail", v)
-
-							if needNotify(v.FeeName) {
-								err = sendNotify(u.WeComBotKey, &v)
-								if err != nil {
-									slog.Error("failed to notify", "err", err)
-									break
-								}
-							} else {
-								slog.Info("skipped", "feeName", v.FeeName)
-							}
-
-							if u.LastSerial < s {
-								u.LastSerial = s
-							}
-							updated = true
-						} else {
-							continue
-						}
-					}
-
-					if updated {
-						goto set
-					}
-				}
+// pollTrans checks user k for new transactions and notifies about each of
+// them. It reports whether the user record was changed.
+func pollTrans(ctx context.Context, k string) (bool, error) {
+	u, ok := cfg.GetUser(k) // ensure locking
+	if !ok || !u.Enabled {
+		return false, nil
+	}
 
-				// success?
-				continue
-			fail:
-				u.Failed++
-				if u.Failed <= 3 {
-					sendError(u.WeComBotKey, err, &u)
-				}
-				// fallthrough
-			set:
-				needSave = true
-				cfg.SetUser(k, u)
-			}
+	total, rows, err := xfb.CardQuerynoPage(ctx, u.SessionId, u.YmUserId, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "CardQuerynoPage failed", "err", err, "name", u.Name)
+		return false, err
+	}
+	slog.DebugContext(ctx, "check trans", "name", u.Name, "total", total)
+
+	lastSerial := u.LastSerial
+	muted := u.Muted(time.Now())
+	var deals []xfb.Trans
+	for i := len(rows) - 1; i >= 0; i-- {
+		v := rows[i]
+		s, err := strconv.Atoi(v.Serialno)
+		if err != nil {
+			slog.ErrorContext(ctx, "bad Serialno", "err", err, "name", u.Name, "serial", v.Serialno)
+			continue
 		}
-
-		if needSave {
-			cfg.Save()
+		if s <= lastSerial {
+			continue
 		}
 
-		<-ticker.C
-		// }
+		slog.InfoContext(ctx, "New transaction", "detail", v)
+		if muted {
+			slog.InfoContext(ctx, "muted", "until", u.MutedUntil)
+		} else if needNotify(v.FeeName) {
+			err = sendNotify(ctx, u.WeComBotKey, &v)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed to notify", "err", err)
+				break
+			}
+		} else {
+			slog.InfoContext(ctx, "skipped", "feeName", v.FeeName)
+		}
+		lastSerial = s
+		deals = append(deals, v)
 	}
-}
 
-func checkBalanceLoop() {
-	ticker := time.NewTicker(time.Duration(cfg.CheckBalanceInterval) * time.Second)
-	for {
-		// select {
-		// case <-ticker.C:
-		needSave := false
-		for k := range cfg.Users {
-			u, _ := cfg.GetUser(k) // ensure locking
-			if u.Enabled {
-				s, err := xfb.GetCardMoney(u.SessionId, u.YmUserId)
-				if err != nil {
-					slog.Error("unable to query card balance", "err", err, "name", u.Name)
-					goto fail
-				}
-				if s == "- - -" {
-					slog.Info(`GetCardMoney returned "- - -"`)
-					continue
-				}
-
-				{ // make goto work
-					balance, err := strconv.ParseFloat(s, 64)
-					if err != nil {
-						slog.Error("unable to parse card balance", "err", err, "name", u.Name, "rawbalance", s)
-						goto fail
-					}
-					slog.Info("check balance", "name", u.Name, "balance", balance, "threshold", u.Threshold)
-					// fmt.Printf("%s, current: %.2f, threshold: %.2f\n", u.Name, balance, u.Threshold)
-					err = rechargeToThreshold(balance, &u)
-					if err != nil {
-						slog.Error("unable to recharge card balance", "err", err, "name", u.Name, "balance", balance)
-						goto fail
-					}
-				}
-
-				// success?
-
-				if u.Failed != 0 {
-					u.Failed = 0
-					goto set
-				}
-				continue
-			fail:
-				u.Failed++
-				if u.Failed <= 3 {
-					sendError(u.WeComBotKey, err, &u)
+	if lastSerial == u.LastSerial {
+		return false, nil
+	}
+	if dryRun {
+		// nothing was notified, the next run sees the same deals again
+		slog.InfoContext(ctx, "dry-run: LastSerial not advanced", "name", u.Name, "deals", len(deals))
+		return false, nil
+	}
+	var low []xfbbroker.Wallet
+	var over []xfbbroker.BudgetAlert
+	cfg.UpdateUser(k, func(u *xfbbroker.User) {
+		if u.LastSerial < lastSerial {
+			u.LastSerial = lastSerial
+			for i := range deals {
+				u.RecordDeal(&deals[i])
+				if w, crossed := u.ApplyDeal(&deals[i]); crossed {
+					low = append(low, w)
 				}
-				// fallthrough
-			set:
-				needSave = true
-				cfg.SetUser(k, u)
+				over = append(over, cfg.ApplyBudgets(u, &deals[i])...)
 			}
 		}
-
-		if needSave {
-			cfg.Save()
+	})
+	for i := range deals {
+		cfg.Emit(k, xfbbroker.EventTransactionCreated, cfg.Annotate(&deals[i]))
+	}
+	if len(deals) > 0 {
+		mq.PublishTransaction(k, cfg.Annotate(&deals[len(deals)-1]))
+	}
+	for i := range low {
+		cfg.Emit(k, xfbbroker.EventBalanceLow, map[string]any{
+			"name":      low[i].Name,
+			"accNum":    low[i].AccNum,
+			"eWalletId": low[i].EWalletId,
+			"balance":   low[i].Balance,
+			"threshold": low[i].Threshold,
+		})
+		if muted {
+			continue
+		}
+		if err := sendLowBalance(ctx, u.WeComBotKey, &low[i]); err != nil {
+			slog.ErrorContext(ctx, "failed to notify low balance", "err", err, "wallet", low[i].Name)
 		}
-		// case <-stop:
-		// 	return
-		// }
-
-		<-ticker.C
 	}
+	for i := range over {
+		slog.InfoContext(ctx, "budget alert", "name", u.Name, "period", over[i].Budget.Period, "category", over[i].Budget.Category, "percent", over[i].Percent)
+		if muted {
+			continue
+		}
+		if err := sendBudgetAlert(ctx, u.WeComBotKey, &over[i]); err != nil {
+			slog.ErrorContext(ctx, "failed to notify budget alert", "err", err)
+		}
+	}
+	return true, nil
 }
 
-func main() {
-	dbginfo, _ := debug.ReadBuildInfo()
-	println(dbginfo.String())
-	slog.Warn("Program started")
+// pollBalance recharges user k back to its threshold when needed.
+func pollBalance(ctx context.Context, k string) (bool, error) {
+	u, ok := cfg.GetUser(k) // ensure locking
+	if !ok || !u.Enabled {
+		return false, nil
+	}
 
-	cfg = xfbbroker.LoadConfig()
+	s, err := xfb.GetCardMoney(ctx, u.SessionId, u.YmUserId)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to query card balance", "err", err, "name", u.Name)
+		return false, err
+	}
+	if s == "- - -" {
+		slog.InfoContext(ctx, `GetCardMoney returned "- - -"`)
+		return false, nil
+	}
 
-	level := slog.LevelInfo
-	if cfg.Debug {
-		level = slog.LevelDebug
+	balance, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to parse card balance", "err", err, "name", u.Name, "rawbalance", s)
+		return false, err
+	}
+	slog.InfoContext(ctx, "check balance", "name", u.Name, "balance", balance, "threshold", u.Threshold)
+	cfg.ObserveBalance(&u, balance)
+	mq.PublishBalance(k, balance)
+	err = rechargeToThreshold(ctx, balance, &u)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to recharge card balance", "err", err, "name", u.Name, "balance", balance)
+		return false, err
 	}
-	slog.SetDefault(slog.New(gorad.NewTextFileSlogHandler(cfg.LogFileName, level)))
-	// stop := make(chan bool)
+	return false, nil
+}
 
-	go checkBalanceLoop()
-	go checkTransLoop()
+// recordResult moves user k through its health states after a poll and
+// reports whether the user record was changed. Entering suspended or
+// needs-reauth is announced to the user.
+func recordResult(ctx context.Context, k string, kind string, err error) bool {
+	xfbbroker.ObservePoll(k, kind, err)
+
+	var u xfbbroker.User
+	var prev xfbbroker.HealthState
+	dirty := false
+	now := time.Now()
+	cfg.UpdateUser(k, func(x *xfbbroker.User) {
+		if err != nil {
+			prev = x.RecordFailure(err, now)
+		} else if x.State() != xfbbroker.HealthHealthy || x.Failed != 0 {
+			prev = x.RecordSuccess(now)
+		} else {
+			// avoid saving the config after every successful poll
+			x.LastSuccessAt = now
+			return
+		}
+		dirty = true
+		u = *x
+	})
+	if !dirty || prev == u.State() {
+		return dirty
+	}
 
-	if cfg.ListenTLS {
-		http.ListenAndServeTLS(cfg.ListenAddr, cfg.TLSCertFile, cfg.TLSKeyFile, xfbbroker.CreateApiServer(cfg))
-	} else {
-		http.ListenAndServe(cfg.ListenAddr, xfbbroker.CreateApiServer(cfg))
+	slog.WarnContext(ctx, "user health changed", "name", u.Name, "from", prev, "to", u.State(), "err", err)
+	mq.PublishHealth(k, u.State())
+	switch u.State() {
+	case xfbbroker.HealthSuspended:
+		sendError(ctx, u.WeComBotKey, fmt.Sprintf("多次请求失败，自动轮询已暂停，每 %s 重试", cfg.ProbeIntervalDuration()), err, &u)
+	case xfbbroker.HealthNeedsReauth:
+		cfg.Emit(k, xfbbroker.EventSessionExpired, map[string]any{"error": u.LastError})
+		sendError(ctx, u.WeComBotKey, "登录已失效，自动轮询已取消，点击重新授权", err, &u)
+	}
+	return dirty
+}
+
+// pollOnce runs both checks for every user, one after another.
+func pollOnce(ctx context.Context) {
+	for _, k := range cfg.UserIds() {
+		if ctx.Err() != nil {
+			break
+		}
+		poll(ctx, jobBalance, k)
+		poll(ctx, jobTrans, k)
+	}
+	saveConfig()
+}
+
+// saveConfig persists cfg, which Save skips with --dry-run.
+func saveConfig() {
+	if err := cfg.Save(); err != nil {
+		slog.Error("unable to save config", "err", err)
 	}
 }
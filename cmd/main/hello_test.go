@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/yiffyi/xfbbroker"
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestRecordResult(t *testing.T) {
+	loadConfig(t, schedulerConfig)
+	ctx := context.Background()
+	state := func() xfbbroker.HealthState {
+		u, _ := cfg.GetUser("a")
+		return u.State()
+	}
+
+	if recordResult(ctx, "a", "trans", nil) {
+		t.Error("a success of a healthy user needs saving")
+	}
+	if u, _ := cfg.GetUser("a"); u.LastSuccessAt.IsZero() {
+		t.Error("LastSuccessAt not set")
+	}
+	for i := 0; i < 3; i++ {
+		if !recordResult(ctx, "a", "trans", errors.New("timeout")) {
+			t.Errorf("failure %d not saved", i+1)
+		}
+	}
+	if state() != xfbbroker.HealthSuspended {
+		t.Errorf("after 3 failures: %s", state())
+	}
+	if !recordResult(ctx, "a", "balance", nil) || state() != xfbbroker.HealthHealthy {
+		t.Errorf("after a success: %s", state())
+	}
+
+	recordResult(ctx, "a", "trans", fmt.Errorf("%w: %w", xfb.ErrUpstream, xfb.ErrSessionExpired))
+	if state() != xfbbroker.HealthNeedsReauth {
+		t.Errorf("after an expired session: %s", state())
+	}
+	if u, _ := cfg.GetUser("b"); u.State() != xfbbroker.HealthHealthy || u.Failed != 0 {
+		t.Errorf("other user changed: %s", u.State())
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yiffyi/xfbbroker"
+	"github.com/yiffyi/xfbbroker/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type jobKind int
+
+const (
+	jobTrans jobKind = iota
+	jobBalance
+)
+
+func (k jobKind) String() string {
+	if k == jobTrans {
+		return "trans"
+	}
+	return "balance"
+}
+
+type jobKey struct {
+	kind   jobKind
+	userId string
+}
+
+// scheduler gives every user an independent schedule for each check, so a
+// slow upstream call for one user does not delay the others. Runs are
+// spread with jitter, backed off exponentially on failure, and pass through
+// a shared worker pool and rate limit toward xiaofubao.
+type scheduler struct {
+	lock    sync.Mutex
+	next    map[jobKey]time.Time
+	last    map[jobKey]time.Time
+	base    map[jobKey]time.Duration
+	running map[jobKey]bool
+	dirty   atomic.Bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		next:    make(map[jobKey]time.Time),
+		last:    make(map[jobKey]time.Time),
+		base:    make(map[jobKey]time.Duration),
+		running: make(map[jobKey]bool),
+	}
+}
+
+// jitter spreads d by up to PollJitter percent in either direction.
+func jitter(d time.Duration) time.Duration {
+	if cfg.PollJitter <= 0 || d <= 0 {
+		return d
+	}
+	spread := int64(d) * int64(cfg.PollJitter) / 100
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int64N(2*spread+1)-spread)
+}
+
+func interval(kind jobKind, u *xfbbroker.User, now time.Time) time.Duration {
+	if kind == jobTrans {
+		return cfg.TransInterval(u, now)
+	}
+	return cfg.BalanceInterval(u)
+}
+
+// delay returns the wait before the next run of kind for u, doubling the
+// interval for every consecutive failure up to MaxBackoff. Suspended users
+// are only probed every ProbeInterval.
+func delay(kind jobKind, u *xfbbroker.User, now time.Time) time.Duration {
+	if u.State() == xfbbroker.HealthSuspended {
+		return cfg.ProbeIntervalDuration()
+	}
+	d := interval(kind, u, now)
+	maxBackoff := cfg.MaxBackoffDuration()
+	for i := 0; i < u.Failed && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if u.Failed > 0 && d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// sync adds jobs for new users and drops jobs of removed ones. The first
+// run of a new job is placed randomly within its interval so that users do
+// not hit upstream in a burst.
+func (s *scheduler) sync(now time.Time) {
+	ids := cfg.UserIds()
+	known := make(map[string]bool, len(ids))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range ids {
+		known[id] = true
+		u, _ := cfg.GetUser(id)
+		for _, kind := range []jobKind{jobTrans, jobBalance} {
+			key := jobKey{kind, id}
+			if _, ok := s.next[key]; ok {
+				continue
+			}
+			d := interval(kind, &u, now)
+			if d <= 0 {
+				d = time.Second
+			}
+			s.next[key] = now.Add(time.Duration(rand.Int64N(int64(d))))
+		}
+	}
+	for key := range s.next {
+		if !known[key.userId] && !s.running[key] {
+			delete(s.next, key)
+			delete(s.last, key)
+			delete(s.base, key)
+		}
+	}
+}
+
+// isDue reports whether key should run at now. Besides its planned time, a
+// healthy job is also due once the interval of the current time of day has
+// passed if it is shorter than the delay it was planned with. That way
+// entering a faster window, or a re-auth after a backoff, takes effect
+// immediately.
+func (s *scheduler) isDue(key jobKey, now time.Time) bool {
+	if s.running[key] {
+		return false
+	}
+	u, ok := cfg.GetUser(key.userId)
+	if !ok || u.State() == xfbbroker.HealthNeedsReauth {
+		return false
+	}
+	if !s.next[key].After(now) {
+		return true
+	}
+
+	last, ok := s.last[key]
+	if !ok || u.State() != xfbbroker.HealthHealthy {
+		return false
+	}
+	d := interval(key.kind, &u, now)
+	return d < s.base[key] && !last.Add(d).After(now)
+}
+
+// due returns the jobs whose time has come and marks them running.
+func (s *scheduler) due(now time.Time) []jobKey {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var keys []jobKey
+	for key := range s.next {
+		if s.isDue(key, now) {
+			s.running[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Trigger makes the job of kind for user k due now. A job running at the
+// time is not run again.
+func (s *scheduler) Trigger(kind jobKind, k string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := jobKey{kind, k}
+	if _, ok := s.next[key]; ok {
+		s.next[key] = time.Now()
+	}
+}
+
+func (s *scheduler) finish(key jobKey) {
+	u, ok := cfg.GetUser(key.userId)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.running, key)
+	if ok {
+		now := time.Now()
+		d := delay(key.kind, &u, now)
+		s.last[key] = now
+		s.base[key] = d
+		s.next[key] = now.Add(jitter(d))
+	}
+}
+
+func (s *scheduler) run(ctx context.Context, key jobKey) {
+	defer s.finish(key)
+	if poll(ctx, key.kind, key.userId) {
+		s.dirty.Store(true)
+	}
+}
+
+// poll runs one check of kind for user k in its own span and records the
+// result. Upstream calls are detached from the cancellation of ctx, so a
+// shutdown lets the current user finish instead of aborting mid-payment.
+// It reports whether the user record was changed.
+func poll(ctx context.Context, kind jobKind, k string) bool {
+	ctx, span := telemetry.Tracer.Start(context.WithoutCancel(ctx), "poll "+kind.String(),
+		trace.WithAttributes(attribute.String("user", k)))
+	defer span.End()
+
+	var changed bool
+	var err error
+	if kind == jobTrans {
+		changed, err = pollTrans(ctx, k)
+	} else {
+		changed, err = pollBalance(ctx, k)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return recordResult(ctx, k, kind.String(), err) || changed
+}
+
+func (s *scheduler) flush() {
+	if s.dirty.Swap(false) {
+		saveConfig()
+	}
+}
+
+// Run dispatches due jobs to MaxConcurrency workers until ctx is cancelled,
+// then waits for the running jobs to finish their current user.
+func (s *scheduler) Run(ctx context.Context) {
+	jobs := make(chan jobKey)
+	limiter := time.NewTicker(time.Duration(float64(time.Second) / cfg.UpstreamRateOrDefault()))
+	defer limiter.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.MaxConcurrencyOrDefault(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				s.run(ctx, key)
+			}
+		}()
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+loop:
+	for {
+		now := time.Now()
+		s.sync(now)
+		for _, key := range s.due(now) {
+			select {
+			case <-limiter.C:
+			case <-ctx.Done():
+				break loop
+			}
+			select {
+			case jobs <- key:
+				slog.Debug("poll dispatched", "kind", key.kind, "user", key.userId)
+			case <-ctx.Done():
+				break loop
+			}
+		}
+		s.flush()
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	s.flush()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker"
+)
+
+const schedulerConfig = `{"CheckTransInterval":60,"CheckBalanceInterval":300,"MaxBackoff":900,"ProbeInterval":1800,"PollJitter":10,
+"Users":{"a":{"Name":"A","YmUserId":"a","Enabled":true},"b":{"Name":"B","YmUserId":"b","Enabled":true}}}`
+
+func TestDelayBacksOff(t *testing.T) {
+	loadConfig(t, schedulerConfig)
+	now := time.Now()
+	for _, tc := range []struct {
+		failed int
+		health xfbbroker.HealthState
+		want   time.Duration
+	}{
+		{0, "", time.Minute},
+		{1, xfbbroker.HealthDegraded, 2 * time.Minute},
+		{2, xfbbroker.HealthDegraded, 4 * time.Minute},
+		{4, xfbbroker.HealthDegraded, 15 * time.Minute},
+		{3, xfbbroker.HealthSuspended, 30 * time.Minute},
+	} {
+		u := xfbbroker.User{Failed: tc.failed, Health: tc.health}
+		if d := delay(jobTrans, &u, now); d != tc.want {
+			t.Errorf("%d failures, %s: delay %v, want %v", tc.failed, tc.health, d, tc.want)
+		}
+	}
+	u := xfbbroker.User{Failed: 1, Health: xfbbroker.HealthDegraded}
+	if d := delay(jobBalance, &u, now); d != 10*time.Minute {
+		t.Errorf("balance delay %v", d)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	loadConfig(t, schedulerConfig)
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter(1m) = %v", d)
+		}
+	}
+	cfg.PollJitter = 0
+	if d := jitter(time.Minute); d != time.Minute {
+		t.Errorf("without PollJitter: %v", d)
+	}
+}
+
+func TestSchedulerJobs(t *testing.T) {
+	loadConfig(t, schedulerConfig)
+	s := newScheduler()
+	now := time.Now()
+
+	s.sync(now)
+	if len(s.next) != 4 {
+		t.Fatalf("%d jobs for 2 users", len(s.next))
+	}
+	// first runs are spread over the interval
+	for key, next := range s.next {
+		if next.Before(now) || !next.Before(now.Add(interval(key.kind, &xfbbroker.User{}, now))) {
+			t.Errorf("%v first runs at %v", key, next.Sub(now))
+		}
+	}
+	if keys := s.due(now); len(keys) != 0 {
+		t.Errorf("due before their time: %v", keys)
+	}
+
+	keys := s.due(now.Add(5 * time.Minute))
+	if len(keys) != 4 {
+		t.Fatalf("%d jobs due after the longest interval", len(keys))
+	}
+	if keys := s.due(now.Add(time.Hour)); len(keys) != 0 {
+		t.Errorf("running jobs due again: %v", keys)
+	}
+
+	trans := jobKey{jobTrans, "a"}
+	cfg.UpdateUser("a", func(u *xfbbroker.User) { u.RecordFailure(errors.New("timeout"), time.Now()) })
+	s.finish(trans)
+	if d := s.next[trans].Sub(s.last[trans]); d < 108*time.Second || d > 132*time.Second {
+		t.Errorf("after a failure the next run is in %v", d)
+	}
+	s.Trigger(jobTrans, "a")
+	if keys := s.due(time.Now()); len(keys) != 1 || keys[0] != trans {
+		t.Errorf("triggered job not due: %v", keys)
+	}
+
+	// jobs of removed users go once they are not running
+	s.finish(trans)
+	delete(cfg.Users, "a")
+	delete(cfg.Users, "b")
+	s.sync(time.Now())
+	if _, ok := s.next[trans]; ok {
+		t.Error("job of a removed user kept")
+	}
+	if _, ok := s.next[jobKey{jobTrans, "b"}]; !ok {
+		t.Error("running job of a removed user dropped")
+	}
+}
+
+func TestSchedulerSkipsNeedsReauth(t *testing.T) {
+	loadConfig(t, schedulerConfig)
+	s := newScheduler()
+	s.sync(time.Now())
+	cfg.UpdateUser("a", func(u *xfbbroker.User) { u.Health = xfbbroker.HealthNeedsReauth })
+	for _, key := range s.due(time.Now().Add(time.Hour)) {
+		if key.userId == "a" {
+			t.Errorf("%v due while needing re-auth", key)
+		}
+	}
+}
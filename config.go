@@ -1,13 +1,24 @@
 package xfbbroker
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/yiffyi/gorad/data"
 )
 
 type User struct {
 	Name        string
+	SchoolCode  string
 	OpenId      string
 	SessionId   string
 	YmUserId    string
@@ -16,11 +27,69 @@ type User struct {
 	WeComBotKey string
 	Failed      int
 	Enabled     bool
+	// per-user polling intervals in seconds, the global ones apply if 0
+	CheckTransInterval   int
+	CheckBalanceInterval int
+	// overrides the global TransSchedule when not empty
+	TransSchedule []ScheduleRule
+	// number of past transactions per hour of day
+	DealHours [24]int
+
+	// e-wallets keyed by WalletKey
+	Wallets map[string]Wallet
+	// access to this card given to other users, keyed by their YmUserId
+	Grants  map[string]Grant
+	Budgets []Budget
+	// secret of the calendar feed URL
+	FeedToken string
+	Webhooks  []Webhook
+	// chats linked with /start, see bot.go
+	TelegramChatId int64
+	WeComUserId    string
+	// no transaction notifications or alerts until then
+	MutedUntil time.Time
+	// spending since MonthStart
+	MonthSpent float64
+	MonthStart time.Time
+
+	Health        HealthState
+	LastError     string
+	LastErrorAt   time.Time
+	LastSuccessAt time.Time
+}
+
+// clone returns a copy of u that shares no maps or slices with it, so
+// that it can be read after the config lock is released while UpdateUser
+// changes the original.
+func (u User) clone() User {
+	u.TransSchedule = slices.Clone(u.TransSchedule)
+	u.Wallets = maps.Clone(u.Wallets)
+	if u.Grants != nil {
+		grants := make(map[string]Grant, len(u.Grants))
+		for k, g := range u.Grants {
+			g.Rights = slices.Clone(g.Rights)
+			grants[k] = g
+		}
+		u.Grants = grants
+	}
+	u.Budgets = slices.Clone(u.Budgets)
+	for i := range u.Budgets {
+		u.Budgets[i].Alerts = slices.Clone(u.Budgets[i].Alerts)
+	}
+	u.Webhooks = slices.Clone(u.Webhooks)
+	for i := range u.Webhooks {
+		u.Webhooks[i].Events = slices.Clone(u.Webhooks[i].Events)
+	}
+	return u
 }
 
 type Config struct {
 	db                   *data.JSONDatabase
 	lock                 *sync.RWMutex
+	dryRun               bool
+	hooks                *webhooks
+	bot                  *chatBot
+	authKey              []byte
 	Users                map[string]User
 	LogFileName          string
 	Debug                bool
@@ -30,40 +99,339 @@ type Config struct {
 	ListenTLS            bool
 	TLSCertFile          string
 	TLSKeyFile           string
-	AuthLocalUrl         string
-	AuthCallback         string
+	// certificates for ListenTLS from Let's Encrypt or another ACME CA
+	// instead of TLSCertFile and TLSKeyFile
+	ACME         ACMEConfig
+	AuthLocalUrl string
+	AuthCallback string
+	// key signing auth states, random on every start if empty
+	AuthSecret string
+	// where browsers go after authorizing, the embedded web UI if empty
+	FrontendUrl string
+	// origin of the API as seen by the web UI and calendar feeds, the one
+	// serving it if empty
+	FrontendApiBase string
+	// lifetime of browser logins in days, 30 if unset
+	SessionDays int
+	// browser logins keyed by the SHA-256 of their cookie
+	Sessions map[string]WebSession
+	// universities keyed by school code, xfb.DefaultSchool if empty
+	Schools map[string]School
+	// seconds to wait for in-flight requests and polls on SIGTERM, 15 if unset
+	ShutdownTimeout int
+	// number of polls running at the same time, 4 if unset
+	MaxConcurrency int
+	// polls started per second toward xiaofubao, 2 if unset
+	UpstreamRate float64
+	// random spread applied to every interval, in percent
+	PollJitter int
+	// upper bound in seconds for the backoff after failures, 3600 if unset
+	MaxBackoff int
+	// transaction polling intervals by time of day
+	TransSchedule []ScheduleRule
+	// interval in seconds used during each user's historically busy hours,
+	// learning is disabled if 0
+	LearnedTransInterval int
+	// seconds between probe polls of suspended users, 1800 if unset
+	ProbeInterval int
+	// export card balances on /metrics
+	MetricsExposeBalances bool
+	// bearer token scrapers of /metrics must send, /metrics is off if unset
+	// since its series are labelled with user IDs
+	MetricsToken string
+	// /readyz fails if no user was polled successfully for this many times
+	// the longest poll interval of the users, 3 if unset
+	ReadyPollIntervals int
+	// let /readyz check that the xiaofubao auth host answers
+	ReadyProbeUpstream bool
+	// "stdout", "otlp" or empty to disable tracing
+	TraceExporter string
+	// OTLP/HTTP endpoint URL, OTEL_EXPORTER_OTLP_ENDPOINT applies if empty
+	TraceEndpoint string
+	// origins allowed to call the API from a browser, "*" allows any
+	CORSAllowedOrigins []string
+	// per-route limits, defaultRateLimits apply if nil
+	RateLimits []RouteRateLimit
+	// unknown credentials a client may try within LoginFailureWindow
+	// seconds before being locked out for LoginLockout seconds
+	LoginMaxFailures   int
+	LoginFailureWindow int
+	LoginLockout       int
+	// take client IPs from X-Forwarded-For
+	TrustProxyHeaders bool
+	// proxies in front of the broker that append to X-Forwarded-For, 1 if 0
+	TrustedProxyHops int
+	// budget usage percentages to alert at, 50, 80 and 100 if empty
+	BudgetAlerts []int
+	// merchant categories, tried in order before the built-in keywords
+	CategoryRules []CategoryRule
+	// ledger accounts of transaction exports
+	ExportAccounts ExportAccounts
+	// days covered by the calendar feed, 7 if unset
+	FeedDays int
+	// attempts per webhook delivery, 6 if unset
+	WebhookMaxAttempts int
+	// allow webhooks to loopback, link-local and private addresses, e.g. a
+	// receiver on the same host or LAN
+	WebhookAllowPrivate bool
+	// Home Assistant integration, disabled if Broker is empty
+	MQTT MQTTConfig
+	// chat bots taking commands like /balance
+	Telegram TelegramConfig
+	WeComApp WeComAppConfig
 }
 
-func LoadConfig() *Config {
+// LoadConfig reads the JSON config at path. Unlike data.JSONDatabase.Load,
+// a missing file is reported instead of being replaced by an empty one.
+func LoadConfig(path string) (*Config, error) {
 	lock := sync.RWMutex{}
-	db := data.NewJSONDatabase("config.json", true)
+	db := data.NewJSONDatabase(path, true)
 	cfg := Config{
 		db:   db,
 		lock: &lock,
+		bot:  newChatBot(),
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	if cfg.Users == nil {
+		cfg.Users = make(map[string]User)
+	}
+	cfg.hooks = newWebhooks(cfg.WebhookAllowPrivate)
+	cfg.compileCategoryRules()
+	cfg.authKey = newAuthKey(cfg.AuthSecret)
+	return &cfg, nil
+}
+
+// Validate reports every problem found in the config at once.
+func (c *Config) Validate() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var errs []error
+	if c.CheckTransInterval <= 0 {
+		errs = append(errs, errors.New("CheckTransInterval must be greater than 0"))
+	}
+	if c.CheckBalanceInterval <= 0 {
+		errs = append(errs, errors.New("CheckBalanceInterval must be greater than 0"))
+	}
+	if c.PollJitter < 0 || c.PollJitter > 100 {
+		errs = append(errs, errors.New("PollJitter must be between 0 and 100"))
+	}
+	for _, r := range c.TransSchedule {
+		if err := r.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("TransSchedule: %w", err))
+		}
+	}
+	if c.MQTT.Broker != "" {
+		if u, err := url.Parse(c.MQTT.Broker); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("MQTT: Broker must be a URL like tcp://host:1883, got %q", c.MQTT.Broker))
+		}
+		if c.MQTT.Codepay && !c.MQTT.Commands {
+			errs = append(errs, errors.New("MQTT: Codepay requires Commands"))
+		}
+	}
+	if _, err := url.Parse(c.FrontendUrl); err != nil {
+		errs = append(errs, fmt.Errorf("FrontendUrl: %w", err))
+	}
+	if err := c.Telegram.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.WeComApp.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.FeedDays > maxExportDays {
+		errs = append(errs, fmt.Errorf("FeedDays must not exceed %d", maxExportDays))
+	}
+	if c.LearnedTransInterval < 0 {
+		errs = append(errs, errors.New("LearnedTransInterval must not be negative"))
+	}
+	switch c.TraceExporter {
+	case "", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("TraceExporter must be stdout, otlp or empty, got %q", c.TraceExporter))
+	}
+	for _, l := range c.RateLimits {
+		for _, rl := range []*RateLimit{l.PerIP, l.PerToken} {
+			if rl != nil && (rl.Rate <= 0 || rl.Burst <= 0) {
+				errs = append(errs, fmt.Errorf("RateLimits %s: Rate and Burst must be greater than 0", l.Route))
+			}
+		}
+	}
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("ListenAddr is required"))
+	}
+	if err := c.ACME.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ACME.Enabled() && !c.ListenTLS {
+		errs = append(errs, errors.New("ACME: ListenTLS must be enabled"))
+	}
+	if c.ACME.Enabled() && c.ACME.HTTPAddr == "" {
+		// TLS-ALPN-01 challenges always come to port 443
+		if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil || port != "443" {
+			errs = append(errs, errors.New("ACME: ListenAddr must be on port 443 unless HTTPAddr is set"))
+		}
+	}
+	if c.ListenTLS && !c.ACME.Enabled() {
+		for _, f := range []string{c.TLSCertFile, c.TLSKeyFile} {
+			if _, err := os.Stat(f); err != nil {
+				errs = append(errs, fmt.Errorf("TLS file: %w", err))
+			}
+		}
 	}
 
-	db.Load(&cfg, true)
-	return &cfg
+	for _, p := range c.BudgetAlerts {
+		if p <= 0 {
+			errs = append(errs, errors.New("BudgetAlerts must be greater than 0"))
+		}
+	}
+
+	errs = append(errs, c.validateSchools()...)
+	errs = append(errs, c.validateGrants()...)
+	errs = append(errs, c.validateCategoryRules()...)
+	errs = append(errs, c.validateWebhooks()...)
+
+	for k, u := range c.Users {
+		if k != u.YmUserId {
+			errs = append(errs, fmt.Errorf("user %s: key does not match YmUserId %q", k, u.YmUserId))
+		}
+		if u.Name == "" {
+			errs = append(errs, fmt.Errorf("user %s: Name is required", k))
+		}
+		if u.Enabled {
+			if u.SessionId == "" {
+				errs = append(errs, fmt.Errorf("user %s: SessionId is required when enabled", k))
+			}
+			if u.OpenId == "" {
+				errs = append(errs, fmt.Errorf("user %s: OpenId is required when enabled", k))
+			}
+		}
+		if u.CheckTransInterval < 0 || u.CheckBalanceInterval < 0 {
+			errs = append(errs, fmt.Errorf("user %s: intervals must not be negative", k))
+		}
+		for _, r := range u.TransSchedule {
+			if err := r.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("user %s: TransSchedule: %w", k, err))
+			}
+		}
+		for wk, w := range u.Wallets {
+			if w.Threshold < 0 {
+				errs = append(errs, fmt.Errorf("user %s: wallet %s: Threshold must not be negative", k, wk))
+			}
+		}
+		if u.Threshold < 0 {
+			errs = append(errs, fmt.Errorf("user %s: Threshold must not be negative", k))
+		}
+		for _, b := range u.Budgets {
+			if err := validateBudget(b); err != nil {
+				errs = append(errs, fmt.Errorf("user %s: Budgets: %w", k, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) ShutdownTimeoutDuration() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return 15 * time.Second
+	}
+	return time.Duration(c.ShutdownTimeout) * time.Second
 }
 
-func (c *Config) Save() {
+func (c *Config) TrustedProxyHopsOrDefault() int {
+	if c.TrustedProxyHops <= 0 {
+		return 1
+	}
+	return c.TrustedProxyHops
+}
+
+func (c *Config) MaxConcurrencyOrDefault() int {
+	if c.MaxConcurrency <= 0 {
+		return 4
+	}
+	return c.MaxConcurrency
+}
+
+func (c *Config) UpstreamRateOrDefault() float64 {
+	if c.UpstreamRate <= 0 {
+		return 2
+	}
+	return c.UpstreamRate
+}
+
+func (c *Config) MaxBackoffDuration() time.Duration {
+	if c.MaxBackoff <= 0 {
+		return time.Hour
+	}
+	return time.Duration(c.MaxBackoff) * time.Second
+}
+
+// BalanceInterval returns how often the balance of u is checked.
+func (c *Config) BalanceInterval(u *User) time.Duration {
+	if u.CheckBalanceInterval > 0 {
+		return time.Duration(u.CheckBalanceInterval) * time.Second
+	}
+	return time.Duration(c.CheckBalanceInterval) * time.Second
+}
+
+// Save writes the config back to its file. In dry-run mode nothing is
+// written, so that a dry run leaves no trace.
+func (c *Config) Save() error {
+	if c.dryRun {
+		slog.Debug("dry-run: config not saved")
+		return nil
+	}
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	c.db.Save(c)
+	return c.db.Save(c)
+}
 
+// UserIds returns the keys of all users, so callers can iterate without
+// holding the lock.
+func (c *Config) UserIds() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	ids := make([]string, 0, len(c.Users))
+	for k := range c.Users {
+		ids = append(ids, k)
+	}
+	return ids
 }
 
 func (c *Config) GetUser(k string) (User, bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	u, ok := c.Users[k]
-	return u, ok
+	return u.clone(), ok
 }
 
 func (c *Config) SetUser(k string, v User) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.Users[k] = v
+	c.Users[k] = v.clone()
+}
+
+// UpdateUser applies fn to user k under the write lock, so that concurrent
+// pollers only overwrite the fields they touch. It reports whether k exists.
+func (c *Config) UpdateUser(k string, fn func(*User)) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	u, ok := c.Users[k]
+	if !ok {
+		return false
+	}
+	fn(&u)
+	c.Users[k] = u
+	return true
 }
 
 // return a copy of User
@@ -72,7 +440,7 @@ func (c *Config) SelectUserFromSessionId(session string) *User {
 	defer c.lock.RUnlock()
 	for _, u := range c.Users {
 		if u.SessionId == session {
-			// u is already a copy of struct
+			u = u.clone()
 			return &u
 		}
 	}
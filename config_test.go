@@ -0,0 +1,207 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// newTestConfig writes cfg with users to a temporary file and loads it,
+// so that the unexported state is set up as in the daemon.
+func newTestConfig(t *testing.T, cfg map[string]any, users ...User) *Config {
+	t.Helper()
+	if cfg == nil {
+		cfg = map[string]any{}
+	}
+	m := make(map[string]User)
+	for _, u := range users {
+		m[u.YmUserId] = u
+	}
+	cfg["Users"] = m
+	path := filepath.Join(t.TempDir(), "config.json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// deal returns a payment of money yuan made at dt ("2006-01-02 15:04:05")
+// that left after on wallet 1 of account 100.
+func deal(serial int, dt string, money, after float64, business string) xfb.Trans {
+	return xfb.Trans{
+		Serialno:     strconv.Itoa(serial),
+		Dealtime:     dt,
+		Money:        strconv.FormatFloat(money, 'f', 2, 64),
+		AfterMon:     strconv.FormatFloat(after, 'f', 2, 64),
+		BusinessName: business,
+		FeeName:      "消费",
+		AccNum:       "100",
+		EWalletId:    "1",
+	}
+}
+
+func TestGetUserReturnsIndependentCopy(t *testing.T) {
+	c := newTestConfig(t, nil, User{
+		Name:     "A",
+		YmUserId: "a",
+		Wallets:  map[string]Wallet{"100:1": {Name: "main"}},
+		Grants:   map[string]Grant{"b": {Rights: []Right{RightRead}}},
+		Budgets:  []Budget{{Period: BudgetDaily, Limit: 10, Alerts: []int{50}}},
+		Webhooks: []Webhook{{Id: "h", Events: []EventType{EventBalanceLow}}},
+	})
+
+	u, _ := c.GetUser("a")
+	u.Wallets["100:1"] = Wallet{Name: "changed"}
+	u.Grants["b"].Rights[0] = RightPay
+	u.Budgets[0].Alerts[0] = 90
+	u.Webhooks[0].Events[0] = EventCodepayPaid
+
+	orig, _ := c.GetUser("a")
+	if orig.Wallets["100:1"].Name != "main" || orig.Grants["b"].Rights[0] != RightRead ||
+		orig.Budgets[0].Alerts[0] != 50 || orig.Webhooks[0].Events[0] != EventBalanceLow {
+		t.Fatalf("changing a copy changed the config: %+v", orig)
+	}
+}
+
+// TestUserCopiesDoNotRace reads users the way handlers do while pollers
+// update them. Run with -race.
+func TestUserCopiesDoNotRace(t *testing.T) {
+	c := newTestConfig(t, nil, User{
+		Name:      "A",
+		YmUserId:  "a",
+		SessionId: "sa",
+		FeedToken: "ft",
+		Budgets:   []Budget{{Period: BudgetDaily, Limit: 1000}},
+		Webhooks:  []Webhook{{Id: "h0", Url: "https://example.com"}},
+		Grants:    map[string]Grant{"b": {Rights: []Right{RightPay}, DailyLimit: 1e9}},
+	})
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, xfb.Location)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 300; i++ {
+			tr := deal(i, now.Add(time.Duration(i)*time.Second).Format(time.DateTime), -1, 100, "食堂")
+			tr.EWalletId = strconv.Itoa(i)
+			c.UpdateUser("a", func(u *User) {
+				u.ApplyDeal(&tr)
+				c.ApplyBudgets(u, &tr)
+				u.Webhooks = append(u.Webhooks, Webhook{Id: strconv.Itoa(i)})
+				u.Grants[strconv.Itoa(i)] = Grant{Rights: []Right{RightRead}}
+			})
+			c.chargeGrant("a", "b", 1, now, false)
+		}
+	}()
+
+	for _, get := range []func() *User{
+		func() *User { u, _ := c.GetUser("a"); return &u },
+		func() *User { return c.SelectUserFromSessionId("sa") },
+		func() *User { return c.selectUserFromFeedToken("ft") },
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				u := get()
+				walletInfos(u, nil)
+				budgetsOf(u, now)
+				for k, g := range u.Grants {
+					grantView(u, k, g, now)
+				}
+				for _, h := range u.Webhooks {
+					_ = h.Url
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serve sends a request to the API of c as the user with session sess,
+// body is encoded as JSON unless nil.
+func serve(t *testing.T, h http.Handler, method, path, sess string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if sess != "" {
+		req.Header.Set("Authorization", "Bearer "+sess)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// decodeData returns the data of a /api/v2 envelope.
+func decodeData[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var env struct {
+		Data T `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("%s: %v", w.Body.String(), err)
+	}
+	return env.Data
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := newTestConfig(t, map[string]any{
+		"CheckTransInterval":   0,
+		"CheckBalanceInterval": 60,
+		"PollJitter":           150,
+		"ListenAddr":           ":8000",
+		"TraceExporter":        "zipkin",
+	}, User{Name: "", YmUserId: "a", Enabled: true, OpenId: "o"}, User{Name: "B", YmUserId: "b", Threshold: -1})
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{
+		"CheckTransInterval must be greater than 0",
+		"PollJitter must be between 0 and 100",
+		`TraceExporter must be stdout, otlp or empty, got "zipkin"`,
+		"user a: Name is required",
+		"user a: SessionId is required when enabled",
+		"user b: Threshold must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "CheckBalanceInterval") || strings.Contains(err.Error(), "ListenAddr") {
+		t.Errorf("valid fields reported:\n%v", err)
+	}
+
+	c = newTestConfig(t, map[string]any{"CheckTransInterval": 60, "CheckBalanceInterval": 60, "ListenAddr": ":8000"},
+		User{Name: "A", YmUserId: "a", Enabled: true, OpenId: "o", SessionId: "s"})
+	if err := c.Validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+}
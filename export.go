@@ -0,0 +1,370 @@
+package xfbbroker
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// ExportAccounts names the ledger accounts used by exports.
+type ExportAccounts struct {
+	// the card, "Assets:CampusCard" if empty; with several wallets the
+	// wallet id is appended, e.g. "Assets:CampusCard:W1"
+	Card string
+	// expenses, the category is appended, "Expenses:Campus" if empty
+	Expenses string
+	// where top-ups come from, "Assets:Bank" if empty
+	TopUp string
+	// balances before the first row come from here in Beancount exports,
+	// "Equity:Opening-Balances" if empty
+	Opening string
+	// "CNY" if empty
+	Currency string
+}
+
+func (a ExportAccounts) orDefault() ExportAccounts {
+	if a.Card == "" {
+		a.Card = "Assets:CampusCard"
+	}
+	if a.Expenses == "" {
+		a.Expenses = "Expenses:Campus"
+	}
+	if a.TopUp == "" {
+		a.TopUp = "Assets:Bank"
+	}
+	if a.Opening == "" {
+		a.Opening = "Equity:Opening-Balances"
+	}
+	if a.Currency == "" {
+		a.Currency = "CNY"
+	}
+	return a
+}
+
+// maxExportDays bounds the upstream requests of one export, one per day.
+const maxExportDays = 92
+
+// transactionsBetween fetches the transactions of every day from from to
+// to, oldest first.
+func (s *ApiServer) transactionsBetween(ctx context.Context, user *User, from, to time.Time) ([]xfb.Trans, error) {
+	seen := make(map[string]bool)
+	var res []xfb.Trans
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		_, rows, err := xfb.CardQuerynoPage(ctx, user.SessionId, user.YmUserId, d)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch transactions of %s: %w", d.Format(time.DateOnly), err)
+		}
+		for _, t := range rows {
+			if !seen[t.Serialno] {
+				seen[t.Serialno] = true
+				res = append(res, t)
+			}
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Dealtime != res[j].Dealtime {
+			return res[i].Dealtime < res[j].Dealtime
+		}
+		a, _ := strconv.Atoi(res[i].Serialno)
+		b, _ := strconv.Atoi(res[j].Serialno)
+		return a < b
+	})
+	return res, nil
+}
+
+type exportEntry struct {
+	Transaction
+	when    time.Time
+	amount  float64
+	balance float64
+	// the asset account of the wallet
+	card string
+	// the expense or top-up account
+	other string
+}
+
+func (c *Config) exportEntries(rows []xfb.Trans) []exportEntry {
+	acc := c.ExportAccounts.orDefault()
+	wallets := make(map[string]bool)
+	for i := range rows {
+		wallets[rows[i].EWalletId] = true
+	}
+
+	res := make([]exportEntry, 0, len(rows))
+	for i := range rows {
+		t := &rows[i]
+		e := exportEntry{Transaction: c.Annotate(t), card: acc.Card}
+		e.when, _ = t.DealTime()
+		e.amount, _ = strconv.ParseFloat(t.Money, 64)
+		e.balance, _ = strconv.ParseFloat(t.AfterMon, 64)
+		if len(wallets) > 1 {
+			e.card += ":W" + accountPart(t.EWalletId)
+		}
+		if e.Category == CategoryTopUp || e.amount > 0 {
+			e.other = acc.TopUp
+		} else {
+			e.other = acc.Expenses + ":" + accountPart(e.Category)
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// accountPart turns s into an account name component: "top-up" becomes
+// "TopUp".
+func accountPart(s string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "Other"
+	}
+	return b.String()
+}
+
+func payee(t *xfb.Trans) string {
+	if t.BusinessName != "" {
+		return t.BusinessName
+	}
+	return t.Address
+}
+
+func quote(s string) string {
+	return strconv.Quote(s)
+}
+
+type exportFormat struct {
+	contentType string
+	ext         string
+	write       func(w io.Writer, entries []exportEntry, acc ExportAccounts)
+}
+
+var exportFormats = map[string]exportFormat{
+	"csv":       {"text/csv; charset=utf-8", "csv", writeCSV},
+	"ofx":       {"application/x-ofx", "ofx", writeOFX},
+	"qif":       {"application/qif", "qif", writeQIF},
+	"beancount": {"text/plain; charset=utf-8", "beancount", writeBeancount},
+	"ledger":    {"text/plain; charset=utf-8", "ledger", writeLedger},
+}
+
+func writeCSV(w io.Writer, entries []exportEntry, acc ExportAccounts) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "serial", "merchant", "address", "fee", "category", "amount", "balance", "account", "wallet"})
+	for _, e := range entries {
+		cw.Write([]string{e.Dealtime, e.Serialno, e.BusinessName, e.Address, e.FeeName, e.Category,
+			e.Money, e.AfterMon, e.AccNum, e.EWalletId})
+	}
+	cw.Flush()
+}
+
+func writeQIF(w io.Writer, entries []exportEntry, acc ExportAccounts) {
+	fmt.Fprintln(w, "!Type:Cash")
+	for _, e := range entries {
+		fmt.Fprintf(w, "D%s\n", e.when.Format("01/02/2006"))
+		fmt.Fprintf(w, "T%.2f\n", e.amount)
+		fmt.Fprintf(w, "P%s\n", payee(&e.Trans))
+		fmt.Fprintf(w, "M%s\n", e.FeeName)
+		fmt.Fprintf(w, "N%s\n", e.Serialno)
+		fmt.Fprintf(w, "L%s\n", e.Category)
+		fmt.Fprintln(w, "^")
+	}
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// writeOFX writes an OFX 2 bank statement, with the balance after the
+// last transaction as ledger balance.
+func writeOFX(w io.Writer, entries []exportEntry, acc ExportAccounts) {
+	const ofxTime = "20060102150405"
+	now := time.Now().In(xfb.Location)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>`)
+	fmt.Fprintf(w, "<DTSERVER>%s</DTSERVER><LANGUAGE>ZHO</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n", now.Format(ofxTime))
+	fmt.Fprint(w, "<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>\n<STMTRS>")
+	fmt.Fprintf(w, "<CURDEF>%s</CURDEF>\n", acc.Currency)
+	fmt.Fprintf(w, "<BANKACCTFROM><BANKID>XFB</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n", xmlText(acc.Card))
+	fmt.Fprint(w, "<BANKTRANLIST>")
+	if len(entries) > 0 {
+		fmt.Fprintf(w, "<DTSTART>%s</DTSTART><DTEND>%s</DTEND>", entries[0].when.Format(ofxTime), entries[len(entries)-1].when.Format(ofxTime))
+	}
+	fmt.Fprintln(w)
+	for _, e := range entries {
+		typ := "DEBIT"
+		if e.amount > 0 {
+			typ = "CREDIT"
+		}
+		fmt.Fprintf(w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%.2f</TRNAMT><FITID>%s</FITID><NAME>%s</NAME><MEMO>%s</MEMO></STMTTRN>\n",
+			typ, e.when.Format(ofxTime), e.amount, xmlText(e.Serialno), xmlText(payee(&e.Trans)), xmlText(e.FeeName))
+	}
+	fmt.Fprint(w, "</BANKTRANLIST>\n")
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		fmt.Fprintf(w, "<LEDGERBAL><BALAMT>%.2f</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>\n", last.balance, last.when.Format(ofxTime))
+	}
+	fmt.Fprintln(w, "</STMTRS></STMTTRNRS></BANKMSGSRSV1>\n</OFX>")
+}
+
+// writeBeancount writes a self-contained ledger: the accounts are opened
+// and the cards padded to their balance before the first row, then one
+// transaction follows per row and a balance assertion per wallet for the
+// day after its last transaction.
+func writeBeancount(w io.Writer, entries []exportEntry, acc ExportAccounts) {
+	if len(entries) == 0 {
+		return
+	}
+	// the day before the first row, so that the pads come first
+	start := periodStart(BudgetDaily, entries[0].when).AddDate(0, 0, -1)
+	first := make(map[string]exportEntry)
+	last := make(map[string]exportEntry)
+	var cards []string
+	others := make(map[string]bool)
+	for _, e := range entries {
+		if _, ok := first[e.card]; !ok {
+			first[e.card] = e
+			cards = append(cards, e.card)
+		}
+		last[e.card] = e
+		others[e.other] = true
+	}
+
+	accounts := append([]string{acc.Opening}, cards...)
+	sorted := make([]string, 0, len(others))
+	for a := range others {
+		sorted = append(sorted, a)
+	}
+	sort.Strings(sorted)
+	for _, a := range append(accounts, sorted...) {
+		fmt.Fprintf(w, "%s open %s %s\n", start.Format(time.DateOnly), a, acc.Currency)
+	}
+	fmt.Fprintln(w)
+	for _, c := range cards {
+		e := first[c]
+		opening := math.Round((e.balance-e.amount)*100) / 100
+		fmt.Fprintf(w, "%s pad %s %s\n", start.Format(time.DateOnly), c, acc.Opening)
+		fmt.Fprintf(w, "%s balance %s  %.2f %s\n", e.when.Format(time.DateOnly), c, opening, acc.Currency)
+	}
+	fmt.Fprintln(w)
+
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s * %s %s\n", e.when.Format(time.DateOnly), quote(payee(&e.Trans)), quote(e.FeeName))
+		fmt.Fprintf(w, "  serial: %s\n", quote(e.Serialno))
+		fmt.Fprintf(w, "  time: %s\n", quote(e.when.Format(time.TimeOnly)))
+		fmt.Fprintf(w, "  %s  %.2f %s\n", e.card, e.amount, acc.Currency)
+		fmt.Fprintf(w, "  %s  %.2f %s\n\n", e.other, -e.amount, acc.Currency)
+	}
+	for _, c := range cards {
+		e := last[c]
+		fmt.Fprintf(w, "%s balance %s  %.2f %s\n", e.when.AddDate(0, 0, 1).Format(time.DateOnly), c, e.balance, acc.Currency)
+	}
+}
+
+// writeLedger writes one transaction per row, asserting the balance after
+// it on the card posting.
+func writeLedger(w io.Writer, entries []exportEntry, acc ExportAccounts) {
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s * (%s) %s\n", e.when.Format("2006/01/02"), e.Serialno, payee(&e.Trans))
+		fmt.Fprintf(w, "    ; %s %s\n", e.FeeName, e.when.Format(time.TimeOnly))
+		fmt.Fprintf(w, "    %s  %.2f %s = %.2f %s\n", e.card, e.amount, acc.Currency, e.balance, acc.Currency)
+		fmt.Fprintf(w, "    %s\n\n", e.other)
+	}
+}
+
+func parseDay(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, xfb.Location)
+}
+
+func (s *ApiServer) handleExportTransactions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sess := s.requestSession(r)
+	if sess == "" {
+		http.Error(w, "no sessionId provided", http.StatusBadRequest)
+		return
+	}
+	user := s.lookupSession(r, sess)
+	if user == nil {
+		http.Error(w, "user with sessionId="+sess+" not found", http.StatusNotFound)
+		return
+	}
+
+	format, ok := exportFormats[q.Get("format")]
+	if !ok {
+		http.Error(w, "format must be csv, ofx, qif, beancount or ledger", http.StatusBadRequest)
+		return
+	}
+	today := periodStart(BudgetDaily, time.Now())
+	to, err := parseDay(q.Get("to"), today)
+	if err != nil {
+		http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	from, err := parseDay(q.Get("from"), to)
+	if err != nil {
+		http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxExportDays {
+		http.Error(w, fmt.Sprintf("at most %d days can be exported at once", maxExportDays), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.transactionsBetween(r.Context(), user, from, to)
+	if err != nil {
+		e := asApiError(err)
+		if e.Status >= http.StatusInternalServerError {
+			e.Status = http.StatusInternalServerError
+		}
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+
+	name := fmt.Sprintf("transactions-%s-%s.%s", from.Format("20060102"), to.Format("20060102"), format.ext)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(http.StatusOK)
+	format.write(w, s.cfg.exportEntries(rows), s.cfg.ExportAccounts.orDefault())
+}
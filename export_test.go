@@ -0,0 +1,77 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// exportRows are two days on two wallets, with a top-up.
+func exportRows() []xfb.Trans {
+	rows := []xfb.Trans{
+		deal(1, "2024-05-06 07:30:00", -4.5, 95.5, "一食堂"),
+		deal(2, "2024-05-06 12:10:00", -12, 83.5, "二食堂 & 超市"),
+		deal(3, "2024-05-06 18:00:00", 50, 133.5, ""),
+		deal(4, "2024-05-07 09:00:00", -3, 17, "洗衣房"),
+	}
+	rows[2].FeeName = "充值"
+	rows[2].Address = "自助充值机"
+	rows[3].EWalletId = "2"
+	rows[3].FeeName = "洗衣"
+	return rows
+}
+
+// ofxServerTime is the only part of an export that depends on the clock.
+var ofxServerTime = regexp.MustCompile(`<DTSERVER>\d+</DTSERVER>`)
+
+func TestExportFormats(t *testing.T) {
+	c := newTestConfig(t, nil)
+	entries := c.exportEntries(exportRows())
+	for name, f := range exportFormats {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			f.write(&buf, entries, c.ExportAccounts.orDefault())
+			got := ofxServerTime.ReplaceAll(buf.Bytes(), []byte("<DTSERVER>20240508000000</DTSERVER>"))
+
+			path := filepath.Join("testdata", "export."+f.ext)
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs, got:\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestExportAccounts(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"ExportAccounts": ExportAccounts{Card: "Assets:Card", Expenses: "Expenses:Food"}})
+	rows := exportRows()[:3]
+	entries := c.exportEntries(rows)
+	want := []struct{ card, other string }{
+		{"Assets:Card", "Expenses:Food:Canteen"},
+		{"Assets:Card", "Expenses:Food:Canteen"},
+		{"Assets:Card", "Assets:Bank"},
+	}
+	for i, e := range entries {
+		if e.card != want[i].card || e.other != want[i].other {
+			t.Errorf("row %d: %s / %s", i, e.card, e.other)
+		}
+	}
+	if got := accountPart("top-up"); got != "TopUp" {
+		t.Errorf("accountPart = %s", got)
+	}
+}
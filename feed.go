@@ -0,0 +1,175 @@
+package xfbbroker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FeedDaysOrDefault is how many days, today included, the calendar feed
+// covers.
+func (c *Config) FeedDaysOrDefault() int {
+	if c.FeedDays <= 0 {
+		return 7
+	}
+	return c.FeedDays
+}
+
+// selectUserFromFeedToken returns a copy of the user owning token.
+func (c *Config) selectUserFromFeedToken(token string) *User {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, u := range c.Users {
+		if u.FeedToken != "" && subtle.ConstantTimeCompare([]byte(u.FeedToken), []byte(token)) == 1 {
+			u = u.clone()
+			return &u
+		}
+	}
+	return nil
+}
+
+// lookupFeedToken is lookupSession for calendar feed tokens.
+func (s *ApiServer) lookupFeedToken(r *http.Request, token string) *User {
+	user := s.cfg.selectUserFromFeedToken(token)
+	if user == nil {
+		s.lookups.record(s.clientIP(r), time.Now())
+	}
+	return user
+}
+
+// icsText escapes s for a TEXT property value.
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// writeICSLine folds lines longer than 75 octets without splitting UTF-8
+// sequences.
+func writeICSLine(w io.Writer, line string) {
+	for len(line) > 75 {
+		i := 75
+		for i > 0 && line[i]&0xC0 == 0x80 {
+			i--
+		}
+		fmt.Fprintf(w, "%s\r\n", line[:i])
+		line = " " + line[i:]
+	}
+	fmt.Fprintf(w, "%s\r\n", line)
+}
+
+// writeICS renders every transaction as a 15 minute event at its deal time.
+func writeICS(w io.Writer, name string, rows []Transaction, now time.Time) {
+	const icsTime = "20060102T150405Z"
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//xfbbroker//transactions//ZH")
+	writeICSLine(w, "CALSCALE:GREGORIAN")
+	writeICSLine(w, "X-WR-CALNAME:"+icsText(name))
+	writeICSLine(w, "X-PUBLISHED-TTL:PT15M")
+	for _, t := range rows {
+		dt, err := t.DealTime()
+		if err != nil {
+			continue
+		}
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, "UID:"+icsText(t.Serialno)+"@xfbbroker")
+		writeICSLine(w, "DTSTAMP:"+now.UTC().Format(icsTime))
+		writeICSLine(w, "DTSTART:"+dt.UTC().Format(icsTime))
+		writeICSLine(w, "DURATION:PT15M")
+		writeICSLine(w, "SUMMARY:"+icsText(payee(&t.Trans)+" "+formatMoney(t.Money)))
+		writeICSLine(w, "DESCRIPTION:"+icsText(fmt.Sprintf("%s\n流水号: %s\n余额: %s", t.FeeName, t.Serialno, t.AfterMon)))
+		if t.Address != "" {
+			writeICSLine(w, "LOCATION:"+icsText(t.Address))
+		}
+		writeICSLine(w, "CATEGORIES:"+icsText(t.Category))
+		writeICSLine(w, "END:VEVENT")
+	}
+	writeICSLine(w, "END:VCALENDAR")
+}
+
+// formatMoney shows expenses as "￥6.50" and income as "+￥6.50".
+func formatMoney(m string) string {
+	if strings.HasPrefix(m, "-") {
+		return "￥" + strings.TrimPrefix(m, "-")
+	}
+	return "+￥" + m
+}
+
+// handleFeed serves the calendar feed. Calendar apps cannot send
+// headers, so the feed has its own token that can be rotated without
+// touching the xiaofubao session.
+func (s *ApiServer) handleFeed(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "no token provided", http.StatusBadRequest)
+		return
+	}
+	user := s.lookupFeedToken(r, token)
+	if user == nil {
+		http.Error(w, "unknown token", http.StatusNotFound)
+		return
+	}
+
+	to := periodStart(BudgetDaily, time.Now())
+	from := to.AddDate(0, 0, 1-s.cfg.FeedDaysOrDefault())
+	rows, err := s.transactionsBetween(r.Context(), user, from, to)
+	if err != nil {
+		e := asApiError(err)
+		if e.Status >= http.StatusInternalServerError {
+			e.Status = http.StatusInternalServerError
+		}
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=900")
+	w.WriteHeader(http.StatusOK)
+	writeICS(w, user.Name+" 校园卡", s.cfg.AnnotateAll(rows), time.Now())
+}
+
+type FeedView struct {
+	Token string `json:"token"`
+	Url   string `json:"url"`
+	Days  int    `json:"days"`
+}
+
+// handleV2FeedToken creates or rotates the calendar feed token. The old
+// feed URL stops working.
+func (s *ApiServer) handleV2FeedToken(w http.ResponseWriter, r *http.Request, user *User) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token := hex.EncodeToString(b)
+	s.cfg.UpdateUser(user.YmUserId, func(u *User) {
+		u.FeedToken = token
+	})
+	if err := s.cfg.Save(); err != nil {
+		writeError(w, r, fmt.Errorf("unable to save config: %w", err))
+		return
+	}
+
+	writeData(w, r, http.StatusOK, FeedView{Token: token, Url: s.feedUrl(r, token), Days: s.cfg.FeedDaysOrDefault()})
+}
+
+// feedUrl is where calendar apps fetch the feed of token: under
+// FrontendApiBase if set, else on the host r was sent to, with https when
+// isSecure says so.
+func (s *ApiServer) feedUrl(r *http.Request, token string) string {
+	base := strings.TrimSuffix(s.cfg.FrontendApiBase, "/")
+	if base == "" {
+		scheme := "http"
+		if s.isSecure(r) {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + "/api/v1/transactions.ics?" + url.Values{"token": {token}}.Encode()
+}
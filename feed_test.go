@@ -0,0 +1,138 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriteICSLineFolds(t *testing.T) {
+	var buf bytes.Buffer
+	line := "SUMMARY:" + strings.Repeat("食堂", 30)
+	writeICSLine(&buf, line)
+	out := buf.String()
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Fatalf("no CRLF: %q", out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	var unfolded string
+	for i, l := range lines {
+		if len(l) > 75 || !utf8.ValidString(l) {
+			t.Errorf("line %d: %d octets, valid %v", i, len(l), utf8.ValidString(l))
+		}
+		if i > 0 {
+			if !strings.HasPrefix(l, " ") {
+				t.Errorf("continuation %d does not start with a space", i)
+			}
+			l = l[1:]
+		}
+		unfolded += l
+	}
+	if unfolded != line {
+		t.Errorf("unfolded %q", unfolded)
+	}
+}
+
+func TestWriteICS(t *testing.T) {
+	c := newTestConfig(t, nil)
+	rows := c.AnnotateAll(exportRows()[:2])
+	rows[0].Address = "一楼; 东侧, 窗口"
+	now := time.Date(2024, 5, 8, 1, 2, 3, 0, time.UTC)
+
+	var buf bytes.Buffer
+	writeICS(&buf, "A 校园卡", rows, now)
+	out := strings.ReplaceAll(buf.String(), "\r\n ", "")
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:A 校园卡\r\n",
+		"UID:1@xfbbroker\r\n",
+		"DTSTAMP:20240508T010203Z\r\n",
+		// 07:30 in xfb.Location
+		"DTSTART:20240505T233000Z\r\n",
+		"SUMMARY:一食堂 ￥4.50\r\n",
+		`DESCRIPTION:消费\n流水号: 1\n余额: 95.50` + "\r\n",
+		`LOCATION:一楼\; 东侧\, 窗口` + "\r\n",
+		"CATEGORIES:canteen\r\n",
+		`SUMMARY:二食堂 & 超市 ￥12.00` + "\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "BEGIN:VEVENT"); n != 2 {
+		t.Errorf("%d events", n)
+	}
+}
+
+func TestFeedUrl(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   map[string]any
+		proto string
+		want  string
+	}{
+		{nil, "https", "http://example.com/api/v1/transactions.ics?token=t"},
+		{map[string]any{"TrustProxyHeaders": true}, "https", "https://example.com/api/v1/transactions.ics?token=t"},
+		{map[string]any{"FrontendApiBase": "https://api.example.org/"}, "", "https://api.example.org/api/v1/transactions.ics?token=t"},
+	} {
+		s := &ApiServer{cfg: newTestConfig(t, tc.cfg)}
+		r := httptest.NewRequest("POST", "/api/v2/user/feed-token", nil)
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if got := s.feedUrl(r, "t"); got != tc.want {
+			t.Errorf("%v: %s, want %s", tc.cfg, got, tc.want)
+		}
+	}
+}
+
+func TestFeedToken(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+	rotate := func() FeedView {
+		w := serve(t, h, "POST", "/api/v2/user/feed-token", "sa", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("feed-token: %d %s", w.Code, w.Body)
+		}
+		return decodeData[FeedView](t, w)
+	}
+	feed := func(token string) int {
+		// the feed itself would ask xiaofubao
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/api/v1/transactions.ics?"+url.Values{"token": {token}}.Encode(), nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	first := rotate()
+	if len(first.Token) != 48 || !strings.HasSuffix(first.Url, "/api/v1/transactions.ics?token="+first.Token) || first.Days != 7 {
+		t.Errorf("feed view %+v", first)
+	}
+	if code := feed(first.Token); code != http.StatusInternalServerError {
+		t.Errorf("valid token with upstream down: %d", code)
+	}
+	second := rotate()
+	if second.Token == first.Token {
+		t.Fatal("token not rotated")
+	}
+	if code := feed(first.Token); code != http.StatusNotFound {
+		t.Errorf("old token: %d", code)
+	}
+	if code := feed(""); code != http.StatusBadRequest {
+		t.Errorf("no token: %d", code)
+	}
+	if u, _ := c.GetUser("a"); u.FeedToken != second.Token {
+		t.Error("token not stored")
+	}
+}
@@ -0,0 +1,17 @@
+// Package frontend holds the web UI built by "pnpm build". Without a
+// build, dist only contains .gitkeep and the broker serves the API alone.
+package frontend
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:dist
+var dist embed.FS
+
+// Dist returns the built app, index.html at its root.
+func Dist() fs.FS {
+	sub, _ := fs.Sub(dist, "dist")
+	return sub
+}
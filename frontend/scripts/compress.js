@@ -0,0 +1,24 @@
+// Writes .gz and .br next to every compressible file in dist, the broker
+// serves them to browsers that accept the encoding.
+import { readdirSync, readFileSync, statSync, writeFileSync } from 'node:fs'
+import { join } from 'node:path'
+import { brotliCompressSync, gzipSync, constants } from 'node:zlib'
+
+const compressible = /\.(html|js|mjs|css|svg|json|txt|map)$/
+
+function walk(dir) {
+  for (const name of readdirSync(dir)) {
+    const path = join(dir, name)
+    if (statSync(path).isDirectory()) {
+      walk(path)
+    } else if (compressible.test(name)) {
+      const data = readFileSync(path)
+      writeFileSync(path + '.gz', gzipSync(data, { level: 9 }))
+      writeFileSync(path + '.br', brotliCompressSync(data, {
+        params: { [constants.BROTLI_PARAM_QUALITY]: constants.BROTLI_MAX_QUALITY },
+      }))
+    }
+  }
+}
+
+walk('dist')
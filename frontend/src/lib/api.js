@@ -1,18 +1,60 @@
-async function get(url, params) {
-    let sessionId = localStorage.getItem("sessionId")
+// The broker tells where its API is in /config.js, vite proxies it during
+// development. Logins are kept in an HttpOnly cookie set by the broker;
+// requests that change anything echo the xfb_csrf cookie.
+
+const config = window.XFB_CONFIG ?? { apiBase: "", authUrl: "/_/xfb/auth" }
+
+// from getSession, the cookie cannot be read if the API is on another origin
+let sessionCsrf = ""
+
+function csrfToken() {
+    let m = document.cookie.match(/(?:^|;\s*)xfb_csrf=([^;]*)/)
+    return m ? decodeURIComponent(m[1]) : sessionCsrf
+}
+
+async function request(method, url, params, body) {
     let p = new URLSearchParams(params)
-    if (sessionId.length > 0) {
-        p.set("sessionId", sessionId)
+    let headers = {}
+    if (method !== "GET") {
+        headers["X-CSRF-Token"] = csrfToken()
+    }
+    if (body !== undefined) {
+        headers["Content-Type"] = "application/json"
+        body = JSON.stringify(body)
     }
-    return await fetch(url + '?' + p.toString())
+    let q = p.toString()
+    url = config.apiBase + url
+    return await fetch(q ? url + '?' + q : url, {
+        method, headers, body, credentials: "include",
+    })
+}
+
+async function get(url, params) {
+    return await request("GET", url, params)
+}
+
+// getSession returns the logged in user, or null if the browser has to
+// go through /_/xfb/auth first.
+async function getSession() {
+    let r = await get("/api/v2/session")
+    if (r.status == 401) {
+        return null
+    }
+    let session = await r.json().then(j => j.data)
+    sessionCsrf = session.csrfToken
+    return session
+}
+
+async function logout() {
+    await request("DELETE", "/api/v2/session")
 }
 
 async function getConfig() {
-    return await get("http://localhost:8000/_/config").then(r => r.json())
+    return await get("/_/config").then(r => r.json())
 }
 
 async function checkSignpay() {
-    return await get("http://localhost:8000/_/xfb/signpay").then(r => {
+    return await get("/_/xfb/signpay").then(r => {
         if (r.status == 201) {
             return r.headers.get('Location')
         } else if (r.status == 200) {
@@ -24,5 +66,5 @@ async function checkSignpay() {
 }
 
 export {
-    getConfig, checkSignpay
-}
\ No newline at end of file
+    config, getSession, logout, getConfig, checkSignpay
+}
@@ -4,4 +4,12 @@ import { svelte } from '@sveltejs/vite-plugin-svelte'
 // https://vitejs.dev/config/
 export default defineConfig({
   plugins: [svelte()],
+  server: {
+    // same origin as the broker, so that its session cookie is sent
+    proxy: {
+      '/api': 'http://localhost:8000',
+      '/_': 'http://localhost:8000',
+      '/config.js': 'http://localhost:8000',
+    },
+  },
 })
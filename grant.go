@@ -0,0 +1,452 @@
+package xfbbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// Right is something a grant allows on the owner's card.
+type Right string
+
+const (
+	// balance, wallets and transactions
+	RightRead Right = "read"
+	// create payment codes
+	RightPay Right = "pay"
+	// recharge the main balance
+	RightRecharge Right = "recharge"
+)
+
+func validRight(r Right) bool {
+	return r == RightRead || r == RightPay || r == RightRecharge
+}
+
+// Grant gives another broker user access to a card without sharing its
+// SessionId. DailyLimit caps what pay and recharge may spend per day in
+// yuan, 0 means no limit. Spent is what was spent on SpentDay.
+type Grant struct {
+	Rights     []Right
+	DailyLimit float64
+	Spent      float64
+	SpentDay   string
+	CreatedAt  time.Time
+}
+
+func (g Grant) Has(r Right) bool {
+	return slices.Contains(g.Rights, r)
+}
+
+func spendDay(now time.Time) string {
+	return now.In(xfb.Location).Format(time.DateOnly)
+}
+
+// SpentOn is what was spent through the grant on the day of now.
+func (g Grant) SpentOn(now time.Time) float64 {
+	if g.SpentDay != spendDay(now) {
+		return 0
+	}
+	return g.Spent
+}
+
+// exhausted reports whether nothing more may be spent today.
+func (g Grant) exhausted(now time.Time) bool {
+	return g.DailyLimit > 0 && g.SpentOn(now) >= g.DailyLimit
+}
+
+func (c *Config) validateGrants() []error {
+	var errs []error
+	for k, u := range c.Users {
+		for grantee, g := range u.Grants {
+			if grantee == k {
+				errs = append(errs, fmt.Errorf("user %s: grant to itself", k))
+			} else if _, ok := c.Users[grantee]; !ok {
+				errs = append(errs, fmt.Errorf("user %s: grant to unknown user %s", k, grantee))
+			}
+			for _, r := range g.Rights {
+				if !validRight(r) {
+					errs = append(errs, fmt.Errorf("user %s: grant to %s: unknown right %q", k, grantee, r))
+				}
+			}
+			if g.DailyLimit < 0 {
+				errs = append(errs, fmt.Errorf("user %s: grant to %s: DailyLimit must not be negative", k, grantee))
+			}
+		}
+	}
+	return errs
+}
+
+// allows reports whether amount may still be spent through g today.
+func (g Grant) allows(amount float64, now time.Time) error {
+	if g.DailyLimit > 0 && g.SpentOn(now)+amount > g.DailyLimit+1e-9 {
+		return newApiError(http.StatusForbidden, ErrLimitExceeded,
+			fmt.Sprintf("amount would exceed the daily limit of %.2f, %.2f left", g.DailyLimit, math.Max(g.DailyLimit-g.SpentOn(now), 0)))
+	}
+	return nil
+}
+
+// checkGrant reports whether grantee may spend amount on owner's card
+// today, without booking it.
+func (c *Config) checkGrant(owner, grantee string, amount float64, now time.Time) error {
+	u, ok := c.GetUser(owner)
+	if !ok {
+		return newApiError(http.StatusForbidden, ErrForbidden, "access revoked")
+	}
+	g, ok := u.Grants[grantee]
+	if !ok {
+		return newApiError(http.StatusForbidden, ErrForbidden, "access revoked")
+	}
+	return g.allows(amount, now)
+}
+
+// chargeGrant adds amount to what grantee spent on owner's card today.
+// With check, it fails instead if that would exceed the daily limit.
+func (c *Config) chargeGrant(owner, grantee string, amount float64, now time.Time, check bool) error {
+	var err error
+	ok := c.UpdateUser(owner, func(u *User) {
+		g, ok := u.Grants[grantee]
+		if !ok {
+			err = newApiError(http.StatusForbidden, ErrForbidden, "access revoked")
+			return
+		}
+		if check {
+			if err = g.allows(amount, now); err != nil {
+				return
+			}
+		}
+		g.Spent = math.Max(g.SpentOn(now)+amount, 0)
+		g.SpentDay = spendDay(now)
+		u.Grants[grantee] = g
+	})
+	if !ok {
+		return newApiError(http.StatusForbidden, ErrForbidden, "access revoked")
+	}
+	return err
+}
+
+type GrantView struct {
+	Owner      string    `json:"owner"`
+	OwnerName  string    `json:"ownerName"`
+	Grantee    string    `json:"grantee"`
+	Rights     []Right   `json:"rights"`
+	DailyLimit float64   `json:"dailyLimit"`
+	SpentToday float64   `json:"spentToday"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func grantView(owner *User, grantee string, g Grant, now time.Time) GrantView {
+	rights := g.Rights
+	if rights == nil {
+		rights = []Right{}
+	}
+	return GrantView{
+		Owner:      owner.YmUserId,
+		OwnerName:  owner.Name,
+		Grantee:    grantee,
+		Rights:     rights,
+		DailyLimit: g.DailyLimit,
+		SpentToday: g.SpentOn(now),
+		CreatedAt:  g.CreatedAt,
+	}
+}
+
+type GrantsResponse struct {
+	Given    []GrantView `json:"given"`
+	Received []GrantView `json:"received"`
+}
+
+func (s *ApiServer) handleGrants(w http.ResponseWriter, r *http.Request, user *User) {
+	now := time.Now()
+	res := GrantsResponse{Given: []GrantView{}, Received: []GrantView{}}
+	for grantee, g := range user.Grants {
+		res.Given = append(res.Given, grantView(user, grantee, g, now))
+	}
+	for _, k := range s.cfg.UserIds() {
+		owner, ok := s.cfg.GetUser(k)
+		if !ok {
+			continue
+		}
+		if g, ok := owner.Grants[user.YmUserId]; ok {
+			res.Received = append(res.Received, grantView(&owner, user.YmUserId, g, now))
+		}
+	}
+	sort.Slice(res.Given, func(i, j int) bool { return res.Given[i].Grantee < res.Given[j].Grantee })
+	sort.Slice(res.Received, func(i, j int) bool { return res.Received[i].Owner < res.Received[j].Owner })
+	writeData(w, r, http.StatusOK, res)
+}
+
+type GrantRequest struct {
+	Rights     []Right `json:"rights"`
+	DailyLimit float64 `json:"dailyLimit"`
+}
+
+// handlePutGrant creates or changes the grant of the authenticated user to
+// another user. Changing a grant keeps what was already spent today.
+func (s *ApiServer) handlePutGrant(w http.ResponseWriter, r *http.Request, user *User) {
+	grantee := mux.Vars(r)["grantee"]
+	var req GrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "invalid body: "+err.Error()))
+		return
+	}
+	if len(req.Rights) == 0 {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "rights must not be empty"))
+		return
+	}
+	for _, right := range req.Rights {
+		if !validRight(right) {
+			writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, fmt.Sprintf("unknown right %q", right)))
+			return
+		}
+	}
+	if req.DailyLimit < 0 {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "dailyLimit must not be negative"))
+		return
+	}
+	if _, ok := s.cfg.GetUser(grantee); !ok || grantee == user.YmUserId {
+		writeError(w, r, newApiError(http.StatusNotFound, ErrNotFound, "no such user "+grantee))
+		return
+	}
+
+	now := time.Now()
+	var g Grant
+	s.cfg.UpdateUser(user.YmUserId, func(u *User) {
+		if u.Grants == nil {
+			u.Grants = make(map[string]Grant)
+		}
+		g = u.Grants[grantee]
+		if g.CreatedAt.IsZero() {
+			g.CreatedAt = now
+		}
+		g.Rights = slices.Clone(req.Rights)
+		slices.Sort(g.Rights)
+		g.Rights = slices.Compact(g.Rights)
+		g.DailyLimit = req.DailyLimit
+		u.Grants[grantee] = g
+	})
+	if err := s.cfg.Save(); err != nil {
+		slog.ErrorContext(r.Context(), "unable to save config", "err", err)
+	}
+	slog.InfoContext(r.Context(), "grant changed", "owner", user.Name, "grantee", grantee, "rights", g.Rights, "dailyLimit", g.DailyLimit)
+	writeData(w, r, http.StatusOK, grantView(user, grantee, g, now))
+}
+
+// handleDeleteGrant revokes a grant. It takes effect with the next request
+// of the grantee.
+func (s *ApiServer) handleDeleteGrant(w http.ResponseWriter, r *http.Request, user *User) {
+	grantee := mux.Vars(r)["grantee"]
+	var g Grant
+	var ok bool
+	s.cfg.UpdateUser(user.YmUserId, func(u *User) {
+		if g, ok = u.Grants[grantee]; ok {
+			delete(u.Grants, grantee)
+		}
+	})
+	if !ok {
+		writeError(w, r, newApiError(http.StatusNotFound, ErrNotFound, "no grant to "+grantee))
+		return
+	}
+	if err := s.cfg.Save(); err != nil {
+		slog.ErrorContext(r.Context(), "unable to save config", "err", err)
+	}
+	slog.InfoContext(r.Context(), "grant revoked", "owner", user.Name, "grantee", grantee)
+	writeData(w, r, http.StatusOK, grantView(user, grantee, g, time.Now()))
+}
+
+// shared wraps a handler acting on the card of the user in the {owner}
+// path variable on behalf of the authenticated user, who needs a grant
+// with right. Unknown owners look like missing grants.
+func (s *ApiServer) shared(right Right, h func(w http.ResponseWriter, r *http.Request, owner *User, grantee *User)) http.HandlerFunc {
+	return s.v2(func(w http.ResponseWriter, r *http.Request, grantee *User) {
+		owner, ok := s.cfg.GetUser(mux.Vars(r)["owner"])
+		g, granted := owner.Grants[grantee.YmUserId]
+		if !ok || !granted || !g.Has(right) {
+			writeError(w, r, newApiError(http.StatusForbidden, ErrForbidden, fmt.Sprintf("no %s access to this card", right)))
+			return
+		}
+		if right != RightRead && !owner.Enabled {
+			writeError(w, r, newApiError(http.StatusForbidden, ErrUserDisabled, "user disabled"))
+			return
+		}
+		if right != RightRead && g.exhausted(time.Now()) {
+			writeError(w, r, newApiError(http.StatusForbidden, ErrLimitExceeded, fmt.Sprintf("daily limit of %.2f reached", g.DailyLimit)))
+			return
+		}
+		h(w, r, &owner, grantee)
+	})
+}
+
+func (s *ApiServer) handleSharedCodepayCreate(w http.ResponseWriter, r *http.Request, owner *User, grantee *User) {
+	code, err := createCodepay(r.Context(), owner)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// charged to the grant once the code is reported paid
+	codepayLock.Lock()
+	codepayGrants[code.QRCode] = grantRef{owner: owner.YmUserId, grantee: grantee.YmUserId}
+	codepayLock.Unlock()
+	go s.watchSharedCodepay(context.WithoutCancel(r.Context()), code.QRCode)
+
+	slog.InfoContext(r.Context(), "shared codepay created", "owner", owner.Name, "grantee", grantee.Name)
+	writeData(w, r, http.StatusCreated, CodepayView{
+		QrCode: code.QRCode,
+		Status: CodepayPending.String(),
+	})
+}
+
+type RechargeRequest struct {
+	Amount float64 `json:"amount"`
+}
+
+type RechargeView struct {
+	TranNo string  `json:"tranNo"`
+	Amount float64 `json:"amount"`
+	DryRun bool    `json:"dryRun,omitempty"`
+}
+
+// maxRecharge is the largest single recharge, the same cap the balance
+// poller uses.
+const maxRecharge = 100
+
+func (s *ApiServer) handleSharedRecharge(w http.ResponseWriter, r *http.Request, owner *User, grantee *User) {
+	var req RechargeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "invalid body: "+err.Error()))
+		return
+	}
+	if req.Amount <= 0 || req.Amount > maxRecharge {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, fmt.Sprintf("amount must be in (0, %d]", maxRecharge)))
+		return
+	}
+	// round to fen as sent upstream
+	amount, _ := strconv.ParseFloat(strconv.FormatFloat(req.Amount, 'f', 2, 64), 64)
+
+	// one shared recharge at a time, so that concurrent ones cannot both
+	// pass the limit before either is booked
+	s.rechargeLock.Lock()
+	defer s.rechargeLock.Unlock()
+	now := time.Now()
+	if err := s.cfg.checkGrant(owner.YmUserId, grantee.YmUserId, amount, now); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tranNo, err := s.cfg.Recharge(r.Context(), owner, amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// a dry run recharged nothing
+	if !s.cfg.DryRun() {
+		if err := s.cfg.chargeGrant(owner.YmUserId, grantee.YmUserId, amount, now, false); err != nil {
+			slog.ErrorContext(r.Context(), "unable to book shared recharge", "err", err)
+		}
+		if err := s.cfg.Save(); err != nil {
+			slog.ErrorContext(r.Context(), "unable to save config", "err", err)
+		}
+	}
+
+	slog.InfoContext(r.Context(), "shared recharge", "owner", owner.Name, "grantee", grantee.Name, "amount", amount, "tranNo", tranNo)
+	writeData(w, r, http.StatusOK, RechargeView{TranNo: tranNo, Amount: amount, DryRun: s.cfg.DryRun()})
+}
+
+type grantRef struct {
+	owner   string
+	grantee string
+}
+
+// payment codes created through a grant, guarded by codepayLock
+var codepayGrants = make(map[string]grantRef)
+
+// chargeCodepay books the amount of a paid shared payment code on its
+// grant. A single payment may go over the limit, further codes are then
+// refused by shared.
+func (s *ApiServer) chargeCodepay(code string, money any) {
+	codepayLock.Lock()
+	ref, ok := codepayGrants[code]
+	delete(codepayGrants, code)
+	codepayLock.Unlock()
+	if !ok {
+		return
+	}
+
+	amount, err := strconv.ParseFloat(fmt.Sprint(money), 64)
+	if err != nil {
+		slog.Error("unable to parse codepay amount", "err", err, "money", money)
+		return
+	}
+	if err := s.cfg.chargeGrant(ref.owner, ref.grantee, math.Abs(amount), time.Now(), false); err != nil {
+		slog.Warn("unable to charge grant", "err", err, "owner", ref.owner, "grantee", ref.grantee)
+	}
+}
+
+// sharedCodepayPoll is how often watchSharedCodepay asks whether a shared
+// code was paid.
+var sharedCodepayPoll = 3 * time.Second
+
+// watchSharedCodepay polls a shared payment code until it is paid or
+// expired, so that its payment is charged to the grant even when the
+// grantee never queries it. Late payments are still seen for
+// codepayLifetime after the code expired.
+func (s *ApiServer) watchSharedCodepay(ctx context.Context, code string) {
+	ctx, cancel := context.WithTimeout(ctx, 2*codepayLifetime*time.Second)
+	defer cancel()
+	ticker := time.NewTicker(sharedCodepayPoll)
+	defer ticker.Stop()
+	for {
+		codepayLock.Lock()
+		e, ok := codepayInstances[code]
+		_, pending := codepayGrants[code]
+		if ok && pending && time.Now().Unix()-e.Creation > 2*codepayLifetime {
+			delete(codepayGrants, code)
+			pending = false
+		}
+		codepayLock.Unlock()
+		// paid, expired or forgotten
+		if !ok || !pending || e.settled {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := e.GetResult(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to query shared codepay", "err", err)
+			continue
+		}
+		if money, ok := res["monDealCur"]; ok {
+			s.settleCodepay(code, money)
+			return
+		}
+	}
+}
+
+func (s *ApiServer) routeGrants(v2 *mux.Router) {
+	v2.HandleFunc("/grants", s.v2(s.handleGrants)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/grants/{grantee}", s.v2(s.handlePutGrant)).Methods(http.MethodPut, http.MethodOptions)
+	v2.HandleFunc("/grants/{grantee}", s.v2(s.handleDeleteGrant)).Methods(http.MethodDelete, http.MethodOptions)
+
+	v2.HandleFunc("/shared/{owner}/cards", s.shared(RightRead, func(w http.ResponseWriter, r *http.Request, owner *User, _ *User) {
+		s.handleV2Cards(w, r, owner)
+	})).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/shared/{owner}/transactions", s.shared(RightRead, func(w http.ResponseWriter, r *http.Request, owner *User, _ *User) {
+		s.handleV2Transactions(w, r, owner)
+	})).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/shared/{owner}/codepay", s.shared(RightPay, s.handleSharedCodepayCreate)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/shared/{owner}/recharge", s.shared(RightRecharge, s.handleSharedRecharge)).Methods(http.MethodPost, http.MethodOptions)
+}
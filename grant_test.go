@@ -0,0 +1,172 @@
+package xfbbroker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func grantUsers() []User {
+	return []User{
+		{Name: "Owner", YmUserId: "a", SessionId: "sa", Enabled: true},
+		{Name: "Grantee", YmUserId: "b", SessionId: "sb", Enabled: true},
+	}
+}
+
+func TestChargeGrantDailyLimit(t *testing.T) {
+	users := grantUsers()
+	users[0].Grants = map[string]Grant{"b": {Rights: []Right{RightPay}, DailyLimit: 20}}
+	c := newTestConfig(t, nil, users...)
+	day := time.Date(2024, 5, 6, 12, 0, 0, 0, xfb.Location)
+
+	if err := c.chargeGrant("a", "b", 15, day, true); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *ApiError
+	if err := c.chargeGrant("a", "b", 10, day, true); !errors.As(err, &apiErr) || apiErr.Code != ErrLimitExceeded {
+		t.Fatalf("over the limit: %v", err)
+	}
+	// paid codes are charged without check, even past the limit
+	if err := c.chargeGrant("a", "b", 10, day, false); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := c.GetUser("a")
+	if got := u.Grants["b"].SpentOn(day); got != 25 || !u.Grants["b"].exhausted(day) {
+		t.Errorf("spent = %v", got)
+	}
+	// a new day starts from zero
+	next := day.Add(24 * time.Hour)
+	if u.Grants["b"].SpentOn(next) != 0 || c.chargeGrant("a", "b", 20, next, true) != nil {
+		t.Error("the limit did not reset the next day")
+	}
+	if err := c.chargeGrant("a", "c", 1, day, true); !errors.As(err, &apiErr) || apiErr.Status != http.StatusForbidden {
+		t.Errorf("charge without grant: %v", err)
+	}
+}
+
+func TestGrantLifecycle(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+
+	if w := serve(t, h, "GET", "/api/v2/shared/a/cards", "sb", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("read without grant: %d", w.Code)
+	}
+	if w := serve(t, h, "PUT", "/api/v2/grants/b", "sa", GrantRequest{Rights: []Right{"admin"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown right: %d", w.Code)
+	}
+	if w := serve(t, h, "PUT", "/api/v2/grants/a", "sa", GrantRequest{Rights: []Right{RightRead}}); w.Code != http.StatusNotFound {
+		t.Errorf("grant to itself: %d", w.Code)
+	}
+	w := serve(t, h, "PUT", "/api/v2/grants/b", "sa", GrantRequest{Rights: []Right{RightPay, RightRead, RightPay}, DailyLimit: 30})
+	if w.Code != http.StatusOK {
+		t.Fatalf("put grant: %d %s", w.Code, w.Body)
+	}
+	if v := decodeData[GrantView](t, w); len(v.Rights) != 2 || v.DailyLimit != 30 {
+		t.Errorf("grant = %+v", v)
+	}
+
+	res := decodeData[GrantsResponse](t, serve(t, h, "GET", "/api/v2/grants", "sb", nil))
+	if len(res.Given) != 0 || len(res.Received) != 1 || res.Received[0].Owner != "a" || res.Received[0].OwnerName != "Owner" {
+		t.Errorf("grants of grantee = %+v", res)
+	}
+	// pay does not imply recharge
+	if w := serve(t, h, "POST", "/api/v2/shared/a/recharge", "sb", RechargeRequest{Amount: 10}); w.Code != http.StatusForbidden {
+		t.Errorf("recharge without right: %d", w.Code)
+	}
+
+	if w := serve(t, h, "DELETE", "/api/v2/grants/b", "sa", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete grant: %d", w.Code)
+	}
+	if w := serve(t, h, "DELETE", "/api/v2/grants/b", "sa", nil); w.Code != http.StatusNotFound {
+		t.Errorf("delete twice: %d", w.Code)
+	}
+	if w := serve(t, h, "GET", "/api/v2/shared/a/transactions", "sb", nil); w.Code != http.StatusForbidden {
+		t.Errorf("read after revoke: %d", w.Code)
+	}
+}
+
+func TestSettleCodepayOnce(t *testing.T) {
+	users := grantUsers()
+	users[0].Grants = map[string]Grant{"b": {Rights: []Right{RightPay}, DailyLimit: 20}}
+	c := newTestConfig(t, nil, users...)
+	s := &ApiServer{cfg: c}
+
+	codepayLock.Lock()
+	codepayInstances["settle"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "settle", Creation: time.Now().Unix()}, user: "a"}
+	codepayGrants["settle"] = grantRef{owner: "a", grantee: "b"}
+	codepayLock.Unlock()
+	t.Cleanup(func() {
+		codepayLock.Lock()
+		delete(codepayInstances, "settle")
+		delete(codepayGrants, "settle")
+		codepayLock.Unlock()
+	})
+
+	// the watcher and a query may both see the payment
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.settleCodepay("settle", "-12.50")
+		}()
+	}
+	wg.Wait()
+
+	u, _ := c.GetUser("a")
+	if got := u.Grants["b"].SpentOn(time.Now()); got != 12.5 {
+		t.Errorf("spent = %v, want 12.5", got)
+	}
+}
+
+func TestCodepaysExpire(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	s := &ApiServer{cfg: c}
+	now := time.Now().Unix()
+
+	codepayLock.Lock()
+	codepayInstances["stale"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "stale", Creation: now - codepayLifetime - codepayRetention - 1}, user: "a"}
+	codepayGrants["stale"] = grantRef{owner: "a", grantee: "b"}
+	codepayInstances["late"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "late", Creation: now - 2*codepayLifetime - 1}, user: "a"}
+	codepayGrants["late"] = grantRef{owner: "a", grantee: "b"}
+	codepayInstances["fresh"] = codepayEntry{QrPayCode: &xfb.QrPayCode{QRCode: "fresh", Creation: now}, user: "a"}
+	expireCodepays(now)
+	_, stale := codepayInstances["stale"]
+	_, staleGrant := codepayGrants["stale"]
+	_, fresh := codepayInstances["fresh"]
+	codepayLock.Unlock()
+	t.Cleanup(func() {
+		codepayLock.Lock()
+		delete(codepayInstances, "late")
+		delete(codepayInstances, "fresh")
+		codepayLock.Unlock()
+	})
+	if stale || staleGrant || !fresh {
+		t.Errorf("after expiring: stale=%v staleGrant=%v fresh=%v", stale, staleGrant, fresh)
+	}
+
+	// the watcher gives up on codes past their lifetime without asking
+	// xiaofubao, the code stays around for late queries
+	done := make(chan struct{})
+	go func() {
+		s.watchSharedCodepay(context.Background(), "late")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher still running")
+	}
+	codepayLock.Lock()
+	_, late := codepayInstances["late"]
+	_, lateGrant := codepayGrants["late"]
+	codepayLock.Unlock()
+	if !late || lateGrant {
+		t.Errorf("after watching: code=%v grant=%v", late, lateGrant)
+	}
+}
@@ -0,0 +1,79 @@
+package xfbbroker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// HealthState tracks whether a user can be polled.
+//
+//	healthy -> degraded -> suspended    on transient failures
+//	any     -> needs-reauth             when xiaofubao rejects the session
+//	any     -> healthy                  on success or re-auth
+type HealthState string
+
+const (
+	HealthHealthy HealthState = "healthy"
+	// polled with exponential backoff
+	HealthDegraded HealthState = "degraded"
+	// polled only every ProbeInterval
+	HealthSuspended HealthState = "suspended"
+	// not polled until the user authorizes again
+	HealthNeedsReauth HealthState = "needs-reauth"
+)
+
+// consecutive transient failures before a user is suspended
+const suspendAfter = 3
+
+// State returns the health of u, treating records saved before the health
+// state existed as healthy.
+func (u *User) State() HealthState {
+	if u.Health == "" {
+		return HealthHealthy
+	}
+	return u.Health
+}
+
+// RecordSuccess marks a successful poll and returns the previous state.
+func (u *User) RecordSuccess(now time.Time) HealthState {
+	prev := u.State()
+	u.Failed = 0
+	u.Health = HealthHealthy
+	u.LastSuccessAt = now
+	return prev
+}
+
+// RecordFailure marks a failed poll and returns the previous state.
+func (u *User) RecordFailure(err error, now time.Time) HealthState {
+	prev := u.State()
+	u.Failed++
+	u.LastError = err.Error()
+	u.LastErrorAt = now
+
+	switch {
+	case errors.Is(err, xfb.ErrSessionExpired):
+		u.Health = HealthNeedsReauth
+	case prev == HealthNeedsReauth:
+		// only a successful re-auth leaves this state
+	case u.Failed >= suspendAfter:
+		u.Health = HealthSuspended
+	default:
+		u.Health = HealthDegraded
+	}
+	return prev
+}
+
+// Reauthorized resets the health of u after a new session was obtained.
+func (u *User) Reauthorized() {
+	u.Failed = 0
+	u.Health = HealthHealthy
+}
+
+func (c *Config) ProbeIntervalDuration() time.Duration {
+	if c.ProbeInterval <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(c.ProbeInterval) * time.Second
+}
@@ -0,0 +1,71 @@
+package xfbbroker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestHealthTransitions(t *testing.T) {
+	now := time.Now()
+	timeout := fmt.Errorf("%w: timeout", xfb.ErrUpstream)
+	expired := fmt.Errorf("%w: %w", xfb.ErrUpstream, xfb.ErrSessionExpired)
+
+	var u User
+	if u.State() != HealthHealthy {
+		t.Fatalf("zero user is %s", u.State())
+	}
+	for i, want := range []HealthState{HealthDegraded, HealthDegraded, HealthSuspended, HealthSuspended} {
+		prev := u.RecordFailure(timeout, now)
+		if u.State() != want || u.Failed != i+1 {
+			t.Errorf("failure %d: %s, %d failed", i+1, u.State(), u.Failed)
+		}
+		if i == 0 && prev != HealthHealthy {
+			t.Errorf("first failure came from %s", prev)
+		}
+	}
+	if prev := u.RecordSuccess(now); prev != HealthSuspended || u.State() != HealthHealthy || u.Failed != 0 || !u.LastSuccessAt.Equal(now) {
+		t.Errorf("success: from %s to %s, %d failed", prev, u.State(), u.Failed)
+	}
+
+	u.RecordFailure(expired, now)
+	if u.State() != HealthNeedsReauth || u.LastError != expired.Error() {
+		t.Fatalf("expired session: %s %q", u.State(), u.LastError)
+	}
+	// only a new session leaves needs-reauth
+	for i := 0; i < suspendAfter; i++ {
+		u.RecordFailure(timeout, now)
+	}
+	if u.State() != HealthNeedsReauth {
+		t.Errorf("needs-reauth left on failures: %s", u.State())
+	}
+	u.Reauthorized()
+	if u.State() != HealthHealthy || u.Failed != 0 {
+		t.Errorf("after re-auth: %s, %d failed", u.State(), u.Failed)
+	}
+}
+
+func TestUserHealthEndpoint(t *testing.T) {
+	users := grantUsers()
+	users[0].Health = HealthDegraded
+	users[0].Failed = 2
+	users[0].LastError = "timeout"
+	c := newTestConfig(t, nil, users...)
+	h := CreateApiServer(c)
+
+	w := serve(t, h, "GET", "/_/users/a/health", "sa", nil)
+	var res UserHealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if res.State != HealthDegraded || res.Failed != 2 || res.LastError != "timeout" || res.LastSuccessAt != nil {
+		t.Errorf("health = %+v", res)
+	}
+	if w := serve(t, h, "GET", "/_/users/a/health", "sb", nil); w.Code != http.StatusForbidden {
+		t.Errorf("other user's session: %d", w.Code)
+	}
+}
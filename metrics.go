@@ -0,0 +1,84 @@
+package xfbbroker
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	PollsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xfbbroker_polls_total",
+		Help: "Polls by user, kind (trans, balance) and outcome (success, failure).",
+	}, []string{"user", "kind", "outcome"})
+
+	NotificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xfbbroker_notifications_total",
+		Help: "Notifications by channel and outcome (sent, failed).",
+	}, []string{"channel", "outcome"})
+
+	RechargesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xfbbroker_recharges_total",
+		Help: "Recharges paid automatically.",
+	})
+
+	RechargeAmountTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xfbbroker_recharge_amount_yuan_total",
+		Help: "Total amount recharged automatically, in yuan.",
+	})
+
+	cardBalance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "xfbbroker_card_balance_yuan",
+		Help: "Last card balance seen per user, only with MetricsExposeBalances.",
+	}, []string{"user"})
+)
+
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "sent"
+}
+
+// ObserveNotification counts a notification sent through channel.
+func ObserveNotification(channel string, err error) {
+	NotificationsTotal.WithLabelValues(channel, outcome(err)).Inc()
+}
+
+// ObservePoll counts a poll of kind for u.
+func ObservePoll(u string, kind string, err error) {
+	o := "success"
+	if err != nil {
+		o = "failure"
+	}
+	PollsTotal.WithLabelValues(u, kind, o).Inc()
+}
+
+// ObserveBalance exports the balance of u if the config opts in, since
+// balances are private to the user.
+func (c *Config) ObserveBalance(u *User, balance float64) {
+	if c.MetricsExposeBalances {
+		cardBalance.WithLabelValues(u.YmUserId).Set(balance)
+	}
+}
+
+// metricsAuth lets only scrapers presenting MetricsToken through to next.
+// Without a token /metrics is not served at all.
+func (s *ApiServer) metricsAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.MetricsToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package xfbbroker
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObservePoll(t *testing.T) {
+	ok := PollsTotal.WithLabelValues("metrics", "trans", "success")
+	failed := PollsTotal.WithLabelValues("metrics", "trans", "failure")
+	before, beforeFailed := testutil.ToFloat64(ok), testutil.ToFloat64(failed)
+
+	ObservePoll("metrics", "trans", nil)
+	ObservePoll("metrics", "trans", errors.New("timeout"))
+	ObservePoll("metrics", "trans", nil)
+	if got := testutil.ToFloat64(ok) - before; got != 2 {
+		t.Errorf("%v successes counted", got)
+	}
+	if got := testutil.ToFloat64(failed) - beforeFailed; got != 1 {
+		t.Errorf("%v failures counted", got)
+	}
+}
+
+func TestObserveBalanceOptIn(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"MetricsToken": "scrape"})
+	c.ObserveBalance(&User{YmUserId: "private"}, 12.5)
+	c.MetricsExposeBalances = true
+	c.ObserveBalance(&User{YmUserId: "public"}, 7)
+
+	w := serve(t, CreateApiServer(c), "GET", "/metrics", "scrape", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics: %d", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, `user="private"`) || !strings.Contains(body, `xfbbroker_card_balance_yuan{user="public"} 7`) {
+		t.Errorf("balances in /metrics:\n%s", body)
+	}
+	for _, name := range []string{"xfbbroker_recharges_total", "xfbbroker_codepay_outstanding"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("%s missing", name)
+		}
+	}
+}
+
+func TestMetricsNeedToken(t *testing.T) {
+	if w := serve(t, CreateApiServer(newTestConfig(t, nil)), "GET", "/metrics", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("without MetricsToken: %d", w.Code)
+	}
+
+	h := CreateApiServer(newTestConfig(t, map[string]any{"MetricsToken": "scrape"}))
+	for _, token := range []string{"", "wrong"} {
+		if w := serve(t, h, "GET", "/metrics", token, nil); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "xfbbroker_") {
+			t.Errorf("token %q: %d", token, w.Code)
+		}
+	}
+	if w := serve(t, h, "GET", "/metrics", "scrape", nil); w.Code != http.StatusOK {
+		t.Errorf("with the token: %d", w.Code)
+	}
+}
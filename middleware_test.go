@@ -0,0 +1,178 @@
+package xfbbroker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	recorderOnce sync.Once
+	recorder     *tracetest.SpanRecorder
+)
+
+// spanRecorder installs a tracer provider recording every span of the
+// test binary.
+func spanRecorder() *tracetest.SpanRecorder {
+	recorderOnce.Do(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return recorder
+}
+
+// endedSpan returns the last ended span with the given request ID.
+func endedSpan(t *testing.T, requestId string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	spans := spanRecorder().Ended()
+	for i := len(spans) - 1; i >= 0; i-- {
+		for _, a := range spans[i].Attributes() {
+			if a.Key == "http.request.id" && a.Value.AsString() == requestId {
+				return spans[i]
+			}
+		}
+	}
+	t.Fatalf("no span for request %s", requestId)
+	return nil
+}
+
+func attr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, a := range s.Attributes() {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	spanRecorder()
+	h := CreateApiServer(newTestConfig(t, nil, grantUsers()...))
+
+	req := httptest.NewRequest("GET", "/api/v1/codepay/sa/query?code=1", nil)
+	req.Header.Set("X-Request-ID", "trace-1")
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	s := endedSpan(t, "trace-1")
+	if s.Name() != "GET /api/v1/codepay/{sessionId}/query" || strings.Contains(s.Name(), "sa") {
+		t.Errorf("span name %q", s.Name())
+	}
+	if s.SpanKind() != trace.SpanKindServer || attr(s, "http.route").AsString() != "/api/v1/codepay/{sessionId}/query" {
+		t.Errorf("kind %v, route %q", s.SpanKind(), attr(s, "http.route").AsString())
+	}
+	if s.Parent().TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || !s.Parent().IsRemote() {
+		t.Errorf("parent %v not taken from traceparent", s.Parent())
+	}
+
+	failing := requestIdMiddleware(tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	})))
+	req = httptest.NewRequest("GET", "/x", nil)
+	req.Header.Set("X-Request-ID", "trace-2")
+	failing.ServeHTTP(httptest.NewRecorder(), req)
+	s = endedSpan(t, "trace-2")
+	if attr(s, "http.response.status_code").AsInt64() != http.StatusBadGateway || s.Status().Code != codes.Error {
+		t.Errorf("failed request: status %v, span status %v", attr(s, "http.response.status_code"), s.Status())
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	var seen string
+	h := requestIdMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestId(r.Context())
+	}))
+	for _, tc := range []struct {
+		in   string
+		keep bool
+	}{
+		{"abc-123.X_y", true},
+		{"", false},
+		{"has space", false},
+		{strings.Repeat("a", 65), false},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", tc.in)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if (seen == tc.in) != tc.keep || seen == "" || w.Header().Get("X-Request-ID") != seen {
+			t.Errorf("X-Request-ID %q: handler saw %q, response has %q", tc.in, seen, w.Header().Get("X-Request-ID"))
+		}
+	}
+}
+
+func TestRedactedPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		vars map[string]string
+		want string
+	}{
+		{"/api/v1/codepay/s3cret/query?code=42", map[string]string{"sessionId": "s3cret"}, "/api/v1/codepay/REDACTED/query?code=REDACTED"},
+		{"/_/xfb/auth?ymToken=t&ymUserId=u&x=1", nil, "/_/xfb/auth?x=1&ymToken=REDACTED&ymUserId=REDACTED"},
+		{"/api/v2/shared/a/cards", map[string]string{"owner": "a"}, "/api/v2/shared/a/cards"},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest("GET", tc.path, nil), tc.vars)
+		if got := redactedPath(req); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	h := requestIdMiddleware(recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "panic-1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var env Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || w.Code != http.StatusInternalServerError {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if env.Success || env.Error.Code != ErrInternal || env.RequestId != "panic-1" || strings.Contains(w.Body.String(), "boom") {
+		t.Errorf("envelope %s", w.Body)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := CreateApiServer(newTestConfig(t, map[string]any{"CORSAllowedOrigins": []string{"https://ui.example.com"}}))
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/openapi.json", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", "https://ui.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://ui.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin: %v", w.Header())
+	}
+	if w := request("GET", "https://evil.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" || w.Code != http.StatusOK {
+		t.Errorf("other origin: %d %v", w.Code, w.Header())
+	}
+	w = request("OPTIONS", "https://ui.example.com")
+	if w.Code != http.StatusNoContent || !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("preflight: %d %v", w.Code, w.Header())
+	}
+
+	h = CreateApiServer(newTestConfig(t, map[string]any{"CORSAllowedOrigins": []string{"*"}}))
+	if w := request("GET", "https://any.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("wildcard: %v", w.Header())
+	}
+}
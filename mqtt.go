@@ -0,0 +1,280 @@
+package xfbbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTConfig connects the daemon to an MQTT broker for Home Assistant.
+type MQTTConfig struct {
+	// e.g. "tcp://localhost:1883", MQTT is disabled if empty
+	Broker   string
+	ClientId string
+	Username string
+	Password string
+	// "xfbbroker" if empty
+	TopicPrefix string
+	// where Home Assistant looks for discovery payloads, "homeassistant"
+	// if empty
+	DiscoveryPrefix string
+	// accept "refresh" on <prefix>/<ymUserId>/command
+	Commands bool
+	// also accept "codepay", which publishes a live payment code on
+	// <prefix>/<ymUserId>/codepay. Anyone able to read that topic can pay
+	// with the card, so give every user an account on the broker limited
+	// to their own topics first, e.g. with mosquitto:
+	//	pattern read xfbbroker/%u/#
+	//	pattern write xfbbroker/%u/command
+	// where the broker usernames are the ymUserIds. Requires Commands.
+	Codepay bool
+}
+
+func (m MQTTConfig) orDefault() MQTTConfig {
+	if m.ClientId == "" {
+		m.ClientId = "xfbbroker"
+	}
+	if m.TopicPrefix == "" {
+		m.TopicPrefix = "xfbbroker"
+	}
+	if m.DiscoveryPrefix == "" {
+		m.DiscoveryPrefix = "homeassistant"
+	}
+	return m
+}
+
+// MQTT publishes balance, last transaction and health of every user as
+// retained messages, announces them to Home Assistant and optionally takes
+// commands. A nil *MQTT publishes nothing.
+type MQTT struct {
+	cfg    *Config
+	opts   MQTTConfig
+	client mqtt.Client
+	// Refresh asks for the checks of user k to run now, set by the daemon
+	Refresh func(k string)
+
+	lock      sync.Mutex
+	announced map[string]bool
+}
+
+// NewMQTT returns nil if no broker is configured.
+func NewMQTT(cfg *Config) *MQTT {
+	if cfg.MQTT.Broker == "" {
+		return nil
+	}
+	m := &MQTT{cfg: cfg, opts: cfg.MQTT.orDefault(), announced: make(map[string]bool)}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.opts.Broker).
+		SetClientID(m.opts.ClientId).
+		SetUsername(m.opts.Username).
+		SetPassword(m.opts.Password).
+		SetWill(m.availability(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "err", err)
+		})
+	m.client = mqtt.NewClient(opts)
+	return m
+}
+
+func (m *MQTT) topic(k, name string) string {
+	return m.opts.TopicPrefix + "/" + k + "/" + name
+}
+
+func (m *MQTT) availability() string {
+	return m.opts.TopicPrefix + "/status"
+}
+
+// Run connects and stays connected until ctx is cancelled.
+func (m *MQTT) Run(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	// with SetConnectRetry the token completes once connected
+	m.client.Connect()
+	<-ctx.Done()
+
+	m.client.Publish(m.availability(), 1, true, "offline").WaitTimeout(time.Second)
+	m.client.Disconnect(250)
+}
+
+func (m *MQTT) onConnect(c mqtt.Client) {
+	slog.Info("MQTT connected", "broker", m.opts.Broker)
+	m.lock.Lock()
+	m.announced = make(map[string]bool)
+	m.lock.Unlock()
+
+	c.Publish(m.availability(), 1, true, "online")
+	for _, k := range m.cfg.UserIds() {
+		if u, ok := m.cfg.GetUser(k); ok {
+			m.PublishHealth(k, u.State())
+		}
+	}
+	if m.opts.Commands {
+		c.Subscribe(m.opts.TopicPrefix+"/+/command", 1, m.onCommand)
+	}
+}
+
+func (m *MQTT) publish(topic string, retained bool, payload any) {
+	var body []byte
+	switch v := payload.(type) {
+	case string:
+		body = []byte(v)
+	default:
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			slog.Error("unable to encode MQTT payload", "err", err, "topic", topic)
+			return
+		}
+	}
+	// the client queues while disconnected, never block the pollers
+	m.client.Publish(topic, 1, retained, body)
+}
+
+// announce publishes the Home Assistant discovery payloads of user k once
+// per connection.
+func (m *MQTT) announce(k string) {
+	m.lock.Lock()
+	done := m.announced[k]
+	m.announced[k] = true
+	m.lock.Unlock()
+	if done {
+		return
+	}
+	u, ok := m.cfg.GetUser(k)
+	if !ok {
+		return
+	}
+
+	id := "xfbbroker_" + k
+	device := map[string]any{
+		"identifiers":  []string{id},
+		"name":         u.Name + " 校园卡",
+		"manufacturer": "xfbbroker",
+	}
+	entity := func(component, object string, fields map[string]any) {
+		fields["unique_id"] = id + "_" + object
+		fields["object_id"] = id + "_" + object
+		fields["availability_topic"] = m.availability()
+		fields["device"] = device
+		m.publish(fmt.Sprintf("%s/%s/%s/%s/config", m.opts.DiscoveryPrefix, component, id, object), true, fields)
+	}
+
+	entity("sensor", "balance", map[string]any{
+		"name":                "余额",
+		"state_topic":         m.topic(k, "balance"),
+		"unit_of_measurement": "CNY",
+		"device_class":        "monetary",
+		"state_class":         "total",
+	})
+	entity("sensor", "last_transaction", map[string]any{
+		"name":                  "最近交易",
+		"state_topic":           m.topic(k, "transaction"),
+		"value_template":        "{{ value_json.money }}",
+		"json_attributes_topic": m.topic(k, "transaction"),
+		"unit_of_measurement":   "CNY",
+		"device_class":          "monetary",
+	})
+	entity("sensor", "health", map[string]any{
+		"name":         "状态",
+		"state_topic":  m.topic(k, "health"),
+		"device_class": "enum",
+		"options":      []HealthState{HealthHealthy, HealthDegraded, HealthSuspended, HealthNeedsReauth},
+	})
+	if m.opts.Commands {
+		entity("button", "refresh", map[string]any{
+			"name":          "刷新",
+			"command_topic": m.topic(k, "command"),
+			"payload_press": "refresh",
+		})
+	}
+	if m.opts.Commands && m.opts.Codepay {
+		entity("sensor", "codepay", map[string]any{
+			"name":        "付款码",
+			"state_topic": m.topic(k, "codepay"),
+		})
+		entity("button", "codepay", map[string]any{
+			"name":          "生成付款码",
+			"command_topic": m.topic(k, "command"),
+			"payload_press": "codepay",
+		})
+	}
+}
+
+func (m *MQTT) PublishBalance(k string, balance float64) {
+	if m == nil {
+		return
+	}
+	m.announce(k)
+	m.publish(m.topic(k, "balance"), true, strconv.FormatFloat(balance, 'f', 2, 64))
+}
+
+func (m *MQTT) PublishTransaction(k string, t Transaction) {
+	if m == nil {
+		return
+	}
+	m.announce(k)
+	m.publish(m.topic(k, "transaction"), true, t)
+}
+
+func (m *MQTT) PublishHealth(k string, state HealthState) {
+	if m == nil {
+		return
+	}
+	m.announce(k)
+	m.publish(m.topic(k, "health"), true, string(state))
+}
+
+func (m *MQTT) onCommand(_ mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 3 {
+		return
+	}
+	k := parts[len(parts)-2]
+	u, ok := m.cfg.GetUser(k)
+	if !ok || !u.Enabled {
+		slog.Warn("MQTT command for unknown or disabled user", "user", k)
+		return
+	}
+
+	cmd := strings.TrimSpace(string(msg.Payload()))
+	slog.Info("MQTT command", "user", u.Name, "command", cmd)
+	switch cmd {
+	case "refresh":
+		if m.Refresh != nil {
+			m.Refresh(k)
+		}
+	case "codepay":
+		if !m.opts.Codepay {
+			slog.Warn("MQTT codepay is disabled", "user", u.Name)
+			return
+		}
+		// callbacks run on the client's goroutine, which must not wait on
+		// xiaofubao
+		go m.codepay(k, &u)
+	default:
+		slog.Warn("unknown MQTT command", "command", cmd)
+	}
+}
+
+func (m *MQTT) codepay(k string, u *User) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	code, err := createCodepay(ctx, u)
+	if err != nil {
+		slog.Error("MQTT codepay failed", "err", err, "user", u.Name)
+		return
+	}
+	// payment codes expire quickly, do not retain them
+	m.publish(m.topic(k, "codepay"), false, code.QRCode)
+}
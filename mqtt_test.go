@@ -0,0 +1,158 @@
+package xfbbroker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// testBroker runs an MQTT broker on a free local port and records the last
+// message of every topic.
+type testBroker struct {
+	*mochi.Server
+	addr string
+
+	lock sync.Mutex
+	last map[string]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	s := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := s.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	l := listeners.NewTCP(listeners.Config{ID: "t", Address: "127.0.0.1:0"})
+	if err := s.AddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	b := &testBroker{Server: s, addr: "tcp://" + l.Address(), last: make(map[string]string)}
+	err := s.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.lock.Lock()
+		b.last[pk.TopicName] = string(pk.Payload)
+		b.lock.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// wait returns the last message on topic once there is one that
+// satisfies ok.
+func (b *testBroker) wait(t *testing.T, topic string, ok func(string) bool) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.lock.Lock()
+		v, found := b.last[topic]
+		b.lock.Unlock()
+		if found && ok(v) {
+			return v
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("nothing suitable published on %s", topic)
+	return ""
+}
+
+func (b *testBroker) has(topic string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.last[topic]
+	return ok
+}
+
+func equals(s string) func(string) bool {
+	return func(v string) bool { return v == s }
+}
+
+func TestMQTT(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestConfig(t, map[string]any{
+		"MQTT": MQTTConfig{Broker: b.addr, Commands: true},
+	}, User{Name: "A", YmUserId: "a", Enabled: true})
+
+	m := NewMQTT(c)
+	refreshed := make(chan string, 1)
+	m.Refresh = func(k string) { refreshed <- k }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	b.wait(t, "xfbbroker/status", equals("online"))
+	b.wait(t, "xfbbroker/a/health", equals(string(HealthHealthy)))
+
+	var balance map[string]any
+	json.Unmarshal([]byte(b.wait(t, "homeassistant/sensor/xfbbroker_a/balance/config", func(string) bool { return true })), &balance)
+	if balance["state_topic"] != "xfbbroker/a/balance" || balance["availability_topic"] != "xfbbroker/status" {
+		t.Errorf("balance discovery = %v", balance)
+	}
+	b.wait(t, "homeassistant/button/xfbbroker_a/refresh/config", func(string) bool { return true })
+
+	m.PublishBalance("a", 12.5)
+	b.wait(t, "xfbbroker/a/balance", equals("12.50"))
+	m.PublishTransaction("a", Transaction{Trans: xfb.Trans{Serialno: "1", Money: "-3.00"}})
+	b.wait(t, "xfbbroker/a/transaction", func(v string) bool {
+		var tr Transaction
+		return json.Unmarshal([]byte(v), &tr) == nil && tr.Money == "-3.00"
+	})
+
+	b.Publish("xfbbroker/a/command", []byte("refresh"), false, 1)
+	select {
+	case k := <-refreshed:
+		if k != "a" {
+			t.Errorf("refreshed %s", k)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh command not handled")
+	}
+	b.Publish("xfbbroker/unknown/command", []byte("refresh"), false, 1)
+
+	// payment codes are not offered unless Codepay is set
+	b.Publish("xfbbroker/a/command", []byte("codepay"), false, 1)
+	b.Publish("xfbbroker/a/command", []byte("refresh"), false, 1)
+	if k := <-refreshed; k != "a" {
+		t.Errorf("refreshed %s", k)
+	}
+	if b.has("xfbbroker/a/codepay") || b.has("homeassistant/button/xfbbroker_a/codepay/config") {
+		t.Error("codepay offered without Codepay")
+	}
+	select {
+	case k := <-refreshed:
+		t.Errorf("refreshed %s", k)
+	default:
+	}
+
+	cancel()
+	<-done
+	b.wait(t, "xfbbroker/status", equals("offline"))
+}
+
+func TestMQTTCodepayRequiresCommands(t *testing.T) {
+	c := newTestConfig(t, map[string]any{
+		"MQTT": MQTTConfig{Broker: "tcp://127.0.0.1:1883", Codepay: true},
+	})
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "Codepay requires Commands") {
+		t.Errorf("Validate() = %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package xfbbroker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RateLimit allows Rate requests per minute with bursts of up to Burst.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RouteRateLimit applies limits per client IP and per credential to the
+// route with the given mux path template, e.g. "/api/v1/codepay/create".
+type RouteRateLimit struct {
+	Route    string
+	PerIP    *RateLimit
+	PerToken *RateLimit
+}
+
+// defaultRateLimits protect the routes that trigger upstream requests for
+// anyone, used when the config has no RateLimits.
+var defaultRateLimits = []RouteRateLimit{
+	{Route: "/_/xfb/auth", PerIP: &RateLimit{Rate: 10, Burst: 5}},
+	{Route: "/api/v1/codepay/create", PerIP: &RateLimit{Rate: 30, Burst: 10}, PerToken: &RateLimit{Rate: 6, Burst: 3}},
+	{Route: "/api/v1/codepay/{sessionId}/create", PerIP: &RateLimit{Rate: 30, Burst: 10}, PerToken: &RateLimit{Rate: 6, Burst: 3}},
+	{Route: "/api/v1/transactions/export", PerIP: &RateLimit{Rate: 10, Burst: 3}, PerToken: &RateLimit{Rate: 2, Burst: 2}},
+	{Route: "/api/v1/transactions.ics", PerIP: &RateLimit{Rate: 10, Burst: 3}, PerToken: &RateLimit{Rate: 2, Burst: 2}},
+	{Route: "/api/v2/codepay", PerIP: &RateLimit{Rate: 30, Burst: 10}, PerToken: &RateLimit{Rate: 6, Burst: 3}},
+	{Route: "/api/v2/shared/{owner}/codepay", PerIP: &RateLimit{Rate: 30, Burst: 10}, PerToken: &RateLimit{Rate: 6, Burst: 3}},
+	{Route: "/api/v2/shared/{owner}/recharge", PerIP: &RateLimit{Rate: 10, Burst: 3}, PerToken: &RateLimit{Rate: 2, Burst: 2}},
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sweepInterval is how often limiters forget the clients they no longer
+// need to remember. The timer only runs while there are any.
+const sweepInterval = time.Minute
+
+// limiter is a set of token buckets sharing one RateLimit.
+type limiter struct {
+	lock    sync.Mutex
+	limit   RateLimit
+	buckets map[string]*bucket
+	timer   *time.Timer
+}
+
+func newLimiter(l RateLimit) *limiter {
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	return &limiter{limit: l, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of key, or reports how long to wait
+// for the next one.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	perSecond := l.limit.Rate / 60
+	burst := float64(l.limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		// a flood of new clients cannot wait for the timer
+		if len(l.buckets) >= 1024 {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+		if l.timer == nil {
+			l.timer = time.AfterFunc(sweepInterval, l.tick)
+		}
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if perSecond <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+func (l *limiter) tick() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(time.Now())
+	if len(l.buckets) > 0 {
+		l.timer.Reset(sweepInterval)
+	} else {
+		l.timer = nil
+	}
+}
+
+// sweep forgets buckets that have refilled completely.
+func (l *limiter) sweep(now time.Time) {
+	if l.limit.Rate <= 0 {
+		// never refilled, the client must stay limited
+		return
+	}
+	full := time.Duration(float64(l.limit.Burst) / (l.limit.Rate / 60) * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+type routeLimiter struct {
+	perIP    *limiter
+	perToken *limiter
+}
+
+// failedLookups counts unknown credentials per client IP, and locks an IP
+// out once it guessed wrong too often within the window.
+type failedLookups struct {
+	lock     sync.Mutex
+	max      int
+	window   time.Duration
+	lockout  time.Duration
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+	timer    *time.Timer
+}
+
+func newFailedLookups(max int, window, lockout time.Duration) *failedLookups {
+	return &failedLookups{
+		max:      max,
+		window:   window,
+		lockout:  lockout,
+		failures: make(map[string][]time.Time),
+		locked:   make(map[string]time.Time),
+	}
+}
+
+func (f *failedLookups) record(ip string, now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.timer == nil {
+		f.timer = time.AfterFunc(sweepInterval, f.tick)
+	}
+
+	recent := f.failures[ip][:0]
+	for _, t := range f.failures[ip] {
+		if now.Sub(t) < f.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) >= f.max {
+		f.locked[ip] = now.Add(f.lockout)
+		delete(f.failures, ip)
+		return
+	}
+	f.failures[ip] = recent
+}
+
+// lockedFor returns how long ip stays locked out, 0 if it is not.
+func (f *failedLookups) lockedFor(ip string, now time.Time) time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	until, ok := f.locked[ip]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(f.locked, ip)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+func (f *failedLookups) tick() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sweep(time.Now())
+	if len(f.failures) > 0 || len(f.locked) > 0 {
+		f.timer.Reset(sweepInterval)
+	} else {
+		f.timer = nil
+	}
+}
+
+// sweep forgets IPs whose newest failure is out of the window and
+// lockouts that are over.
+func (f *failedLookups) sweep(now time.Time) {
+	for ip, ts := range f.failures {
+		if now.Sub(ts[len(ts)-1]) >= f.window {
+			delete(f.failures, ip)
+		}
+	}
+	for ip, until := range f.locked {
+		if !now.Before(until) {
+			delete(f.locked, ip)
+		}
+	}
+}
+
+func (c *Config) loginGuardOrDefault() (int, time.Duration, time.Duration) {
+	max, window, lockout := c.LoginMaxFailures, c.LoginFailureWindow, c.LoginLockout
+	if max <= 0 {
+		max = 10
+	}
+	if window <= 0 {
+		window = 600
+	}
+	if lockout <= 0 {
+		lockout = 900
+	}
+	return max, time.Duration(window) * time.Second, time.Duration(lockout) * time.Second
+}
+
+func (s *ApiServer) setupRateLimits() {
+	limits := s.cfg.RateLimits
+	if limits == nil {
+		limits = defaultRateLimits
+	}
+
+	s.limiters = make(map[string]routeLimiter)
+	for _, l := range limits {
+		var rl routeLimiter
+		if l.PerIP != nil {
+			rl.perIP = newLimiter(*l.PerIP)
+		}
+		if l.PerToken != nil {
+			rl.perToken = newLimiter(*l.PerToken)
+		}
+		s.limiters[l.Route] = rl
+	}
+
+	s.lookups = newFailedLookups(s.cfg.loginGuardOrDefault())
+}
+
+// clientIP is the address of the peer or, behind trusted proxies, the
+// X-Forwarded-For entry added by the outermost of them. Entries to its left
+// come from the client and may be forged.
+func (s *ApiServer) clientIP(r *http.Request) string {
+	if s.cfg.TrustProxyHeaders {
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		if len(hops) > 0 {
+			i := max(len(hops)-s.cfg.TrustedProxyHopsOrDefault(), 0)
+			return strings.TrimSpace(hops[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// credential returns a hash of the credential the request carries, so that
+// buckets do not keep session IDs in memory in the clear.
+func credential(r *http.Request) string {
+	sess := mux.Vars(r)["sessionId"]
+	if sess == "" {
+		sess = r.URL.Query().Get("sessionId")
+	}
+	if sess == "" {
+		sess = r.URL.Query().Get("token")
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		sess = strings.TrimPrefix(h, "Bearer ")
+	}
+	if c, err := r.Cookie(sessionCookie); sess == "" && err == nil {
+		sess = c.Value
+	}
+	if sess == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(sess))
+	return hex.EncodeToString(sum[:])
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, r, newApiError(http.StatusTooManyRequests, ErrRateLimited, "too many requests, retry in "+wait.Round(time.Second).String()))
+}
+
+// rateLimitMiddleware rejects clients that are locked out after guessing
+// credentials, then applies the limits configured for the matched route.
+func (s *ApiServer) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		ip := s.clientIP(r)
+		if wait := s.lookups.lockedFor(ip, now); wait > 0 {
+			tooManyRequests(w, r, wait)
+			return
+		}
+
+		route := ""
+		if cur := mux.CurrentRoute(r); cur != nil {
+			route, _ = cur.GetPathTemplate()
+		}
+		rl, ok := s.limiters[route]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if rl.perIP != nil {
+			if ok, wait := rl.perIP.allow(ip, now); !ok {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+		if cred := credential(r); rl.perToken != nil && cred != "" {
+			if ok, wait := rl.perToken.allow(cred, now); !ok {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookupSession resolves a sessionId to its user like
+// Config.SelectUserFromSessionId, counting misses against the client so
+// that sessions cannot be guessed.
+func (s *ApiServer) lookupSession(r *http.Request, sess string) *User {
+	user := s.cfg.SelectUserFromSessionId(sess)
+	if user == nil {
+		s.lookups.record(s.clientIP(r), time.Now())
+	}
+	return user
+}
@@ -0,0 +1,176 @@
+package xfbbroker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 6, Burst: 2})
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d of the burst refused", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 10*time.Second {
+		t.Errorf("after the burst: %v, wait %v", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other key limited")
+	}
+	if ok, _ := l.allow("a", now.Add(5*time.Second)); ok {
+		t.Error("allowed before a token refilled")
+	}
+	if ok, _ := l.allow("a", now.Add(15*time.Second)); !ok {
+		t.Error("refilled token refused")
+	}
+
+	// buckets are forgotten once full again, after 20s for this limit
+	l.lock.Lock()
+	l.sweep(now.Add(21 * time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets left after sweeping, want 1", len(l.buckets))
+	}
+	l.sweep(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Errorf("%d buckets left", len(l.buckets))
+	}
+	l.lock.Unlock()
+}
+
+func TestLimiterTimer(t *testing.T) {
+	l := newLimiter(RateLimit{Rate: 60, Burst: 1})
+	l.allow("a", time.Now().Add(-time.Hour))
+	l.lock.Lock()
+	armed := l.timer != nil
+	l.lock.Unlock()
+	if !armed {
+		t.Fatal("no sweep scheduled")
+	}
+	l.timer.Stop()
+	l.tick()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.buckets) != 0 || l.timer != nil {
+		t.Errorf("after tick: %d buckets, timer %v", len(l.buckets), l.timer)
+	}
+}
+
+func TestFailedLookups(t *testing.T) {
+	f := newFailedLookups(3, time.Minute, 10*time.Minute)
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	defer func() {
+		f.lock.Lock()
+		f.timer.Stop()
+		f.lock.Unlock()
+	}()
+
+	f.record("1", now)
+	f.record("1", now.Add(30*time.Second))
+	// the first failure left the window
+	f.record("1", now.Add(61*time.Second))
+	if d := f.lockedFor("1", now.Add(61*time.Second)); d != 0 {
+		t.Fatalf("locked after failures spread over the window: %v", d)
+	}
+	f.record("1", now.Add(62*time.Second))
+	if d := f.lockedFor("1", now.Add(62*time.Second)); d != 10*time.Minute {
+		t.Fatalf("locked for %v", d)
+	}
+	if d := f.lockedFor("1", now.Add(62*time.Second+10*time.Minute)); d != 0 {
+		t.Errorf("still locked after the lockout: %v", d)
+	}
+
+	f.record("2", now)
+	f.record("3", now.Add(time.Minute))
+	f.lock.Lock()
+	f.locked["4"] = now.Add(time.Minute)
+	f.sweep(now.Add(90 * time.Second))
+	_, has2 := f.failures["2"]
+	_, has3 := f.failures["3"]
+	_, has4 := f.locked["4"]
+	f.lock.Unlock()
+	if has2 || !has3 || has4 {
+		t.Errorf("after sweep: 2=%v 3=%v 4=%v", has2, has3, has4)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	c := newTestConfig(t, map[string]any{
+		"RateLimits":       []RouteRateLimit{{Route: "/api/v2/user", PerToken: &RateLimit{Rate: 1, Burst: 2}}},
+		"LoginMaxFailures": 3,
+	}, grantUsers()...)
+	h := CreateApiServer(c)
+
+	for i := 0; i < 2; i++ {
+		if w := serve(t, h, "GET", "/api/v2/user", "sa", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d", i, w.Code)
+		}
+	}
+	w := serve(t, h, "GET", "/api/v2/user", "sa", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("over the limit: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve(t, h, "GET", "/api/v2/user", "sb", nil); w.Code != http.StatusOK {
+		t.Errorf("other session: %d", w.Code)
+	}
+
+	// guessing sessions locks the client out, even with a valid one
+	for i := 0; i < 3; i++ {
+		serve(t, h, "GET", "/api/v2/cards", "guess", nil)
+	}
+	if w := serve(t, h, "GET", "/api/v2/budgets", "sb", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("after guessing: %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		trust bool
+		hops  int
+		xff   []string
+		want  string
+	}{
+		{false, 0, []string{"1.1.1.1"}, "192.0.2.1"},
+		{true, 0, nil, "192.0.2.1"},
+		{true, 0, []string{"203.0.113.7"}, "203.0.113.7"},
+		// a forged entry sent by the client is left of what the proxy adds
+		{true, 0, []string{"1.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{true, 0, []string{"1.1.1.1", "203.0.113.7"}, "203.0.113.7"},
+		{true, 2, []string{"1.1.1.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{true, 3, []string{"203.0.113.7"}, "203.0.113.7"},
+	} {
+		c := newTestConfig(t, map[string]any{"TrustProxyHeaders": tc.trust, "TrustedProxyHops": tc.hops})
+		s := &ApiServer{cfg: c}
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, v := range tc.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := s.clientIP(r); got != tc.want {
+			t.Errorf("trust=%v hops=%d %q: %s, want %s", tc.trust, tc.hops, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestForgedForwardedForIsLimited(t *testing.T) {
+	c := newTestConfig(t, map[string]any{
+		"TrustProxyHeaders": true,
+		"RateLimits":        []RouteRateLimit{{Route: "/api/v2/user", PerIP: &RateLimit{Rate: 1, Burst: 1}}},
+	}, grantUsers()...)
+	h := CreateApiServer(c)
+
+	for i, forged := range []string{"1.1.1.1", "2.2.2.2"} {
+		r := httptest.NewRequest("GET", "/api/v2/user", nil)
+		r.Header.Set("Authorization", "Bearer sa")
+		r.Header.Set("X-Forwarded-For", forged+", 203.0.113.7")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if want := []int{http.StatusOK, http.StatusTooManyRequests}[i]; w.Code != want {
+			t.Errorf("request claiming %s: %d, want %d", forged, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package xfbbroker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// ComponentStatus is the result of one readiness check. Detail is only
+// logged, /readyz is public.
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Detail string `json:"-"`
+}
+
+type ReadinessResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// CheckWritable verifies a file can be created next to the config file, so
+// that Save will not fail.
+func (c *Config) CheckWritable() error {
+	f, err := os.CreateTemp(filepath.Dir(c.db.Path), ".xfbbroker-ready-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (c *Config) ReadyPollIntervalsOrDefault() int {
+	if c.ReadyPollIntervals <= 0 {
+		return 3
+	}
+	return c.ReadyPollIntervals
+}
+
+// pollInterval is the longest u may wait between two polls around now: the
+// transaction interval in effect now and at its last successful poll, the
+// balance interval, or ProbeInterval while suspended.
+func (c *Config) pollInterval(u *User, now time.Time) time.Duration {
+	d := max(c.TransInterval(u, now), c.BalanceInterval(u))
+	if !u.LastSuccessAt.IsZero() {
+		d = max(d, c.TransInterval(u, u.LastSuccessAt))
+	}
+	if u.State() == HealthSuspended {
+		d = max(d, c.ProbeIntervalDuration())
+	}
+	return d
+}
+
+// checkPolls passes if some enabled user was polled successfully within
+// ReadyPollIntervals of the longest poll interval of the users, or if the
+// process is still too young to tell.
+func (s *ApiServer) checkPolls(now time.Time) ComponentStatus {
+	var last time.Time
+	var longest time.Duration
+	polled := 0
+	for _, k := range s.cfg.UserIds() {
+		u, _ := s.cfg.GetUser(k)
+		// expired sessions wait for their users, restarting does not help
+		if !u.Enabled || u.State() == HealthNeedsReauth {
+			continue
+		}
+		polled++
+		if u.LastSuccessAt.After(last) {
+			last = u.LastSuccessAt
+		}
+		longest = max(longest, s.cfg.pollInterval(&u, now))
+	}
+
+	window := time.Duration(s.cfg.ReadyPollIntervalsOrDefault()) * longest
+	if now.Sub(s.started) < window {
+		return ComponentStatus{Status: "ok", Detail: "starting"}
+	}
+	if polled == 0 {
+		return ComponentStatus{Status: "ok", Detail: "no users to poll"}
+	}
+	if now.Sub(last) > window {
+		if last.IsZero() {
+			return ComponentStatus{Status: "fail", Detail: "no successful poll yet"}
+		}
+		return ComponentStatus{Status: "fail", Detail: fmt.Sprintf("last successful poll at %s", last.Format(time.RFC3339))}
+	}
+	return ComponentStatus{Status: "ok", Detail: fmt.Sprintf("last successful poll at %s", last.Format(time.RFC3339))}
+}
+
+// upstreamProbeInterval is how long the result of the upstream check is
+// reused, so that frequent probes do not hammer xiaofubao.
+const upstreamProbeInterval = time.Minute
+
+type upstreamProbe struct {
+	lock sync.Mutex
+	at   time.Time
+	err  error
+}
+
+// check asks the xiaofubao auth host for a redirect, at most once per
+// upstreamProbeInterval.
+func (p *upstreamProbe) check(ctx context.Context, c *Config, now time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.at.IsZero() && now.Sub(p.at) < upstreamProbeInterval {
+		return p.err
+	}
+	school, ok := c.School("")
+	if !ok {
+		// any school will do, they share the auth host
+		school = School{School: xfb.DefaultSchool, AuthCallback: c.AuthCallback}
+	}
+	_, p.err = xfb.GetRedirectLocation(ctx, authUrl(school, ""))
+	p.at = now
+	return p.err
+}
+
+func (s *ApiServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (s *ApiServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res := ReadinessResponse{
+		Status:     "ok",
+		Components: map[string]ComponentStatus{},
+	}
+
+	if err := s.cfg.Validate(); err != nil {
+		res.Components["config"] = ComponentStatus{Status: "fail", Detail: err.Error()}
+	} else {
+		res.Components["config"] = ComponentStatus{Status: "ok"}
+	}
+
+	if err := s.cfg.CheckWritable(); err != nil {
+		res.Components["store"] = ComponentStatus{Status: "fail", Detail: err.Error()}
+	} else {
+		res.Components["store"] = ComponentStatus{Status: "ok"}
+	}
+
+	res.Components["poll"] = s.checkPolls(time.Now())
+
+	if s.cfg.ReadyProbeUpstream {
+		if err := s.upstream.check(r.Context(), s.cfg, time.Now()); err != nil {
+			res.Components["upstream"] = ComponentStatus{Status: "fail", Detail: err.Error()}
+		} else {
+			res.Components["upstream"] = ComponentStatus{Status: "ok"}
+		}
+	}
+
+	code := http.StatusOK
+	for name, c := range res.Components {
+		if c.Status != "ok" {
+			res.Status = "fail"
+			code = http.StatusServiceUnavailable
+			slog.WarnContext(r.Context(), "not ready", "component", name, "detail", c.Detail)
+		}
+	}
+
+	resBuf, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(resBuf)
+}
+
+// ProbeReady asks the server run with c for /readyz on the loopback
+// interface, over TLS if it serves TLS. It is meant for container
+// healthchecks, which cannot know the scheme and port.
+func (c *Config) ProbeReady(ctx context.Context) error {
+	host, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("ListenAddr: %w", err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	scheme := "http"
+	// the certificate names the public host, not the address dialed
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if c.ListenTLS {
+		scheme = "https"
+		if len(c.ACME.Domains) > 0 {
+			// autocert picks the certificate by SNI
+			tlsConfig.ServerName = c.ACME.Domains[0]
+		}
+	}
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+net.JoinHostPort(host, port)+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/readyz: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package xfbbroker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestReadyzHidesDetails(t *testing.T) {
+	// no ListenAddr, so Validate fails
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+
+	w := serve(t, h, "GET", "/readyz", "", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz: %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"fail"`) || strings.Contains(body, "ListenAddr") || strings.Contains(body, "detail") {
+		t.Errorf("readyz body: %s", body)
+	}
+}
+
+func TestCheckPolls(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	users := grantUsers()
+	c := newTestConfig(t, map[string]any{"CheckTransInterval": 60}, users...)
+	s := &ApiServer{cfg: c, started: now.Add(-time.Hour)}
+
+	if st := s.checkPolls(now); st.Status != "fail" {
+		t.Errorf("never polled: %+v", st)
+	}
+	c.UpdateUser("b", func(u *User) { u.RecordSuccess(now.Add(-time.Minute)) })
+	if st := s.checkPolls(now); st.Status != "ok" {
+		t.Errorf("polled a minute ago: %+v", st)
+	}
+	if st := s.checkPolls(now.Add(time.Hour)); st.Status != "fail" {
+		t.Errorf("polled an hour ago: %+v", st)
+	}
+
+	// users waiting for a new authorization do not count
+	for _, k := range []string{"a", "b"} {
+		c.UpdateUser(k, func(u *User) { u.Health = HealthNeedsReauth })
+	}
+	if st := s.checkPolls(now.Add(time.Hour)); st.Status != "ok" {
+		t.Errorf("all sessions expired: %+v", st)
+	}
+
+	young := &ApiServer{cfg: c, started: now.Add(-time.Minute)}
+	c.UpdateUser("a", func(u *User) { u.Health = HealthDegraded })
+	if st := young.checkPolls(now); st.Status != "ok" {
+		t.Errorf("just started: %+v", st)
+	}
+}
+
+func TestCheckPollsLongestInterval(t *testing.T) {
+	now := time.Date(2024, 5, 6, 7, 10, 0, 0, xfb.Location)
+	users := grantUsers()[:1]
+	users[0].TransSchedule = []ScheduleRule{{Start: "22:00", End: "07:00", Interval: 3600}}
+	users[0].LastSuccessAt = now.Add(-20 * time.Minute)
+	c := newTestConfig(t, map[string]any{"CheckTransInterval": 60, "ProbeInterval": 7200}, users...)
+	s := &ApiServer{cfg: c, started: now.Add(-24 * time.Hour)}
+
+	// the last poll was at night, the next one is due an hour later
+	if st := s.checkPolls(now); st.Status != "ok" {
+		t.Errorf("polled under the night schedule: %+v", st)
+	}
+	if st := s.checkPolls(now.Add(5 * time.Hour)); st.Status != "fail" {
+		t.Errorf("three night intervals later: %+v", st)
+	}
+
+	c.UpdateUser("a", func(u *User) {
+		u.TransSchedule = nil
+		u.CheckBalanceInterval = 3600
+	})
+	if st := s.checkPolls(now.Add(time.Hour)); st.Status != "ok" {
+		t.Errorf("within the balance interval: %+v", st)
+	}
+
+	c.UpdateUser("a", func(u *User) {
+		u.CheckBalanceInterval = 0
+		u.Health = HealthSuspended
+	})
+	if st := s.checkPolls(now.Add(3 * time.Hour)); st.Status != "ok" {
+		t.Errorf("suspended, probed every ProbeInterval: %+v", st)
+	}
+}
+
+func TestUpstreamProbeIsCached(t *testing.T) {
+	c := newTestConfig(t, nil)
+	var p upstreamProbe
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	now := time.Now()
+	first := p.check(ctx, c, now)
+	if first == nil {
+		t.Fatal("probe with a cancelled context passed")
+	}
+	if err := p.check(ctx, c, now.Add(upstreamProbeInterval/2)); err != first {
+		t.Errorf("probe repeated within the interval: %v", err)
+	}
+	if err := p.check(ctx, c, now.Add(upstreamProbeInterval)); err == first {
+		t.Error("probe not repeated after the interval")
+	}
+}
+
+func TestProbeReady(t *testing.T) {
+	ready := true
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" || !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	plain := httptest.NewServer(h)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(h)
+	defer secure.Close()
+
+	for _, tc := range []struct {
+		srv *httptest.Server
+		tls bool
+	}{{plain, false}, {secure, true}} {
+		// listening on all interfaces is probed on loopback
+		addr := strings.Replace(tc.srv.Listener.Addr().String(), "127.0.0.1", "0.0.0.0", 1)
+		c := newTestConfig(t, map[string]any{"ListenAddr": addr, "ListenTLS": tc.tls})
+		ready = true
+		if err := c.ProbeReady(context.Background()); err != nil {
+			t.Errorf("tls=%v: %v", tc.tls, err)
+		}
+		ready = false
+		if err := c.ProbeReady(context.Background()); err == nil {
+			t.Errorf("tls=%v: not ready passed", tc.tls)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package xfbbroker
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strconv"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// SetDryRun makes Recharge stop before any upstream request.
+func (c *Config) SetDryRun(v bool) {
+	c.dryRun = v
+}
+
+func (c *Config) DryRun() bool {
+	return c.dryRun
+}
+
+// Recharge adds amount yuan to the main balance of u with the signed
+// payment, returning the upstream transaction number. In dry-run mode
+// nothing is sent upstream, not even the order, and the transaction number
+// is empty.
+func (c *Config) Recharge(ctx context.Context, u *User, amount float64) (string, error) {
+	if c.dryRun {
+		slog.InfoContext(ctx, "dry-run: recharge skipped", "name", u.Name, "amount", amount)
+		return "", nil
+	}
+	payUrl, err := xfb.RechargeOnCard(ctx, c.SchoolOf(u), strconv.FormatFloat(amount, 'f', 2, 64), u.OpenId, u.SessionId, u.YmUserId)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to recharge", "err", err)
+		return "", err
+	}
+	url, _ := url.Parse(payUrl)
+	tranNo := url.Query().Get("tran_no")
+
+	_, err = xfb.SignPayCheck(ctx, tranNo)
+	if err != nil {
+		slog.ErrorContext(ctx, "signpay check failed", "err", err)
+		return "", err
+	}
+	err = xfb.PayChoose(ctx, tranNo)
+	if err != nil {
+		slog.ErrorContext(ctx, "choose signpay failed", "err", err)
+		return "", err
+	}
+	err = xfb.DoPay(ctx, tranNo)
+	if err != nil {
+		slog.ErrorContext(ctx, "unable to pay", "err", err)
+		return "", err
+	}
+	RechargesTotal.Inc()
+	RechargeAmountTotal.Add(amount)
+	slog.InfoContext(ctx, "recharged", "name", u.Name, "amount", amount, "tranNo", tranNo)
+	c.Emit(u.YmUserId, EventRechargeCompleted, map[string]any{"tranNo": tranNo, "amount": amount})
+	return tranNo, nil
+}
@@ -0,0 +1,95 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestRechargeDryRun(t *testing.T) {
+	c := newTestConfig(t, nil, botUsers()...)
+	u, _ := c.GetUser("a")
+	// any upstream request fails at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.Recharge(ctx, &u, 10); !errors.Is(err, xfb.ErrUpstream) {
+		t.Fatalf("without dry-run: %v", err)
+	}
+	c.SetDryRun(true)
+	tranNo, err := c.Recharge(ctx, &u, 10)
+	if err != nil || tranNo != "" {
+		t.Errorf("dry-run reached upstream: %q, %v", tranNo, err)
+	}
+
+	c.botCommand(ctx, telegramChat, "/recharge 10")
+	if r := c.botCommand(ctx, telegramChat, "/confirm"); !strings.Contains(r.Text, "未充值") {
+		t.Errorf("dry-run /confirm: %q", r.Text)
+	}
+}
+
+func TestSaveDryRun(t *testing.T) {
+	c := newTestConfig(t, nil, botUsers()...)
+	before, _ := os.ReadFile(c.db.Path)
+	c.SetDryRun(true)
+	c.UpdateUser("a", func(u *User) { u.LastSerial = 987654 })
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(c.db.Path); !bytes.Equal(before, after) {
+		t.Error("dry run wrote the config")
+	}
+	c.SetDryRun(false)
+	c.Save()
+	if after, _ := os.ReadFile(c.db.Path); !strings.Contains(string(after), "987654") {
+		t.Error("config not saved")
+	}
+}
+
+func TestSharedRechargeChargesAfterRecharging(t *testing.T) {
+	users := grantUsers()
+	users[0].Grants = map[string]Grant{"b": {Rights: []Right{RightRecharge}, DailyLimit: 20}}
+	// no rate limits, several recharges follow
+	c := newTestConfig(t, map[string]any{"RateLimits": []RouteRateLimit{}}, users...)
+	h := CreateApiServer(c)
+	spent := func() float64 {
+		u, _ := c.GetUser("a")
+		return u.Grants["b"].SpentOn(time.Now())
+	}
+	recharge := func(amount float64) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(RechargeRequest{Amount: amount})
+		// xiaofubao cannot be reached
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("POST", "/api/v2/shared/a/recharge", bytes.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer sb")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := recharge(15); w.Code != http.StatusBadGateway || spent() != 0 {
+		t.Errorf("failed recharge: %d, spent %v", w.Code, spent())
+	}
+	if w := recharge(25); w.Code != http.StatusForbidden {
+		t.Errorf("over the limit: %d", w.Code)
+	}
+
+	c.SetDryRun(true)
+	w := recharge(15)
+	if v := decodeData[RechargeView](t, w); w.Code != http.StatusOK || !v.DryRun || v.TranNo != "" {
+		t.Errorf("dry run: %d %s", w.Code, w.Body)
+	}
+	if spent() != 0 {
+		t.Errorf("dry run spent %v of the grant", spent())
+	}
+}
@@ -0,0 +1,93 @@
+package xfbbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// ErrorCode is the machine-readable reason carried in an error envelope.
+type ErrorCode string
+
+const (
+	ErrBadRequest     ErrorCode = "bad_request"
+	ErrUnauthorized   ErrorCode = "unauthorized"
+	ErrForbidden      ErrorCode = "forbidden"
+	ErrNotFound       ErrorCode = "not_found"
+	ErrSessionExpired ErrorCode = "session_expired"
+	ErrUserDisabled   ErrorCode = "user_disabled"
+	ErrLimitExceeded  ErrorCode = "limit_exceeded"
+	ErrUpstream       ErrorCode = "upstream_error"
+	ErrRateLimited    ErrorCode = "rate_limited"
+	ErrInternal       ErrorCode = "internal_error"
+)
+
+// Envelope wraps every /api/v2 response.
+type Envelope struct {
+	Success   bool      `json:"success"`
+	Data      any       `json:"data,omitempty"`
+	Error     *ApiError `json:"error,omitempty"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+type ApiError struct {
+	Status  int       `json:"-"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ApiError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+func newApiError(status int, code ErrorCode, msg string) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: msg}
+}
+
+// asApiError maps err to the error returned to clients. Errors from
+// xiaofubao become session_expired or upstream_error, anything else that
+// is not already an *ApiError is an internal error.
+func asApiError(err error) *ApiError {
+	var e *ApiError
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, xfb.ErrSessionExpired):
+		return newApiError(http.StatusUnauthorized, ErrSessionExpired, "xiaofubao session expired, authorize again")
+	case errors.Is(err, xfb.ErrUpstream):
+		return newApiError(http.StatusBadGateway, ErrUpstream, err.Error())
+	default:
+		return newApiError(http.StatusInternalServerError, ErrInternal, err.Error())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	resBuf, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resBuf)
+}
+
+func writeData(w http.ResponseWriter, r *http.Request, status int, data any) {
+	writeJSON(w, status, Envelope{
+		Success:   true,
+		Data:      data,
+		RequestId: RequestId(r.Context()),
+	})
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := asApiError(err)
+	writeJSON(w, e.Status, Envelope{
+		Success:   false,
+		Error:     e,
+		RequestId: RequestId(r.Context()),
+	})
+}
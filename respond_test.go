@@ -0,0 +1,104 @@
+package xfbbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestAsApiError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{newApiError(http.StatusForbidden, ErrForbidden, "no"), http.StatusForbidden, ErrForbidden},
+		{fmt.Errorf("wrapped: %w", newApiError(http.StatusNotFound, ErrNotFound, "gone")), http.StatusNotFound, ErrNotFound},
+		{fmt.Errorf("%w: %w", xfb.ErrUpstream, xfb.ErrSessionExpired), http.StatusUnauthorized, ErrSessionExpired},
+		{fmt.Errorf("%w: timeout", xfb.ErrUpstream), http.StatusBadGateway, ErrUpstream},
+		{errors.New("bug"), http.StatusInternalServerError, ErrInternal},
+	} {
+		if e := asApiError(tc.err); e.Status != tc.status || e.Code != tc.code {
+			t.Errorf("%v: %d %s", tc.err, e.Status, e.Code)
+		}
+	}
+}
+
+func TestV2Envelope(t *testing.T) {
+	h := CreateApiServer(newTestConfig(t, nil, grantUsers()...))
+	decode := func(w *httptest.ResponseRecorder) (env Envelope) {
+		t.Helper()
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type %q", ct)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+			t.Fatalf("%d %s", w.Code, w.Body)
+		}
+		if env.RequestId == "" || env.RequestId != w.Header().Get("X-Request-ID") {
+			t.Errorf("requestId %q, header %q", env.RequestId, w.Header().Get("X-Request-ID"))
+		}
+		return env
+	}
+
+	w := serve(t, h, "GET", "/api/v2/user", "sa", nil)
+	if env := decode(w); w.Code != http.StatusOK || !env.Success || env.Data == nil || env.Error != nil {
+		t.Errorf("success: %d %s", w.Code, w.Body)
+	}
+	w = serve(t, h, "GET", "/api/v2/user", "", nil)
+	if env := decode(w); w.Code != http.StatusUnauthorized || env.Success || env.Error.Code != ErrUnauthorized {
+		t.Errorf("no session: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), `"data"`) {
+		t.Errorf("error with data: %s", w.Body)
+	}
+}
+
+// Every /api route is documented in openapi.json with its methods.
+func TestOpenapiCoversRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	r := CreateApiServer(newTestConfig(t, nil))
+	documented := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, "/api/") || tpl == "/api/openapi.json" {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, m := range methods {
+			if m == http.MethodOptions {
+				continue
+			}
+			if _, ok := spec.Paths[tpl][strings.ToLower(m)]; !ok {
+				t.Errorf("%s %s is not in openapi.json", m, tpl)
+			}
+			documented[tpl] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path := range spec.Paths {
+		if !documented[path] {
+			t.Errorf("%s in openapi.json is not served", path)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("/api/openapi.json: %d", w.Code)
+	}
+}
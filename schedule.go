@@ -0,0 +1,109 @@
+package xfbbroker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// ScheduleRule sets the transaction polling interval during a time-of-day
+// window, e.g. every 20s from 11:00 to 13:00. Windows may wrap past
+// midnight (22:00-07:00). Times are in xfb.Location.
+type ScheduleRule struct {
+	Start    string
+	End      string
+	Interval int
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (r *ScheduleRule) validate() error {
+	if _, err := parseClock(r.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(r.End); err != nil {
+		return err
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("rule %s-%s: Interval must be greater than 0", r.Start, r.End)
+	}
+	return nil
+}
+
+// Contains reports whether t falls in [Start, End).
+func (r *ScheduleRule) Contains(t time.Time) bool {
+	start, err := parseClock(r.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(r.End)
+	if err != nil {
+		return false
+	}
+
+	t = t.In(xfb.Location)
+	m := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return start <= m && m < end
+	}
+	return m >= start || m < end
+}
+
+func matchSchedule(rules []ScheduleRule, t time.Time) (time.Duration, bool) {
+	for i := range rules {
+		if rules[i].Contains(t) {
+			return time.Duration(rules[i].Interval) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// RecordDeal adds the hour of t to the history TransInterval learns busy
+// hours from.
+func (u *User) RecordDeal(t *xfb.Trans) {
+	dt, err := t.DealTime()
+	if err != nil {
+		return
+	}
+	u.DealHours[dt.Hour()]++
+}
+
+// busyHour reports whether the user historically spends at least twice as
+// often during the hour of t as on average, based on at least 24 deals.
+func (u *User) busyHour(t time.Time) bool {
+	total := 0
+	for _, n := range u.DealHours {
+		total += n
+	}
+	if total < 24 {
+		return false
+	}
+	n := u.DealHours[t.In(xfb.Location).Hour()]
+	return n*24 >= total*2
+}
+
+// TransInterval returns how often the transactions of u are checked at t.
+// The first match wins: the user's schedule, the global schedule, a learned
+// busy hour, the user's fixed interval, the global interval.
+func (c *Config) TransInterval(u *User, t time.Time) time.Duration {
+	if d, ok := matchSchedule(u.TransSchedule, t); ok {
+		return d
+	}
+	if d, ok := matchSchedule(c.TransSchedule, t); ok {
+		return d
+	}
+	if c.LearnedTransInterval > 0 && u.busyHour(t) {
+		return time.Duration(c.LearnedTransInterval) * time.Second
+	}
+	if u.CheckTransInterval > 0 {
+		return time.Duration(u.CheckTransInterval) * time.Second
+	}
+	return time.Duration(c.CheckTransInterval) * time.Second
+}
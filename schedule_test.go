@@ -0,0 +1,91 @@
+package xfbbroker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func at(clock string) time.Time {
+	t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-05-06 "+clock, xfb.Location)
+	return t
+}
+
+func TestScheduleRuleContains(t *testing.T) {
+	lunch := ScheduleRule{Start: "11:00", End: "13:00", Interval: 20}
+	night := ScheduleRule{Start: "22:00", End: "07:00", Interval: 600}
+	for _, tc := range []struct {
+		r     ScheduleRule
+		clock string
+		want  bool
+	}{
+		{lunch, "10:59", false},
+		{lunch, "11:00", true},
+		{lunch, "12:59", true},
+		{lunch, "13:00", false},
+		{night, "23:30", true},
+		{night, "03:00", true},
+		{night, "07:00", false},
+		{night, "12:00", false},
+	} {
+		if got := tc.r.Contains(at(tc.clock)); got != tc.want {
+			t.Errorf("%s-%s contains %s = %v", tc.r.Start, tc.r.End, tc.clock, got)
+		}
+	}
+	// 03:30 UTC is 11:30 in xfb.Location
+	if !lunch.Contains(time.Date(2024, 5, 6, 3, 30, 0, 0, time.UTC)) {
+		t.Error("times are not compared in xfb.Location")
+	}
+	for _, bad := range []ScheduleRule{{Start: "11", End: "13:00", Interval: 1}, {Start: "11:00", End: "25:00", Interval: 1}, {Start: "11:00", End: "13:00"}} {
+		if bad.validate() == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestTransInterval(t *testing.T) {
+	c := newTestConfig(t, map[string]any{
+		"CheckTransInterval":   300,
+		"LearnedTransInterval": 30,
+		"TransSchedule":        []ScheduleRule{{Start: "11:00", End: "13:00", Interval: 20}},
+	})
+	u := &User{
+		CheckTransInterval: 120,
+		TransSchedule:      []ScheduleRule{{Start: "12:00", End: "12:30", Interval: 10}},
+	}
+	// 24 deals, 6 of them between 18:00 and 19:00 and one in every other
+	// hour until then
+	for h := 0; h < 18; h++ {
+		u.DealHours[h] = 1
+	}
+	u.DealHours[18] = 5
+	u.RecordDeal(&xfb.Trans{Dealtime: "2024-05-01 18:10:00"})
+	if u.DealHours[18] != 6 {
+		t.Fatalf("RecordDeal: %v", u.DealHours)
+	}
+
+	for _, tc := range []struct {
+		clock string
+		want  time.Duration
+	}{
+		{"12:10", 10 * time.Second},
+		{"11:10", 20 * time.Second},
+		{"18:30", 30 * time.Second},
+		{"08:30", 120 * time.Second},
+		{"15:00", 120 * time.Second},
+	} {
+		if d := c.TransInterval(u, at(tc.clock)); d != tc.want {
+			t.Errorf("%s: %v, want %v", tc.clock, d, tc.want)
+		}
+	}
+	u.CheckTransInterval = 0
+	if d := c.TransInterval(u, at("15:00")); d != 300*time.Second {
+		t.Errorf("global interval: %v", d)
+	}
+	// 08:00 is busy too, but too few deals tell nothing
+	u.DealHours = [24]int{8: 20}
+	if d := c.TransInterval(u, at("08:30")); d != 300*time.Second {
+		t.Errorf("learned from 20 deals: %v", d)
+	}
+}
@@ -0,0 +1,75 @@
+package xfbbroker
+
+import (
+	"fmt"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// School is a university served by the broker. AuthCallback is where
+// xiaofubao sends users of this school after authorization; it should
+// carry ?school=<Code> so that handleAuth can tell schools apart.
+type School struct {
+	Name string
+	xfb.School
+	AuthCallback string
+}
+
+// School returns the school with the given code. An empty code means the
+// only configured school; without any configured schools, an empty code
+// or that of xfb.DefaultSchool gives xfb.DefaultSchool with the global
+// AuthCallback. With several schools the code must be given.
+func (c *Config) School(code string) (School, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if code == "" && len(c.Schools) == 1 {
+		for k := range c.Schools {
+			code = k
+		}
+	}
+	if s, ok := c.Schools[code]; ok {
+		if s.Platform == "" {
+			s.Platform = xfb.DefaultSchool.Platform
+		}
+		if s.AuthCallback == "" {
+			s.AuthCallback = c.AuthCallback
+		}
+		return s, true
+	}
+	if len(c.Schools) == 0 && (code == "" || code == xfb.DefaultSchool.Code) {
+		return School{School: xfb.DefaultSchool, AuthCallback: c.AuthCallback}, true
+	}
+	return School{}, false
+}
+
+// SchoolOf returns the parameters for xfb calls made on behalf of u.
+func (c *Config) SchoolOf(u *User) xfb.School {
+	s, ok := c.School(u.SchoolCode)
+	if !ok {
+		// keep serving users of a school removed from the config
+		return xfb.School{Code: u.SchoolCode, SubAppId: xfb.DefaultSchool.SubAppId, Platform: xfb.DefaultSchool.Platform}
+	}
+	return s.School
+}
+
+func (c *Config) validateSchools() []error {
+	var errs []error
+	for k, s := range c.Schools {
+		if k != s.Code {
+			errs = append(errs, fmt.Errorf("school %s: key does not match Code %q", k, s.Code))
+		}
+		if s.SubAppId == "" {
+			errs = append(errs, fmt.Errorf("school %s: SubAppId is required", k))
+		}
+	}
+	for k, u := range c.Users {
+		if _, ok := c.Schools[u.SchoolCode]; len(c.Schools) > 0 && u.SchoolCode != "" && !ok {
+			errs = append(errs, fmt.Errorf("user %s: unknown SchoolCode %q", k, u.SchoolCode))
+		}
+		if len(c.Schools) > 1 && u.SchoolCode == "" {
+			errs = append(errs, fmt.Errorf("user %s: SchoolCode is required with several schools", k))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,93 @@
+package xfbbroker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func testSchools(codes ...string) map[string]School {
+	m := make(map[string]School)
+	for _, code := range codes {
+		m[code] = School{Name: code, School: xfb.School{Code: code, SubAppId: "app" + code}}
+	}
+	return m
+}
+
+func TestSchool(t *testing.T) {
+	for _, tc := range []struct {
+		schools []string
+		code    string
+		want    string
+		ok      bool
+	}{
+		{nil, "", xfb.DefaultSchool.Code, true},
+		{nil, xfb.DefaultSchool.Code, xfb.DefaultSchool.Code, true},
+		{nil, "1", "", false},
+		{[]string{"1"}, "", "1", true},
+		{[]string{"1"}, "1", "1", true},
+		{[]string{"1"}, xfb.DefaultSchool.Code, "", false},
+		{[]string{"1", "2"}, "", "", false},
+		{[]string{"1", "2"}, "2", "2", true},
+	} {
+		c := newTestConfig(t, map[string]any{"Schools": testSchools(tc.schools...)})
+		s, ok := c.School(tc.code)
+		if ok != tc.ok || s.Code != tc.want {
+			t.Errorf("schools %v, School(%q) = %q, %v", tc.schools, tc.code, s.Code, ok)
+		}
+		if ok && s.Platform == "" {
+			t.Errorf("schools %v, School(%q) has no Platform", tc.schools, tc.code)
+		}
+	}
+}
+
+func TestValidateSchoolCodes(t *testing.T) {
+	users := []User{
+		{Name: "A", YmUserId: "a", SchoolCode: "1"},
+		{Name: "B", YmUserId: "b"},
+		{Name: "C", YmUserId: "c", SchoolCode: "3"},
+	}
+	err := newTestConfig(t, map[string]any{"Schools": testSchools("1", "2")}, users...).Validate()
+	if err == nil || !strings.Contains(err.Error(), "user b: SchoolCode is required") || !strings.Contains(err.Error(), `user c: unknown SchoolCode "3"`) ||
+		strings.Contains(err.Error(), "user a:") {
+		t.Errorf("several schools: %v", err)
+	}
+	// with a single school, users without code belong to it
+	err = newTestConfig(t, map[string]any{"Schools": testSchools("1")}, users[:2]...).Validate()
+	if err != nil && strings.Contains(err.Error(), "SchoolCode") {
+		t.Errorf("single school: %v", err)
+	}
+}
+
+func TestAuthRetryUsesSignedSchool(t *testing.T) {
+	c := newTestConfig(t, map[string]any{"Schools": testSchools("1", "2")})
+	h := CreateApiServer(c)
+	state, nonce := c.newAuthState("2")
+
+	callback := func(state string) *httptest.ResponseRecorder {
+		q := url.Values{"school": {"1"}, "state": {state}, "ymToken": {"t"}, "ymUserId": {"u"}}
+		// no upstream request gets through
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/_/xfb/auth?"+q.Encode(), nil).WithContext(ctx)
+		req.AddCookie(&http.Cookie{Name: authStateCookie, Value: nonce})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := callback(state)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), `href="/_/xfb/auth?school=2"`) {
+		t.Errorf("upstream failure: %d %s", w.Code, w.Body)
+	}
+	// without a valid state nothing can be retried: the school is unknown
+	w = callback("forged")
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "href=") {
+		t.Errorf("bad state: %d %s", w.Code, w.Body)
+	}
+}
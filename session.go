@@ -0,0 +1,204 @@
+package xfbbroker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "xfb_session"
+	// readable by the frontend, which echoes it in csrfHeader
+	csrfCookie = "xfb_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// WebSession is a browser login made through handleAuth. Sessions are
+// stored under the SHA-256 of their cookie, so the config file does not
+// hold usable credentials.
+type WebSession struct {
+	UserId    string
+	CSRFToken string
+	UserAgent string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (c *Config) SessionLifetimeOrDefault() time.Duration {
+	if c.SessionDays <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(c.SessionDays) * 24 * time.Hour
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewWebSession logs user k in and returns the session cookie value.
+// Expired sessions of all users are dropped on the way.
+func (c *Config) NewWebSession(k, userAgent string, now time.Time) (string, WebSession) {
+	token := randomToken()
+	sess := WebSession{
+		UserId:    k,
+		CSRFToken: randomToken(),
+		UserAgent: userAgent,
+		CreatedAt: now,
+		ExpiresAt: now.Add(c.SessionLifetimeOrDefault()),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Sessions == nil {
+		c.Sessions = make(map[string]WebSession)
+	}
+	for key, s := range c.Sessions {
+		if now.After(s.ExpiresAt) {
+			delete(c.Sessions, key)
+		}
+	}
+	c.Sessions[sessionKey(token)] = sess
+	return token, sess
+}
+
+// WebSession returns the live session behind a cookie value.
+func (c *Config) WebSession(token string, now time.Time) (WebSession, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	s, ok := c.Sessions[sessionKey(token)]
+	if !ok || now.After(s.ExpiresAt) {
+		return WebSession{}, false
+	}
+	if _, ok := c.Users[s.UserId]; !ok {
+		return WebSession{}, false
+	}
+	return s, true
+}
+
+func (c *Config) DeleteWebSession(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.Sessions, sessionKey(token))
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// cookieSession returns the web session of r. Requests that change
+// anything must also carry its CSRF token in csrfHeader, since the
+// browser attaches the cookie to requests made by any site.
+func (s *ApiServer) cookieSession(r *http.Request) (string, WebSession, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", WebSession{}, newApiError(http.StatusUnauthorized, ErrUnauthorized, "no credentials provided")
+	}
+	sess, ok := s.cfg.WebSession(c.Value, time.Now())
+	if !ok {
+		return "", WebSession{}, newApiError(http.StatusUnauthorized, ErrUnauthorized, "session expired, please log in again")
+	}
+	if !safeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(sess.CSRFToken)) != 1 {
+		return "", WebSession{}, newApiError(http.StatusForbidden, ErrForbidden, "missing or wrong "+csrfHeader)
+	}
+	return c.Value, sess, nil
+}
+
+// explicitSession returns the sessionId sent as "Authorization: Bearer"
+// or, failing that, as the sessionId query parameter.
+func explicitSession(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("sessionId")
+}
+
+// requestSession returns the xfb sessionId a /api/v1 request acts with:
+// the explicit one, or that of the user logged in through the session
+// cookie.
+func (s *ApiServer) requestSession(r *http.Request) string {
+	if sess := explicitSession(r); sess != "" {
+		return sess
+	}
+	if _, ws, err := s.cookieSession(r); err == nil {
+		if u, ok := s.cfg.GetUser(ws.UserId); ok {
+			return u.SessionId
+		}
+	}
+	return ""
+}
+
+func (s *ApiServer) setSessionCookies(w http.ResponseWriter, r *http.Request, token string, sess WebSession) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		Secure:   s.isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    sess.CSRFToken,
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		Secure:   s.isSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (s *ApiServer) clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, Secure: s.isSecure(r)})
+	}
+}
+
+type SessionView struct {
+	User      UserView  `json:"user"`
+	CSRFToken string    `json:"csrfToken"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// handleV2Session tells the frontend who is logged in through the cookie.
+func (s *ApiServer) handleV2Session(w http.ResponseWriter, r *http.Request) {
+	_, sess, err := s.cookieSession(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	u, ok := s.cfg.GetUser(sess.UserId)
+	if !ok {
+		writeError(w, r, newApiError(http.StatusUnauthorized, ErrUnauthorized, "user no longer exists"))
+		return
+	}
+	writeData(w, r, http.StatusOK, SessionView{User: userView(&u), CSRFToken: sess.CSRFToken, ExpiresAt: sess.ExpiresAt})
+}
+
+// handleV2Logout ends the session of the cookie.
+func (s *ApiServer) handleV2Logout(w http.ResponseWriter, r *http.Request) {
+	token, _, err := s.cookieSession(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.cfg.DeleteWebSession(token)
+	if err := s.cfg.Save(); err != nil {
+		writeError(w, r, fmt.Errorf("unable to save config: %w", err))
+		return
+	}
+	s.clearSessionCookies(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
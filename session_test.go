@@ -0,0 +1,89 @@
+package xfbbroker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveCookie sends a request with the session cookie token and, unless
+// empty, the CSRF token.
+func serveCookie(h http.Handler, method, path, token, csrf string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	if csrf != "" {
+		req.Header.Set(csrfHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebSession(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+	token, sess := c.NewWebSession("a", "test", time.Now())
+	if _, ok := c.Sessions[token]; ok {
+		t.Error("session stored under its cookie value")
+	}
+
+	w := serveCookie(h, "GET", "/api/v2/session", token, "")
+	if v := decodeData[SessionView](t, w); w.Code != http.StatusOK || v.User.YmUserId != "a" || v.CSRFToken != sess.CSRFToken {
+		t.Fatalf("session: %d %s", w.Code, w.Body)
+	}
+	if w := serveCookie(h, "GET", "/api/v2/user", token, ""); w.Code != http.StatusOK {
+		t.Errorf("read with cookie: %d", w.Code)
+	}
+	// the v1 API takes the cookie too
+	if w := serveCookie(h, "GET", "/api/v1/budgets", token, ""); w.Code != http.StatusOK {
+		t.Errorf("v1 with cookie: %d", w.Code)
+	}
+
+	for _, csrf := range []string{"", "wrong"} {
+		if w := serveCookie(h, "POST", "/api/v2/user/feed-token", token, csrf); w.Code != http.StatusForbidden {
+			t.Errorf("change with CSRF token %q: %d", csrf, w.Code)
+		}
+	}
+	if w := serveCookie(h, "POST", "/api/v2/user/feed-token", token, sess.CSRFToken); w.Code != http.StatusOK {
+		t.Errorf("change with CSRF token: %d %s", w.Code, w.Body)
+	}
+
+	if w := serveCookie(h, "DELETE", "/api/v2/session", token, sess.CSRFToken); w.Code != http.StatusNoContent {
+		t.Fatalf("logout: %d", w.Code)
+	}
+	if w := serveCookie(h, "GET", "/api/v2/user", token, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("read after logout: %d", w.Code)
+	}
+}
+
+func TestWebSessionEnds(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+
+	expired, _ := c.NewWebSession("a", "test", time.Now().Add(-c.SessionLifetimeOrDefault()-time.Minute))
+	if w := serveCookie(h, "GET", "/api/v2/user", expired, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired session: %d", w.Code)
+	}
+
+	token, _ := c.NewWebSession("b", "test", time.Now())
+	c.lock.Lock()
+	delete(c.Users, "b")
+	c.lock.Unlock()
+	for _, path := range []string{"/api/v2/user", "/api/v2/session"} {
+		if w := serveCookie(h, "GET", path, token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s of deleted user: %d", path, w.Code)
+		}
+	}
+}
+
+func TestRequestSessionTakesBearer(t *testing.T) {
+	c := newTestConfig(t, nil, grantUsers()...)
+	h := CreateApiServer(c)
+	if w := serve(t, h, "GET", "/api/v1/budgets", "sa", nil); w.Code != http.StatusOK {
+		t.Errorf("v1 with bearer: %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, h, "GET", "/api/v1/budgets", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("v1 without credentials: %d", w.Code)
+	}
+}
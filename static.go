@@ -0,0 +1,144 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticFile is a file of the embedded frontend with its precompressed
+// variants, keyed by Content-Encoding.
+type staticFile struct {
+	data     []byte
+	etag     string
+	encoded  map[string][]byte
+	mimeType string
+}
+
+// staticSite serves the built frontend. Paths that are not files get
+// index.html, so that the client side router can handle them.
+type staticSite struct {
+	files map[string]*staticFile
+}
+
+// encodings in order of preference, with the suffix of their files
+var staticEncodings = []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+func newStaticSite(fsys fs.FS) *staticSite {
+	site := &staticSite{files: make(map[string]*staticFile)}
+	fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		for _, e := range staticEncodings {
+			if strings.HasSuffix(p, e.ext) {
+				return nil
+			}
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		f := &staticFile{
+			data:     data,
+			etag:     `"` + base64.RawURLEncoding.EncodeToString(sum[:12]) + `"`,
+			encoded:  make(map[string][]byte),
+			mimeType: mime.TypeByExtension(path.Ext(p)),
+		}
+		if f.mimeType == "" {
+			f.mimeType = http.DetectContentType(data)
+		}
+		for _, e := range staticEncodings {
+			if b, err := fs.ReadFile(fsys, p+e.ext); err == nil {
+				f.encoded[e.name] = b
+			}
+		}
+		site.files["/"+p] = f
+		return nil
+	})
+	return site
+}
+
+// built reports whether the frontend was built into the binary.
+func (site *staticSite) built() bool {
+	return site.files["/index.html"] != nil
+}
+
+func acceptsEncoding(r *http.Request, name string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(enc) == name {
+			return strings.TrimSpace(params) != "q=0"
+		}
+	}
+	return false
+}
+
+func (site *staticSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+	if strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/_/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	f := site.files[p]
+	if p == "/" || (f == nil && path.Ext(p) == "") {
+		f = site.files["/index.html"]
+	}
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// vite puts a content hash in the names of everything under assets/
+	if strings.HasPrefix(p, "/assets/") {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", f.mimeType)
+	w.Header().Set("ETag", f.etag)
+
+	data := f.data
+	if len(f.encoded) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, e := range staticEncodings {
+			if b, ok := f.encoded[e.name]; ok && acceptsEncoding(r, e.name) {
+				w.Header().Set("Content-Encoding", e.name)
+				// each representation needs its own strong validator
+				w.Header().Set("ETag", strings.TrimSuffix(f.etag, `"`)+"-"+e.name+`"`)
+				data = b
+				break
+			}
+		}
+	}
+	http.ServeContent(w, r, p, time.Time{}, bytes.NewReader(data))
+}
+
+// FrontendConfig is what the web UI learns from /config.js at runtime.
+type FrontendConfig struct {
+	ApiBase string `json:"apiBase"`
+	AuthUrl string `json:"authUrl"`
+}
+
+// handleFrontendConfig serves /config.js, which index.html loads before
+// the app so that one build works behind any origin.
+func (s *ApiServer) handleFrontendConfig(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(FrontendConfig{
+		ApiBase: strings.TrimSuffix(s.cfg.FrontendApiBase, "/"),
+		AuthUrl: strings.TrimSuffix(s.cfg.FrontendApiBase, "/") + "/_/xfb/auth",
+	})
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte("window.XFB_CONFIG = "))
+	w.Write(body)
+	w.Write([]byte(";\n"))
+}
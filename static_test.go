@@ -0,0 +1,84 @@
+package xfbbroker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testSite() *staticSite {
+	return newStaticSite(fstest.MapFS{
+		"index.html":            {Data: []byte("<!DOCTYPE html><title>app</title>")},
+		"favicon.svg":           {Data: []byte("<svg/>")},
+		"assets/app-1a2b.js":    {Data: []byte("console.log(1)")},
+		"assets/app-1a2b.js.br": {Data: []byte("br")},
+		"assets/app-1a2b.js.gz": {Data: []byte("gz")},
+		".gitkeep":              {},
+	})
+}
+
+func TestStaticSite(t *testing.T) {
+	site := testSite()
+	if !site.built() || newStaticSite(fstest.MapFS{".gitkeep": {}}).built() {
+		t.Fatal("built() wrong")
+	}
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		site.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, p := range []string{"/", "/cards", "/shared/a/cards"} {
+		w := get(p, "")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<title>app</title>") || w.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("%s: %d %v", p, w.Code, w.Header())
+		}
+	}
+	for _, p := range []string{"/missing.js", "/api/v3/x", "/_/nothing", "/.gitkeep"} {
+		if w := get(p, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d", p, w.Code)
+		}
+	}
+	if w := get("/favicon.svg", ""); w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("favicon: %v", w.Header())
+	}
+
+	w := get("/assets/app-1a2b.js", "gzip, deflate, br")
+	if w.Body.String() != "br" || w.Header().Get("Content-Encoding") != "br" ||
+		!strings.Contains(w.Header().Get("Cache-Control"), "immutable") || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("br: %q %v", w.Body, w.Header())
+	}
+	brTag := w.Header().Get("ETag")
+	w = get("/assets/app-1a2b.js", "gzip, br;q=0")
+	if w.Body.String() != "gz" || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") == brTag {
+		t.Errorf("gzip: %q %v", w.Body, w.Header())
+	}
+	w = get("/assets/app-1a2b.js", "")
+	if w.Body.String() != "console.log(1)" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("identity: %q %v", w.Body, w.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/assets/app-1a2b.js", nil)
+	req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	site.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+}
+
+func TestFrontendConfig(t *testing.T) {
+	h := CreateApiServer(newTestConfig(t, map[string]any{"FrontendApiBase": "https://api.example.com/"}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/config.js", nil))
+	want := `window.XFB_CONFIG = {"apiBase":"https://api.example.com","authUrl":"https://api.example.com/_/xfb/auth"};` + "\n"
+	if w.Code != http.StatusOK || w.Body.String() != want || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript") {
+		t.Errorf("%d %q", w.Code, w.Body)
+	}
+}
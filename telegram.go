@@ -0,0 +1,220 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TelegramConfig enables the Telegram bot. Updates are received by long
+// polling unless WebhookUrl is set.
+type TelegramConfig struct {
+	// from BotFather, the bot is disabled if empty
+	Token string
+	// bot name without @, for t.me links
+	Username string
+	// public URL of /_/bot/telegram
+	WebhookUrl string
+	// sent back by Telegram in X-Telegram-Bot-Api-Secret-Token
+	WebhookSecret string
+	// "https://api.telegram.org" if empty
+	ApiUrl string
+}
+
+func (t TelegramConfig) apiUrl(method string) string {
+	base := t.ApiUrl
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	return base + "/bot" + t.Token + "/" + method
+}
+
+type telegramUpdate struct {
+	UpdateId int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			Id   int64  `json:"id"`
+			Type string `json:"type"`
+		} `json:"chat"`
+		From *struct {
+			Id int64 `json:"id"`
+		} `json:"from"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+type telegramResponse struct {
+	Ok          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+var telegramClient = &http.Client{Timeout: 60 * time.Second}
+
+func (c *Config) telegramDo(req *http.Request, v any) error {
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("telegram: %s: %w", resp.Status, err)
+	}
+	if !r.Ok {
+		return fmt.Errorf("telegram: %s", r.Description)
+	}
+	if v != nil {
+		return json.Unmarshal(r.Result, v)
+	}
+	return nil
+}
+
+func (c *Config) telegramCall(ctx context.Context, method string, payload any, v any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Telegram.apiUrl(method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.telegramDo(req, v)
+}
+
+func (c *Config) telegramReply(ctx context.Context, chatId int64, reply BotReply) error {
+	if reply.Image == nil {
+		err := c.telegramCall(ctx, "sendMessage", map[string]any{"chat_id": chatId, "text": reply.Text}, nil)
+		ObserveNotification("telegram", err)
+		return err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", strconv.FormatInt(chatId, 10))
+	mw.WriteField("caption", reply.Text)
+	fw, err := mw.CreateFormFile("photo", "qr.png")
+	if err != nil {
+		return err
+	}
+	fw.Write(reply.Image)
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Telegram.apiUrl("sendPhoto"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	err = c.telegramDo(req, nil)
+	ObserveNotification("telegram", err)
+	return err
+}
+
+func (c *Config) handleTelegramUpdate(ctx context.Context, u telegramUpdate) {
+	if u.Message == nil || u.Message.Text == "" {
+		return
+	}
+	chatId := u.Message.Chat.Id
+	// a linked chat acts on the card, so it must be the owner's own: in a
+	// private chat the chat is the sender
+	if u.Message.Chat.Type != "private" || u.Message.From == nil || u.Message.From.Id != chatId {
+		slog.InfoContext(ctx, "ignoring telegram message outside a private chat", "type", u.Message.Chat.Type)
+		if err := c.telegramReply(ctx, chatId, BotReply{Text: "请私聊机器人使用"}); err != nil {
+			slog.ErrorContext(ctx, "unable to reply on telegram", "err", err)
+		}
+		return
+	}
+	reply := c.botCommand(ctx, botChat{channel: "telegram", id: strconv.FormatInt(chatId, 10)}, u.Message.Text)
+	if err := c.telegramReply(ctx, chatId, reply); err != nil {
+		slog.ErrorContext(ctx, "unable to reply on telegram", "err", err)
+	}
+}
+
+// RunTelegram registers the webhook, or long polls for updates until ctx
+// is cancelled. It does nothing without a Telegram token.
+func (c *Config) RunTelegram(ctx context.Context) {
+	if c.Telegram.Token == "" {
+		return
+	}
+	if c.Telegram.WebhookUrl != "" {
+		err := c.telegramCall(ctx, "setWebhook", map[string]any{
+			"url":             c.Telegram.WebhookUrl,
+			"secret_token":    c.Telegram.WebhookSecret,
+			"allowed_updates": []string{"message"},
+		}, nil)
+		if err != nil {
+			slog.Error("unable to set telegram webhook", "err", err)
+		}
+		return
+	}
+
+	if err := c.telegramCall(ctx, "deleteWebhook", map[string]any{}, nil); err != nil {
+		slog.Warn("unable to delete telegram webhook", "err", err)
+	}
+	slog.Info("telegram long polling started")
+	var offset int64
+	backoff := time.Second
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := c.telegramCall(ctx, "getUpdates", map[string]any{
+			"offset":          offset,
+			"timeout":         50,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("telegram getUpdates failed", "err", err, "retry", backoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+				}
+				backoff = min(backoff*2, time.Minute)
+			}
+			continue
+		}
+		backoff = time.Second
+		for _, u := range updates {
+			offset = u.UpdateId + 1
+			c.handleTelegramUpdate(context.WithoutCancel(ctx), u)
+		}
+	}
+}
+
+func (s *ApiServer) handleTelegramWebhook(w http.ResponseWriter, r *http.Request) {
+	t := s.cfg.Telegram
+	if t.Token == "" || t.WebhookUrl == "" {
+		http.NotFound(w, r)
+		return
+	}
+	secret := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(t.WebhookSecret)) != 1 {
+		http.Error(w, "bad secret token", http.StatusUnauthorized)
+		return
+	}
+
+	var u telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// answer at once, Telegram retries slow webhooks
+	go s.cfg.handleTelegramUpdate(context.WithoutCancel(r.Context()), u)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t TelegramConfig) validate() error {
+	if t.WebhookUrl != "" && t.WebhookSecret == "" {
+		return errors.New("Telegram: WebhookSecret is required with WebhookUrl")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Package telemetry sets up OpenTelemetry tracing for the broker and ties
+// slog records to the active span.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer is used for every span the broker creates. It is a no-op until
+// Setup installs an exporter.
+var Tracer = otel.Tracer("github.com/yiffyi/xfbbroker")
+
+// Setup installs a global tracer provider exporting to exporter, which is
+// "stdout", "otlp" or "" to disable tracing. For "otlp", endpoint overrides
+// OTEL_EXPORTER_OTLP_ENDPOINT when set. The returned function flushes and
+// stops the exporter.
+func Setup(ctx context.Context, exporter string, endpoint string) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("xfbbroker"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// SlogHandler adds trace_id and span_id to records logged with a context
+// carrying a span.
+type SlogHandler struct {
+	slog.Handler
+}
+
+func (h SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return SlogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h SlogHandler) WithGroup(name string) slog.Handler {
+	return SlogHandler{h.Handler.WithGroup(name)}
+}
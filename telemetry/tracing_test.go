@@ -0,0 +1,44 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "", "")
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Errorf("disabled tracing: %v", err)
+	}
+	if _, err := Setup(context.Background(), "zipkin", ""); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(SlogHandler{slog.NewTextHandler(&buf, nil)}).With("component", "test")
+
+	log.InfoContext(context.Background(), "no span")
+	if strings.Contains(buf.String(), "trace_id") {
+		t.Errorf("trace_id without a span: %s", buf.String())
+	}
+
+	tp := sdktrace.NewTracerProvider()
+	defer tp.Shutdown(context.Background())
+	ctx, span := tp.Tracer("test").Start(context.Background(), "op")
+	defer span.End()
+	buf.Reset()
+	log.WithGroup("g").InfoContext(ctx, "in span", "k", "v")
+	sc := span.SpanContext()
+	for _, want := range []string{"component=test", "trace_id=" + sc.TraceID().String(), "span_id=" + sc.SpanID().String()} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in %s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package xfbbroker
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig obtains and renews the server certificate from an ACME CA.
+// Using it means agreeing to the terms of service of the CA.
+type ACMEConfig struct {
+	// names to get certificates for, ACME is disabled if empty
+	Domains []string
+	Email   string
+	// Let's Encrypt if empty
+	DirectoryUrl string
+	// where certificates and the account key are kept, "certs" if empty
+	CacheDir string
+	// address answering HTTP-01 challenges and redirecting to HTTPS,
+	// usually ":80". Only TLS-ALPN-01 on ListenAddr is used if empty, which
+	// then has to be on port 443
+	HTTPAddr string
+	// external account binding, required by ZeroSSL
+	EABKeyId   string
+	EABHMACKey string
+}
+
+func (a ACMEConfig) Enabled() bool {
+	return len(a.Domains) > 0
+}
+
+func (a ACMEConfig) CacheDirOrDefault() string {
+	if a.CacheDir == "" {
+		return "certs"
+	}
+	return a.CacheDir
+}
+
+func (a ACMEConfig) validate() error {
+	if !a.Enabled() {
+		return nil
+	}
+	if (a.EABKeyId == "") != (a.EABHMACKey == "") {
+		return errors.New("ACME: EABKeyId and EABHMACKey go together")
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(a.EABHMACKey); err != nil {
+		return errors.New("ACME: EABHMACKey must be base64url without padding")
+	}
+	return nil
+}
+
+// ServerTLS returns the TLS settings of the API server, nil without
+// ListenTLS. challenge answers HTTP-01 challenges on ACME.HTTPAddr and is
+// nil unless that is set.
+func (c *Config) ServerTLS() (config *tls.Config, challenge http.Handler, err error) {
+	if !c.ListenTLS {
+		return nil, nil, nil
+	}
+	if !c.ACME.Enabled() {
+		r, err := newCertReloader(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{GetCertificate: r.GetCertificate}, nil, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(c.ACME.CacheDirOrDefault()),
+		HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+		Email:      c.ACME.Email,
+	}
+	if c.ACME.DirectoryUrl != "" {
+		m.Client = &acme.Client{DirectoryURL: c.ACME.DirectoryUrl}
+	}
+	if c.ACME.EABKeyId != "" {
+		key, _ := base64.RawURLEncoding.DecodeString(c.ACME.EABHMACKey)
+		m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: c.ACME.EABKeyId, Key: key}
+	}
+	if c.ACME.HTTPAddr != "" {
+		challenge = m.HTTPHandler(nil)
+	}
+	// also offers acme-tls/1 for TLS-ALPN-01
+	return m.TLSConfig(), challenge, nil
+}
+
+// certReloader serves a certificate from files and picks up a renewed
+// one without a restart. The files are checked at most every
+// certCheckInterval; a pair that fails to load is logged and the previous
+// certificate stays in use.
+type certReloader struct {
+	certFile, keyFile string
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+const certCheckInterval = 10 * time.Second
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesModTime is the later modification time of the two files.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(now time.Time) error {
+	r.checked = now
+	mod, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && mod.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %w", r.certFile, err)
+	}
+	if r.cert != nil {
+		slog.Info("TLS certificate reloaded", "file", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = mod
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		if err := r.load(now); err != nil {
+			slog.Error("keeping the previous TLS certificate", "err", err)
+		}
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,117 @@
+package xfbbroker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for name to certFile and
+// keyFile, with the given modification time.
+func writeCert(t *testing.T, certFile, keyFile, name string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	mod := time.Now().Add(-time.Hour)
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("loaded missing files")
+	}
+	writeCert(t, certFile, keyFile, "one", mod)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := func() string {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	expire := func() {
+		r.lock.Lock()
+		r.checked = time.Time{}
+		r.lock.Unlock()
+	}
+
+	writeCert(t, certFile, keyFile, "two", mod.Add(time.Minute))
+	if got := name(); got != "one" {
+		t.Errorf("reloaded before certCheckInterval: %s", got)
+	}
+	expire()
+	if got := name(); got != "two" {
+		t.Errorf("after renewal: %s", got)
+	}
+
+	// a half-written renewal keeps the previous certificate
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	os.Chtimes(certFile, mod.Add(2*time.Minute), mod.Add(2*time.Minute))
+	expire()
+	if got := name(); got != "two" {
+		t.Errorf("after a broken renewal: %s", got)
+	}
+	writeCert(t, certFile, keyFile, "three", mod.Add(3*time.Minute))
+	expire()
+	if got := name(); got != "three" {
+		t.Errorf("after fixing the renewal: %s", got)
+	}
+}
+
+func TestValidateACME(t *testing.T) {
+	for _, tc := range []struct {
+		listen, http string
+		ok           bool
+	}{
+		{":443", "", true},
+		{"0.0.0.0:443", "", true},
+		{":8443", "", false},
+		{":8443", ":80", true},
+		{"localhost", "", false},
+	} {
+		c := newTestConfig(t, map[string]any{
+			"ListenAddr": tc.listen,
+			"ListenTLS":  true,
+			"ACME":       ACMEConfig{Domains: []string{"example.com"}, HTTPAddr: tc.http},
+		})
+		err := c.Validate()
+		if bad := err != nil && strings.Contains(err.Error(), "ACME:"); bad == tc.ok {
+			t.Errorf("ListenAddr %q, HTTPAddr %q: %v", tc.listen, tc.http, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package xfbbroker
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+// Wallet is one e-wallet of an account, such as the main wallet or a
+// subsidy wallet. Wallets are discovered from transactions and keyed by
+// WalletKey. Only the main balance can be recharged (to User.Threshold);
+// for every wallet, falling below Threshold triggers an alert.
+type Wallet struct {
+	Name      string
+	AccNum    string
+	EWalletId string
+	Threshold float64
+	Balance   float64
+	BalanceAt time.Time
+}
+
+// WalletKey identifies the wallet t was paid from, as "accNum:eWalletId".
+func WalletKey(t *xfb.Trans) string {
+	return t.AccNum + ":" + t.EWalletId
+}
+
+// ApplyDeal records the balance after t on its wallet, adding the wallet
+// the first time it is seen. It returns the wallet and whether t took its
+// balance below its threshold.
+func (u *User) ApplyDeal(t *xfb.Trans) (Wallet, bool) {
+	if u.Wallets == nil {
+		u.Wallets = make(map[string]Wallet)
+	}
+	k := WalletKey(t)
+	w, ok := u.Wallets[k]
+	if !ok {
+		w = Wallet{
+			Name:      "钱包 " + t.EWalletId,
+			AccNum:    t.AccNum,
+			EWalletId: t.EWalletId,
+		}
+	}
+
+	balance, err := strconv.ParseFloat(t.AfterMon, 64)
+	dt, dtErr := t.DealTime()
+	if err != nil || dtErr != nil || dt.Before(w.BalanceAt) {
+		u.Wallets[k] = w
+		return w, false
+	}
+
+	crossed := w.Threshold > 0 && balance < w.Threshold && (w.BalanceAt.IsZero() || w.Balance >= w.Threshold)
+	w.Balance = balance
+	w.BalanceAt = dt
+	u.Wallets[k] = w
+	return w, crossed
+}
+
+type WalletInfo struct {
+	Key          string        `json:"key"`
+	Name         string        `json:"name"`
+	AccNum       string        `json:"accNum"`
+	EWalletId    string        `json:"eWalletId"`
+	Balance      float64       `json:"balance"`
+	BalanceAt    *time.Time    `json:"balanceAt,omitempty"`
+	Threshold    float64       `json:"threshold"`
+	Transactions []Transaction `json:"transactions"`
+}
+
+// walletInfos merges the wallets known for u with rows, the latest
+// transactions, newest last. The balance of a wallet is taken from its
+// newest row when that is more recent than the stored one.
+func walletInfos(u *User, rows []Transaction) []WalletInfo {
+	byKey := make(map[string]*WalletInfo)
+	for k, w := range u.Wallets {
+		info := &WalletInfo{
+			Key:          k,
+			Name:         w.Name,
+			AccNum:       w.AccNum,
+			EWalletId:    w.EWalletId,
+			Balance:      w.Balance,
+			Threshold:    w.Threshold,
+			Transactions: []Transaction{},
+		}
+		if !w.BalanceAt.IsZero() {
+			at := w.BalanceAt
+			info.BalanceAt = &at
+		}
+		byKey[k] = info
+	}
+
+	for _, t := range rows {
+		k := WalletKey(&t.Trans)
+		info, ok := byKey[k]
+		if !ok {
+			info = &WalletInfo{
+				Key:          k,
+				Name:         "钱包 " + t.EWalletId,
+				AccNum:       t.AccNum,
+				EWalletId:    t.EWalletId,
+				Transactions: []Transaction{},
+			}
+			byKey[k] = info
+		}
+		info.Transactions = append(info.Transactions, t)
+
+		balance, err := strconv.ParseFloat(t.AfterMon, 64)
+		dt, dtErr := t.DealTime()
+		if err == nil && dtErr == nil && (info.BalanceAt == nil || !dt.Before(*info.BalanceAt)) {
+			info.Balance = balance
+			info.BalanceAt = &dt
+		}
+	}
+
+	res := make([]WalletInfo, 0, len(byKey))
+	for _, info := range byKey {
+		res = append(res, *info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
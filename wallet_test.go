@@ -0,0 +1,68 @@
+package xfbbroker
+
+import (
+	"testing"
+
+	"github.com/yiffyi/xfbbroker/xfb"
+)
+
+func TestApplyDealCrossesThresholdOnce(t *testing.T) {
+	u := &User{Wallets: map[string]Wallet{"100:1": {Name: "main", Threshold: 20}}}
+	steps := []struct {
+		dt      string
+		after   float64
+		crossed bool
+	}{
+		{"2024-05-06 08:00:00", 30, false},
+		{"2024-05-06 12:00:00", 15, true},
+		{"2024-05-06 18:00:00", 10, false}, // still below, no second alert
+		{"2024-05-06 10:00:00", 50, false}, // older than the stored balance
+		{"2024-05-07 08:00:00", 25, false},
+		{"2024-05-07 12:00:00", 5, true},
+	}
+	for i, s := range steps {
+		tr := deal(i, s.dt, -1, s.after, "食堂")
+		w, crossed := u.ApplyDeal(&tr)
+		if crossed != s.crossed {
+			t.Errorf("step %d: crossed = %v, want %v", i, crossed, s.crossed)
+		}
+		if s.dt != "2024-05-06 10:00:00" && w.Balance != s.after {
+			t.Errorf("step %d: balance = %v, want %v", i, w.Balance, s.after)
+		}
+	}
+	if u.Wallets["100:1"].Balance != 5 {
+		t.Errorf("stored balance = %v", u.Wallets["100:1"].Balance)
+	}
+}
+
+func TestApplyDealAddsUnknownWallet(t *testing.T) {
+	u := &User{}
+	tr := deal(1, "2024-05-06 08:00:00", -1, 3, "食堂")
+	tr.EWalletId = "2"
+	if _, crossed := u.ApplyDeal(&tr); crossed {
+		t.Error("a wallet without threshold must not alert")
+	}
+	w, ok := u.Wallets["100:2"]
+	if !ok || w.Balance != 3 || w.EWalletId != "2" {
+		t.Fatalf("wallet not added: %+v", u.Wallets)
+	}
+}
+
+func TestWalletInfosMergesRows(t *testing.T) {
+	c := newTestConfig(t, nil)
+	u := &User{Wallets: map[string]Wallet{"100:1": {Name: "main", AccNum: "100", EWalletId: "1", Balance: 99, Threshold: 10}}}
+	a := deal(1, "2024-05-06 08:00:00", -2, 40, "食堂")
+	b := deal(2, "2024-05-06 09:00:00", -3, 7, "超市")
+	b.EWalletId = "2"
+	infos := walletInfos(u, c.AnnotateAll([]xfb.Trans{a, b}))
+
+	if len(infos) != 2 || infos[0].Key != "100:1" || infos[1].Key != "100:2" {
+		t.Fatalf("wallets = %+v", infos)
+	}
+	if infos[0].Balance != 40 || infos[0].Threshold != 10 || len(infos[0].Transactions) != 1 {
+		t.Errorf("main wallet = %+v", infos[0])
+	}
+	if infos[1].Balance != 7 || infos[1].Transactions[0].Category != CategorySupermarket {
+		t.Errorf("new wallet = %+v", infos[1])
+	}
+}
@@ -0,0 +1,511 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type EventType string
+
+const (
+	EventTransactionCreated EventType = "transaction.created"
+	EventBalanceLow         EventType = "balance.low"
+	EventRechargeCompleted  EventType = "recharge.completed"
+	EventSessionExpired     EventType = "session.expired"
+	EventCodepayPaid        EventType = "codepay.paid"
+)
+
+var eventTypes = []EventType{EventTransactionCreated, EventBalanceLow, EventRechargeCompleted, EventSessionExpired, EventCodepayPaid}
+
+// Webhook receives the events of a user as signed JSON POSTs. The body is
+// signed with HMAC-SHA256 under Secret, see sign.
+type Webhook struct {
+	Id     string
+	Url    string
+	Secret string
+	// event types to send, all if empty
+	Events    []EventType
+	CreatedAt time.Time
+}
+
+func (h *Webhook) wants(t EventType) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, t)
+}
+
+type Event struct {
+	Id        string    `json:"id"`
+	Type      EventType `json:"type"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      any       `json:"data"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+	// not sent because the broker runs with --dry-run
+	DeliverySkipped DeliveryStatus = "skipped"
+)
+
+// Delivery is one event sent to one webhook, with all its attempts.
+type Delivery struct {
+	Id         string         `json:"id"`
+	WebhookId  string         `json:"webhookId"`
+	Url        string         `json:"url"`
+	Event      Event          `json:"event"`
+	Status     DeliveryStatus `json:"status"`
+	Attempts   int            `json:"attempts"`
+	LastStatus int            `json:"lastStatus,omitempty"`
+	LastError  string         `json:"lastError,omitempty"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	UpdatedAt  time.Time      `json:"updatedAt"`
+	// redelivery of this delivery
+	ReplayOf string `json:"replayOf,omitempty"`
+}
+
+// deliveryLogSize is how many deliveries are kept per user.
+const deliveryLogSize = 100
+
+// webhooks sends events in the background and keeps the recent
+// deliveries of every user in memory.
+type webhooks struct {
+	client *http.Client
+	// wait before the first retry, doubled for each one after
+	backoff time.Duration
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	lock sync.Mutex
+	log  map[string][]*Delivery
+}
+
+func newWebhooks(allowPrivate bool) *webhooks {
+	ctx, cancel := context.WithCancel(context.Background())
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	return &webhooks{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// no proxy, the dialer must see the address of the receiver
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+		},
+		backoff: 10 * time.Second,
+		ctx:     ctx,
+		cancel:  cancel,
+		log:     make(map[string][]*Delivery),
+	}
+}
+
+// errPrivateAddress is returned for webhooks resolving to an address of
+// the host or its network, unless WebhookAllowPrivate is set.
+var errPrivateAddress = errors.New("refusing to send webhooks to a loopback, link-local or private address")
+
+func isPrivate(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// refusePrivate is a net.Dialer Control hook. It runs after the name is
+// resolved, for every connection including redirects, so a name cannot
+// be pointed at an internal address after the webhook was validated.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if isPrivate(ap.Addr()) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, ap.Addr())
+	}
+	return nil
+}
+
+func randomId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *Config) WebhookMaxAttemptsOrDefault() int {
+	if c.WebhookMaxAttempts <= 0 {
+		return 6
+	}
+	return c.WebhookMaxAttempts
+}
+
+// Emit sends an event about user k to its webhooks. It does not block.
+func (c *Config) Emit(k string, t EventType, data any) {
+	if c.hooks == nil {
+		return
+	}
+	u, ok := c.GetUser(k)
+	if !ok {
+		return
+	}
+	e := Event{Id: randomId(12), Type: t, User: k, CreatedAt: time.Now(), Data: data}
+	for i := range u.Webhooks {
+		if u.Webhooks[i].wants(t) {
+			c.deliver(k, u.Webhooks[i], e, "")
+		}
+	}
+}
+
+func (c *Config) deliver(k string, h Webhook, e Event, replayOf string) *Delivery {
+	now := time.Now()
+	status := DeliveryPending
+	if c.dryRun {
+		status = DeliverySkipped
+	}
+	d := &Delivery{
+		Id:        randomId(12),
+		WebhookId: h.Id,
+		Url:       h.Url,
+		Event:     e,
+		Status:    status,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ReplayOf:  replayOf,
+	}
+	w := c.hooks
+	w.lock.Lock()
+	l := append(w.log[k], d)
+	if len(l) > deliveryLogSize {
+		l = l[len(l)-deliveryLogSize:]
+	}
+	w.log[k] = l
+	w.lock.Unlock()
+
+	if status == DeliverySkipped {
+		slog.Info("dry-run: webhook skipped", "user", k, "event", e.Type, "url", h.Url)
+		return d
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		c.send(d, h.Secret)
+	}()
+	return d
+}
+
+// sign computes the X-Xfbbroker-Signature header: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret.
+func sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// errPermanent marks responses that are not worth retrying.
+var errPermanent = errors.New("permanent failure")
+
+func (w *webhooks) attempt(d *Delivery, secret string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, d.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "xfbbroker-webhook")
+	req.Header.Set("X-Xfbbroker-Event", string(d.Event.Type))
+	req.Header.Set("X-Xfbbroker-Delivery", d.Id)
+	req.Header.Set("X-Xfbbroker-Signature", sign(secret, time.Now().Unix(), body))
+
+	resp, err := w.client.Do(req)
+	if errors.Is(err, errPrivateAddress) {
+		return 0, fmt.Errorf("%w: %w", errPermanent, err)
+	} else if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	default:
+		return resp.StatusCode, fmt.Errorf("%w: HTTP %d", errPermanent, resp.StatusCode)
+	}
+}
+
+// send posts d until it succeeds, fails permanently or runs out of
+// attempts, waiting 10s, 20s, 40s... in between.
+func (c *Config) send(d *Delivery, secret string) {
+	w := c.hooks
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		slog.Error("unable to encode webhook event", "err", err)
+		return
+	}
+
+	backoff := w.backoff
+	for {
+		status, err := w.attempt(d, secret, body)
+		ObserveNotification("webhook", err)
+
+		w.lock.Lock()
+		d.Attempts++
+		d.LastStatus = status
+		d.UpdatedAt = time.Now()
+		d.LastError = ""
+		if err != nil {
+			d.LastError = err.Error()
+		}
+		switch {
+		case err == nil:
+			d.Status = DeliveryDelivered
+		case errors.Is(err, errPermanent) || d.Attempts >= c.WebhookMaxAttemptsOrDefault() || w.ctx.Err() != nil:
+			d.Status = DeliveryFailed
+		}
+		done := d.Status != DeliveryPending
+		w.lock.Unlock()
+
+		if done {
+			if err != nil {
+				slog.Warn("webhook delivery failed", "delivery", d.Id, "url", d.Url, "event", d.Event.Type, "attempts", d.Attempts, "err", err)
+			}
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+		}
+		backoff *= 2
+	}
+}
+
+// CloseWebhooks waits up to timeout for deliveries in progress, then
+// abandons their retries.
+func (c *Config) CloseWebhooks(timeout time.Duration) {
+	if c.hooks == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		c.hooks.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		c.hooks.cancel()
+		<-done
+	}
+	c.hooks.cancel()
+}
+
+// deliveries returns copies of the recent deliveries of user k, newest
+// first.
+func (c *Config) deliveries(k string) []Delivery {
+	w := c.hooks
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	l := w.log[k]
+	res := make([]Delivery, 0, len(l))
+	for i := len(l) - 1; i >= 0; i-- {
+		res = append(res, *l[i])
+	}
+	return res
+}
+
+// validateWebhookUrl rejects malformed URLs and, unless allowed, literal
+// internal addresses. Names are checked when sending, see refusePrivate.
+func (c *Config) validateWebhookUrl(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Url must be an absolute http or https URL")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && isPrivate(ip) && !c.WebhookAllowPrivate {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+func (c *Config) validateWebhooks() []error {
+	var errs []error
+	for k, u := range c.Users {
+		for _, h := range u.Webhooks {
+			if err := c.validateWebhookUrl(h.Url); err != nil {
+				errs = append(errs, fmt.Errorf("user %s: webhook %s: %w", k, h.Id, err))
+			}
+			if h.Secret == "" {
+				errs = append(errs, fmt.Errorf("user %s: webhook %s: Secret is required", k, h.Id))
+			}
+			for _, t := range h.Events {
+				if !slices.Contains(eventTypes, t) {
+					errs = append(errs, fmt.Errorf("user %s: webhook %s: unknown event %q", k, h.Id, t))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+type WebhookView struct {
+	Id        string      `json:"id"`
+	Url       string      `json:"url"`
+	Events    []EventType `json:"events"`
+	CreatedAt time.Time   `json:"createdAt"`
+	// only returned on creation
+	Secret string `json:"secret,omitempty"`
+}
+
+func webhookView(h Webhook) WebhookView {
+	events := h.Events
+	if events == nil {
+		events = []EventType{}
+	}
+	return WebhookView{Id: h.Id, Url: h.Url, Events: events, CreatedAt: h.CreatedAt}
+}
+
+func (s *ApiServer) handleWebhooks(w http.ResponseWriter, r *http.Request, user *User) {
+	res := make([]WebhookView, 0, len(user.Webhooks))
+	for _, h := range user.Webhooks {
+		res = append(res, webhookView(h))
+	}
+	writeData(w, r, http.StatusOK, res)
+}
+
+type WebhookRequest struct {
+	Url    string      `json:"url"`
+	Events []EventType `json:"events"`
+}
+
+// handleCreateWebhook registers a webhook. Its secret is generated and
+// shown only in the response.
+func (s *ApiServer) handleCreateWebhook(w http.ResponseWriter, r *http.Request, user *User) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "invalid body: "+err.Error()))
+		return
+	}
+	if err := s.cfg.validateWebhookUrl(req.Url); err != nil {
+		writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "url must be an absolute http or https URL"))
+		return
+	}
+	for _, t := range req.Events {
+		if !slices.Contains(eventTypes, t) {
+			writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, fmt.Sprintf("unknown event %q", t)))
+			return
+		}
+	}
+
+	h := Webhook{
+		Id:        randomId(8),
+		Url:       req.Url,
+		Secret:    randomId(24),
+		Events:    req.Events,
+		CreatedAt: time.Now(),
+	}
+	s.cfg.UpdateUser(user.YmUserId, func(u *User) {
+		u.Webhooks = append(u.Webhooks, h)
+	})
+	if err := s.cfg.Save(); err != nil {
+		writeError(w, r, fmt.Errorf("unable to save config: %w", err))
+		return
+	}
+
+	v := webhookView(h)
+	v.Secret = h.Secret
+	writeData(w, r, http.StatusCreated, v)
+}
+
+func (s *ApiServer) handleDeleteWebhook(w http.ResponseWriter, r *http.Request, user *User) {
+	id := mux.Vars(r)["id"]
+	found := false
+	s.cfg.UpdateUser(user.YmUserId, func(u *User) {
+		// DeleteFunc works in place, leave the array of copies alone
+		u.Webhooks = slices.DeleteFunc(slices.Clone(u.Webhooks), func(h Webhook) bool {
+			if h.Id == id {
+				found = true
+			}
+			return h.Id == id
+		})
+	})
+	if !found {
+		writeError(w, r, newApiError(http.StatusNotFound, ErrNotFound, "no webhook "+id))
+		return
+	}
+	if err := s.cfg.Save(); err != nil {
+		writeError(w, r, fmt.Errorf("unable to save config: %w", err))
+		return
+	}
+	writeData(w, r, http.StatusOK, nil)
+}
+
+func (s *ApiServer) handleDeliveries(w http.ResponseWriter, r *http.Request, user *User) {
+	res := s.cfg.deliveries(user.YmUserId)
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			writeError(w, r, newApiError(http.StatusBadRequest, ErrBadRequest, "limit must be a positive integer"))
+			return
+		}
+		res = res[:min(n, len(res))]
+	}
+	writeData(w, r, http.StatusOK, res)
+}
+
+// handleReplayDelivery sends the event of a logged delivery again, as a
+// new delivery to the same webhook.
+func (s *ApiServer) handleReplayDelivery(w http.ResponseWriter, r *http.Request, user *User) {
+	id := mux.Vars(r)["id"]
+	ds := s.cfg.deliveries(user.YmUserId)
+	idx := slices.IndexFunc(ds, func(d Delivery) bool { return d.Id == id })
+	if idx < 0 {
+		writeError(w, r, newApiError(http.StatusNotFound, ErrNotFound, "no delivery "+id))
+		return
+	}
+	d := ds[idx]
+	hi := slices.IndexFunc(user.Webhooks, func(h Webhook) bool { return h.Id == d.WebhookId })
+	if hi < 0 {
+		writeError(w, r, newApiError(http.StatusNotFound, ErrNotFound, "webhook "+d.WebhookId+" was deleted"))
+		return
+	}
+
+	nd := s.cfg.deliver(user.YmUserId, user.Webhooks[hi], d.Event, d.Id)
+	writeData(w, r, http.StatusAccepted, nd)
+}
+
+func (s *ApiServer) routeWebhooks(v2 *mux.Router) {
+	v2.HandleFunc("/webhooks", s.v2(s.handleWebhooks)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/webhooks", s.v2(s.handleCreateWebhook)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/webhooks/deliveries", s.v2(s.handleDeliveries)).Methods(http.MethodGet, http.MethodOptions)
+	v2.HandleFunc("/webhooks/deliveries/{id}/replay", s.v2(s.handleReplayDelivery)).Methods(http.MethodPost, http.MethodOptions)
+	v2.HandleFunc("/webhooks/{id}", s.v2(s.handleDeleteWebhook)).Methods(http.MethodDelete, http.MethodOptions)
+}
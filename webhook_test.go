@@ -0,0 +1,164 @@
+package xfbbroker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":"e"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got := sign("secret", 1700000000, body); got != want {
+		t.Errorf("sign = %s, want %s", got, want)
+	}
+}
+
+// hookConfig returns a config whose user a sends every event to url.
+func hookConfig(t *testing.T, cfg map[string]any, url string) *Config {
+	c := newTestConfig(t, cfg, User{
+		Name:      "A",
+		YmUserId:  "a",
+		SessionId: "sa",
+		Webhooks:  []Webhook{{Id: "h", Url: url, Secret: "secret"}},
+	})
+	c.hooks.backoff = time.Millisecond
+	return c
+}
+
+func TestWebhookRetriesUntilDelivered(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var ts int64
+		fmt.Sscanf(r.Header.Get("X-Xfbbroker-Signature"), "t=%d,", &ts)
+		if r.Header.Get("X-Xfbbroker-Signature") != sign("secret", ts, body) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Xfbbroker-Signature"))
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil || e.Type != EventBalanceLow || e.User != "a" {
+			t.Errorf("event = %+v, %v", e, err)
+		}
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	c := hookConfig(t, map[string]any{"WebhookAllowPrivate": true}, srv.URL)
+	c.Emit("a", EventBalanceLow, map[string]float64{"balance": 1})
+	c.CloseWebhooks(5 * time.Second)
+
+	ds := c.deliveries("a")
+	if len(ds) != 1 || ds[0].Status != DeliveryDelivered || ds[0].Attempts != 3 || ds[0].LastStatus != 200 {
+		t.Fatalf("deliveries = %+v", ds)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		attempts int
+	}{
+		// client errors are not retried
+		{http.StatusBadRequest, 1},
+		{http.StatusInternalServerError, 2},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		c := hookConfig(t, map[string]any{"WebhookAllowPrivate": true, "WebhookMaxAttempts": 2}, srv.URL)
+		c.Emit("a", EventSessionExpired, nil)
+		c.CloseWebhooks(5 * time.Second)
+		srv.Close()
+
+		ds := c.deliveries("a")
+		if len(ds) != 1 || ds[0].Status != DeliveryFailed || ds[0].Attempts != tc.attempts {
+			t.Errorf("HTTP %d: deliveries = %+v", tc.status, ds)
+		}
+	}
+}
+
+func TestWebhookDryRunSkipped(t *testing.T) {
+	sent := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent <- struct{}{}
+	}))
+	defer srv.Close()
+	c := hookConfig(t, map[string]any{"WebhookAllowPrivate": true}, srv.URL)
+	c.SetDryRun(true)
+
+	c.Emit("a", EventSessionExpired, nil)
+	c.CloseWebhooks(5 * time.Second)
+
+	select {
+	case <-sent:
+		t.Error("webhook sent in dry-run")
+	default:
+	}
+	if ds := c.deliveries("a"); len(ds) != 1 || ds[0].Status != DeliverySkipped || ds[0].Attempts != 0 {
+		t.Errorf("deliveries = %+v", ds)
+	}
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	// a name resolving to loopback passes validation but not the dialer
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	c := hookConfig(t, nil, url)
+	c.Emit("a", EventBalanceLow, nil)
+	c.CloseWebhooks(5 * time.Second)
+
+	ds := c.deliveries("a")
+	if len(ds) != 1 || ds[0].Status != DeliveryFailed || ds[0].Attempts != 1 || calls.Load() != 0 {
+		t.Fatalf("deliveries = %+v, calls = %d", ds, calls.Load())
+	}
+
+	h := CreateApiServer(c)
+	for _, u := range []string{srv.URL, "http://10.0.0.1/hook", "http://[::1]/", "http://169.254.169.254/"} {
+		if w := serve(t, h, "POST", "/api/v2/webhooks", "sa", WebhookRequest{Url: u}); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d", u, w.Code)
+		}
+	}
+	if w := serve(t, h, "POST", "/api/v2/webhooks", "sa", WebhookRequest{Url: "https://example.com/hook"}); w.Code != http.StatusCreated {
+		t.Errorf("public url: %d", w.Code)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	c := hookConfig(t, nil, "https://example.com/a")
+	h := CreateApiServer(c)
+	w := serve(t, h, "POST", "/api/v2/webhooks", "sa", WebhookRequest{Url: "https://example.com/b"})
+	created := decodeData[WebhookView](t, w)
+	before, _ := c.GetUser("a")
+
+	if w := serve(t, h, "DELETE", "/api/v2/webhooks/h", "sa", nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: %d", w.Code)
+	}
+	if w := serve(t, h, "DELETE", "/api/v2/webhooks/h", "sa", nil); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: %d", w.Code)
+	}
+	views := decodeData[[]WebhookView](t, serve(t, h, "GET", "/api/v2/webhooks", "sa", nil))
+	if len(views) != 1 || views[0].Id != created.Id {
+		t.Errorf("webhooks = %+v", views)
+	}
+	if len(before.Webhooks) != 2 || before.Webhooks[0].Id != "h" {
+		t.Errorf("earlier copy changed: %+v", before.Webhooks)
+	}
+}
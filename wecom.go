@@ -0,0 +1,307 @@
+package xfbbroker
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WeComAppConfig enables commands sent to a WeCom self-built app. The
+// callback URL of the app is /_/bot/wecom; replies are sent through the
+// message API.
+type WeComAppConfig struct {
+	// the app is disabled if empty
+	CorpId  string
+	AgentId int
+	Secret  string
+	// callback Token and EncodingAESKey from the app settings
+	Token          string
+	EncodingAESKey string
+	// "https://qyapi.weixin.qq.com" if empty
+	ApiUrl string
+}
+
+func (a WeComAppConfig) apiUrl(path string) string {
+	base := a.ApiUrl
+	if base == "" {
+		base = "https://qyapi.weixin.qq.com"
+	}
+	return base + path
+}
+
+func (a WeComAppConfig) validate() error {
+	if a.CorpId == "" {
+		return nil
+	}
+	var errs []error
+	if a.AgentId <= 0 || a.Secret == "" || a.Token == "" {
+		errs = append(errs, errors.New("WeComApp: AgentId, Secret and Token are required with CorpId"))
+	}
+	if _, err := a.aesKey(); err != nil {
+		errs = append(errs, fmt.Errorf("WeComApp: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (a WeComAppConfig) aesKey() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(a.EncodingAESKey + "=")
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("EncodingAESKey must be 43 characters of base64")
+	}
+	return key, nil
+}
+
+// signature is the msg_signature of a callback: the SHA-1 of the sorted
+// token, timestamp, nonce and encrypted message.
+func (a WeComAppConfig) signature(timestamp, nonce, encrypted string) string {
+	parts := []string{a.Token, timestamp, nonce, encrypted}
+	sort.Strings(parts)
+	sum := sha1.Sum([]byte(strings.Join(parts, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// decrypt opens a callback message: AES-256-CBC with the IV taken from
+// the key, padded to 32 bytes, holding 16 random bytes, the big-endian
+// message length, the message and the corp id.
+func (a WeComAppConfig) decrypt(encrypted string) ([]byte, error) {
+	key, err := a.aesKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("bad ciphertext length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, key[:16]).CryptBlocks(data, data)
+
+	pad := int(data[len(data)-1])
+	if pad < 1 || pad > 32 || pad > len(data) {
+		return nil, errors.New("bad padding")
+	}
+	data = data[:len(data)-pad]
+	if len(data) < 20 {
+		return nil, errors.New("message too short")
+	}
+	n := int(binary.BigEndian.Uint32(data[16:20]))
+	if 20+n > len(data) {
+		return nil, errors.New("bad message length")
+	}
+	if string(data[20+n:]) != a.CorpId {
+		return nil, errors.New("message is for another corp")
+	}
+	return data[20 : 20+n], nil
+}
+
+// wecomToken caches the access token of the message API.
+type wecomToken struct {
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var wecomClient = &http.Client{Timeout: 30 * time.Second}
+
+type wecomResponse struct {
+	ErrCode     int    `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	MediaId     string `json:"media_id"`
+}
+
+func wecomDo(req *http.Request) (*wecomResponse, error) {
+	resp, err := wecomClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r wecomResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("wecom: %s: %w", resp.Status, err)
+	}
+	if r.ErrCode != 0 {
+		return nil, fmt.Errorf("wecom: %d %s", r.ErrCode, r.ErrMsg)
+	}
+	return &r, nil
+}
+
+func (c *Config) wecomAccessToken(ctx context.Context) (string, error) {
+	t := &c.bot.wecom
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	q := url.Values{"corpid": {c.WeComApp.CorpId}, "corpsecret": {c.WeComApp.Secret}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.WeComApp.apiUrl("/cgi-bin/gettoken?"+q.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+	r, err := wecomDo(req)
+	if err != nil {
+		return "", err
+	}
+	t.token = r.AccessToken
+	// renew a little early
+	t.expires = time.Now().Add(time.Duration(r.ExpiresIn)*time.Second - 5*time.Minute)
+	return t.token, nil
+}
+
+func (c *Config) wecomSend(ctx context.Context, msg map[string]any) error {
+	token, err := c.wecomAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	msg["agentid"] = c.WeComApp.AgentId
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.WeComApp.apiUrl("/cgi-bin/message/send?access_token="+url.QueryEscape(token)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = wecomDo(req)
+	return err
+}
+
+func (c *Config) wecomUpload(ctx context.Context, png []byte) (string, error) {
+	token, err := c.wecomAccessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("media", "qr.png")
+	if err != nil {
+		return "", err
+	}
+	fw.Write(png)
+	mw.Close()
+
+	q := url.Values{"access_token": {token}, "type": {"image"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.WeComApp.apiUrl("/cgi-bin/media/upload?"+q.Encode()), &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	r, err := wecomDo(req)
+	if err != nil {
+		return "", err
+	}
+	return r.MediaId, nil
+}
+
+func (c *Config) wecomReply(ctx context.Context, userId string, reply BotReply) error {
+	if reply.Image != nil {
+		mediaId, err := c.wecomUpload(ctx, reply.Image)
+		if err == nil {
+			err = c.wecomSend(ctx, map[string]any{"touser": userId, "msgtype": "image", "image": map[string]string{"media_id": mediaId}})
+		}
+		if err != nil {
+			ObserveNotification("wecom_app", err)
+			return err
+		}
+	}
+	err := c.wecomSend(ctx, map[string]any{"touser": userId, "msgtype": "text", "text": map[string]string{"content": reply.Text}})
+	ObserveNotification("wecom_app", err)
+	return err
+}
+
+type wecomEnvelope struct {
+	Encrypt string `xml:"Encrypt"`
+}
+
+type wecomMessage struct {
+	FromUserName string `xml:"FromUserName"`
+	MsgType      string `xml:"MsgType"`
+	Content      string `xml:"Content"`
+}
+
+// handleWeComCallback verifies the callback URL on GET and takes text
+// messages on POST. Both are signed with the callback Token.
+func (s *ApiServer) handleWeComCallback(w http.ResponseWriter, r *http.Request) {
+	a := s.cfg.WeComApp
+	if a.CorpId == "" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	check := func(encrypted string) ([]byte, bool) {
+		sig := a.signature(q.Get("timestamp"), q.Get("nonce"), encrypted)
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(q.Get("msg_signature"))) != 1 {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return nil, false
+		}
+		msg, err := a.decrypt(encrypted)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		return msg, true
+	}
+
+	if r.Method == http.MethodGet {
+		if echo, ok := check(q.Get("echostr")); ok {
+			w.Write(echo)
+		}
+		return
+	}
+
+	var env wecomEnvelope
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plain, ok := check(env.Encrypt)
+	if !ok {
+		return
+	}
+	var msg wecomMessage
+	if err := xml.Unmarshal(plain, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an empty answer acknowledges the message, the reply is sent
+	// separately so that slow upstream calls do not hit the callback
+	// timeout
+	w.WriteHeader(http.StatusOK)
+	if msg.MsgType != "text" {
+		return
+	}
+	go func(ctx context.Context) {
+		reply := s.cfg.botCommand(ctx, botChat{channel: "wecom", id: msg.FromUserName}, msg.Content)
+		if err := s.cfg.wecomReply(ctx, msg.FromUserName, reply); err != nil {
+			slog.ErrorContext(ctx, "unable to reply on wecom", "err", err)
+		}
+	}(context.WithoutCancel(r.Context()))
+}
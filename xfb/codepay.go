@@ -1,6 +1,7 @@
 package xfb
 
 import (
+	"context"
 	"fmt"
 	"image/png"
 	"net/url"
@@ -21,10 +22,10 @@ type QrPayCode struct {
 	Creation  int64
 }
 
-func GenerateQrPayCode(sessionId string) (*QrPayCode, error) {
+func GenerateQrPayCode(ctx context.Context, sessionId string) (*QrPayCode, error) {
 	var result XfbResponse
 
-	_, err := Post(XfbWebApp+qrCodeEndpointUrl, sessionId, nil, &result)
+	_, err := Post(ctx, XfbWebApp+qrCodeEndpointUrl, sessionId, nil, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -65,13 +66,13 @@ func (q *QrPayCode) GetQrPngBuf(size int) ([]byte, error) {
 	return qr.PNG(size)
 }
 
-func (q *QrPayCode) GetResult() (map[string]any, error) {
+func (q *QrPayCode) GetResult(ctx context.Context) (map[string]any, error) {
 	form := url.Values{}
 	form.Add("qrCode", q.QRCode)
 
 	var result XfbResponse
 
-	_, err := PostForm(XfbWebApp+qrResultEndpointUrl, q.SessionID, form, &result)
+	_, err := PostForm(ctx, XfbWebApp+qrResultEndpointUrl, q.SessionID, form, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,9 @@
 package xfb
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -10,8 +12,57 @@ import (
 	"time"
 
 	"github.com/yiffyi/gorad/radhttp"
+	"github.com/yiffyi/xfbbroker/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrUpstream wraps every error returned by a request to xiaofubao.
+var ErrUpstream = errors.New("xfb request failed")
+
+// ErrSessionExpired is returned when xiaofubao rejects the shiroJID, which
+// it does by redirecting to its login page, answering 401/403 or, on some
+// endpoints, answering 200 with a nonzero statusCode and a login message.
+var ErrSessionExpired = errors.New("xfb session expired")
+
+// sessionMessages are parts of the messages xiaofubao sends along with a
+// nonzero statusCode when the session is no longer valid. The codes vary
+// between endpoints, the messages do not.
+var sessionMessages = []string{"未登录", "登录失效", "登录已失效", "登录过期", "登录超时", "重新登录", "会话失效", "会话已过期"}
+
+// checkStatusCode maps the statusCode and message of an HTTP 200 answer to
+// an error.
+func checkStatusCode(code int, b []byte) error {
+	if code == 0 {
+		return nil
+	}
+	var res struct {
+		Message string `json:"message"`
+	}
+	json.Unmarshal(b, &res)
+	for _, m := range sessionMessages {
+		if strings.Contains(res.Message, m) {
+			return fmt.Errorf("%w: statusCode %d: %s", ErrSessionExpired, code, res.Message)
+		}
+	}
+	if res.Message != "" {
+		return fmt.Errorf("bad statusCode from xfb: %d: %s", code, res.Message)
+	}
+	return fmt.Errorf("bad statusCode from xfb: %d", code)
+}
+
+func checkHTTPStatus(resp *http.Response, b []byte) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusFound, http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("%w: %s", ErrSessionExpired, resp.Status)
+	default:
+		return fmt.Errorf("bad HTTP Status: %s\n\t%s", resp.Status, string(b))
+	}
+}
+
 const XfbPay = "https://pay.xiaofubao.com"
 const XfbWebApp = "https://webapp.xiaofubao.com"
 const XfbApp = "https://application.xiaofubao.com"
@@ -60,64 +111,68 @@ var client = &http.Client{
 // 	}
 // }
 
-func PostForm(url string, sessionId string, form url.Values, v XfbBaseResponse) (newSessionId string, err error) {
-	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(form.Encode()))
+func PostForm(ctx context.Context, url string, sessionId string, form url.Values, v XfbBaseResponse) (newSessionId string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(form.Encode()))
 	if err != nil {
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	if len(sessionId) > 0 {
-		req.AddCookie(&http.Cookie{Name: "shiroJID", Value: sessionId})
-	}
-
-	resp, b, err := radhttp.JSONDo(client, req, v)
-	if resp == nil {
-		return
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad HTTP Status: %s\n\t%s", resp.Status, string(b))
-		return
-	}
-
-	newSessionId = ""
-	for _, v := range resp.Cookies() {
-		if v.Name == "shiroJID" {
-			newSessionId = v.Value
-		}
-	}
-
-	if code := v.GetStatusCode(); code == 0 {
-		err = nil
-		return
-	} else {
-		err = fmt.Errorf("bad statusCode from xfb: %d", code)
-		return
-	}
+	return do(req, sessionId, v)
 }
 
-func Post(url string, sessionId string, payload map[string]any, v XfbBaseResponse) (newSessionId string, err error) {
+func Post(ctx context.Context, url string, sessionId string, payload map[string]any, v XfbBaseResponse) (newSessionId string, err error) {
 	req, err := radhttp.NewJSONPostRequest(url, payload)
 	if err != nil {
 		return
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
 	// req.Header.Set("Referer", "https://webapp.xiaofubao.com/card/card_home.shtml?platform=WECHAT_H5&schoolCode=20090820&thirdAppid=wx8fddf03d92fd6fa9")
 	// req.Header.Set("Origin", "https://webapp.xiaofubao.com")
 	// req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 18_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148 MicroMessenger/8.0.57(0x18003921) NetType/WIFI Language/en")
 	// req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
 	// req.Header.Set("Accept", "application/json, text/plain, */*")
+	return do(req, sessionId, v)
+}
+
+// do sends req with the shiroJID session cookie and decodes the response
+// into v. It returns the rotated session if xiaofubao issued a new one.
+func do(req *http.Request, sessionId string, v XfbBaseResponse) (newSessionId string, err error) {
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrUpstream, err)
+		}
+	}()
+
+	ctx, span := telemetry.Tracer.Start(req.Context(), "xfb "+endpointLabel(req.URL.String()), trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	req = req.WithContext(ctx)
+	span.SetAttributes(attribute.String("xfb.endpoint", endpointLabel(req.URL.String())))
+
 	if len(sessionId) > 0 {
 		req.AddCookie(&http.Cookie{Name: "shiroJID", Value: sessionId})
 	}
 
+	start := time.Now()
 	resp, b, err := radhttp.JSONDo(client, req, v)
 	if resp == nil {
+		observe(req.URL.String(), start, err, true, "")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "transport error")
 		return
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	defer func() {
+		observe(req.URL.String(), start, err, false, newSessionId)
+		span.SetAttributes(attribute.Bool("xfb.session_rotated", newSessionId != ""))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}()
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad HTTP Status: %s\n\t%s", resp.Status, string(b))
+	if e := checkHTTPStatus(resp, b); e != nil {
+		err = e
 		return
 	}
 
@@ -128,20 +183,23 @@ func Post(url string, sessionId string, payload map[string]any, v XfbBaseRespons
 		}
 	}
 
-	if code := v.GetStatusCode(); code == 0 {
-		err = nil
-		return
-	} else {
-		err = fmt.Errorf("bad statusCode from xfb: %d", code)
-		return
+	if code := v.GetStatusCode(); code != 0 {
+		span.SetAttributes(attribute.Int("xfb.status_code", code))
 	}
+	err = checkStatusCode(v.GetStatusCode(), b)
+	return
 }
 
-func GetRedirectLocation(url string) (string, error) {
-	resp, err := client.Get(url)
+func GetRedirectLocation(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
+	resp.Body.Close()
 	loc := resp.Header.Get("Location")
 	if loc == "" {
 		return "", errors.New("no Location found")
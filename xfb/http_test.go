@@ -0,0 +1,76 @@
+package xfb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// redirectTransport sends every request to the test server at host.
+type redirectTransport struct {
+	host string
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeUpstream answers every request to xiaofubao with status and body
+// until the test ends.
+func fakeUpstream(t *testing.T, status int, body string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status == http.StatusFound {
+			w.Header().Set("Location", "/login")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	u, _ := url.Parse(srv.URL)
+	orig := client.Transport
+	client.Transport = redirectTransport{host: u.Host}
+	t.Cleanup(func() {
+		client.Transport = orig
+		srv.Close()
+	})
+}
+
+func TestSessionExpired(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		body    string
+		expired bool
+		ok      bool
+	}{
+		{"ok", 200, `{"statusCode":0,"data":"1"}`, false, true},
+		{"redirect", 302, ``, true, false},
+		{"unauthorized", 401, `{}`, true, false},
+		{"forbidden", 403, `{}`, true, false},
+		{"login message", 200, `{"statusCode":203,"message":"登录失效，请重新登录"}`, true, false},
+		{"not logged in", 200, `{"statusCode":-1,"message":"用户未登录","success":false}`, true, false},
+		{"other statusCode", 200, `{"statusCode":500,"message":"系统繁忙"}`, false, false},
+		{"server error", 500, `{}`, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeUpstream(t, tc.status, tc.body)
+			var res XfbResponse
+			_, err := PostForm(context.Background(), XfbWebApp+"/x", "sid", url.Values{}, &res)
+			if tc.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUpstream) || errors.Is(err, ErrSessionExpired) != tc.expired {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package xfb
+
+import (
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "xfb_upstream_requests_total",
+		Help: "Requests to xiaofubao by endpoint and outcome.",
+	}, []string{"endpoint", "outcome"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "xfb_upstream_request_duration_seconds",
+		Help:    "Latency of requests to xiaofubao by endpoint.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint"})
+
+	sessionRefreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "xfb_session_refreshes_total",
+		Help: "Responses from xiaofubao that rotated the shiroJID session.",
+	})
+)
+
+func endpointLabel(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "invalid"
+	}
+	return u.Path
+}
+
+func outcomeLabel(err error, transport bool) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrSessionExpired):
+		return "session_expired"
+	case transport:
+		return "transport_error"
+	default:
+		return "error"
+	}
+}
+
+// observe records one request made by Post or PostForm.
+func observe(rawUrl string, start time.Time, err error, transport bool, newSessionId string) {
+	endpoint := endpointLabel(rawUrl)
+	upstreamDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	upstreamRequests.WithLabelValues(endpoint, outcomeLabel(err, transport)).Inc()
+	if newSessionId != "" {
+		sessionRefreshes.Inc()
+	}
+}
@@ -0,0 +1,42 @@
+package xfb
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpstreamMetrics(t *testing.T) {
+	const endpoint = "/metrics-test"
+	for _, tc := range []struct {
+		status  int
+		body    string
+		outcome string
+	}{
+		{200, `{"statusCode":0}`, "ok"},
+		{200, `{"statusCode":500,"message":"系统繁忙"}`, "error"},
+		{401, `{}`, "session_expired"},
+	} {
+		fakeUpstream(t, tc.status, tc.body)
+		c := upstreamRequests.WithLabelValues(endpoint, tc.outcome)
+		before := testutil.ToFloat64(c)
+		var res XfbResponse
+		PostForm(context.Background(), XfbWebApp+endpoint, "sid", url.Values{}, &res)
+		if got := testutil.ToFloat64(c) - before; got != 1 {
+			t.Errorf("%d %s: %v requests counted as %s", tc.status, tc.body, got, tc.outcome)
+		}
+	}
+
+	// a canceled request never reaches xiaofubao
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := upstreamRequests.WithLabelValues(endpoint, "transport_error")
+	before := testutil.ToFloat64(c)
+	var res XfbResponse
+	PostForm(ctx, XfbWebApp+endpoint, "sid", url.Values{}, &res)
+	if got := testutil.ToFloat64(c) - before; got != 1 {
+		t.Errorf("%v transport errors counted", got)
+	}
+}
@@ -1,5 +1,22 @@
 package xfb
 
+import "time"
+
+// School holds the parameters xiaofubao needs to route a request to a
+// university.
+type School struct {
+	Code     string
+	SubAppId string
+	Platform string
+}
+
+// DefaultSchool is the university the broker was first written for.
+var DefaultSchool = School{
+	Code:     "20090820",
+	SubAppId: "wx8fddf03d92fd6fa9",
+	Platform: "WECHAT_H5",
+}
+
 type XfbBaseResponse interface {
 	GetStatusCode() int
 }
@@ -82,3 +99,11 @@ type UserDefaultLoginInfo struct {
 	CardActiveType   int    `json:"cardActiveType"`
 	AuthType         int    `json:"authType"`
 }
+
+// Location is the time zone xiaofubao reports and expects times in.
+var Location = time.FixedZone("CST", 8*60*60)
+
+// DealTime parses Dealtime, which xiaofubao formats as "2006-01-02 15:04:05".
+func (t *Trans) DealTime() (time.Time, error) {
+	return time.ParseInLocation(time.DateTime, t.Dealtime, Location)
+}
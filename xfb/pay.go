@@ -1,6 +1,7 @@
 package xfb
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,10 +9,10 @@ import (
 	"time"
 )
 
-func GetUserById(token, ymId string) (sessionId string, data map[string]any, err error) {
+func GetUserById(ctx context.Context, school School, token, ymId string) (sessionId string, data map[string]any, err error) {
 	var r XfbResponse
-	sessionId, err = Post(XfbWebApp+"/user/getUserById", "", map[string]any{
-		"platform": "WECHAT_H5",
+	sessionId, err = Post(ctx, XfbWebApp+"/user/getUserById", "", map[string]any{
+		"platform": school.Platform,
 		"token":    token,
 		"ymId":     ymId,
 	}, &r)
@@ -22,13 +23,13 @@ func GetUserById(token, ymId string) (sessionId string, data map[string]any, err
 	return
 }
 
-func GetUserDefaultLoginInfo(sessionId string) (data *UserDefaultLoginInfo, newSessionId string, err error) {
+func GetUserDefaultLoginInfo(ctx context.Context, school School, sessionId string) (data *UserDefaultLoginInfo, newSessionId string, err error) {
 	var r XfbResponse
-	newSessionId, err = Post(XfbWebApp+"/user/defaultLogin", sessionId, map[string]any{
-		"platform": "WECHAT_H5",
+	newSessionId, err = Post(ctx, XfbWebApp+"/user/defaultLogin", sessionId, map[string]any{
+		"platform": school.Platform,
 	}, &r)
 	if err != nil {
-		slog.Error("GetUserDefaultLoginInfo", "err", err)
+		slog.ErrorContext(ctx, "GetUserDefaultLoginInfo", "err", err)
 		return nil, "", err
 	}
 	data = &UserDefaultLoginInfo{}
@@ -40,9 +41,9 @@ func GetUserDefaultLoginInfo(sessionId string) (data *UserDefaultLoginInfo, newS
 	return
 }
 
-func GetCardMoney(sessionId, ymId string) (string, error) {
+func GetCardMoney(ctx context.Context, sessionId, ymId string) (string, error) {
 	var r XfbResponse
-	_, err := Post(XfbWebApp+"/card/getCardMoney", sessionId, map[string]any{
+	_, err := Post(ctx, XfbWebApp+"/card/getCardMoney", sessionId, map[string]any{
 		"ymId": ymId,
 	}, &r)
 	if err != nil {
@@ -52,16 +53,19 @@ func GetCardMoney(sessionId, ymId string) (string, error) {
 	val := r.Data.(string)
 	// what's wrong with you?
 	if val == "- - -" {
-		slog.Debug(`GetCardMoney: "- - -" received`, "body", r)
+		slog.DebugContext(ctx, `GetCardMoney: "- - -" received`, "body", r)
 	}
 
 	return val, err
 }
 
-func CardQuerynoPage(sessionId, ymId string, queryTime time.Time) (total int, rows []Trans, err error) {
+// CardQuerynoPage returns the transactions on the day of queryTime. Days
+// are those of Location, whatever the zone of queryTime: a server on UTC
+// would otherwise ask for yesterday until 08:00.
+func CardQuerynoPage(ctx context.Context, sessionId, ymId string, queryTime time.Time) (total int, rows []Trans, err error) {
 	var r XfbQueryTransResponse
-	_, err = Post(XfbWebApp+"/routeauth/auth/route/user/cardQuerynoPage", sessionId, map[string]any{
-		"queryTime": queryTime.Format("20060102"),
+	_, err = Post(ctx, XfbWebApp+"/routeauth/auth/route/user/cardQuerynoPage", sessionId, map[string]any{
+		"queryTime": queryTime.In(Location).Format("20060102"),
 		"ymId":      ymId,
 	}, &r)
 
@@ -76,16 +80,16 @@ func CardQuerynoPage(sessionId, ymId string, queryTime time.Time) (total int, ro
 	return
 }
 
-func RechargeOnCard(money, openId, sessionId, ymId string) (string, error) {
+func RechargeOnCard(ctx context.Context, school School, money, openId, sessionId, ymId string) (string, error) {
 	var r XfbResponse
-	_, err := Post(XfbWebApp+"/order/rechargeOnCardByParam", sessionId, map[string]any{
+	_, err := Post(ctx, XfbWebApp+"/order/rechargeOnCardByParam", sessionId, map[string]any{
 		"openid":         openId,
 		"totalMoney":     money,
 		"orderRealMoney": money,
 		"rechargeType":   1,
-		"subappid":       "wx8fddf03d92fd6fa9",
-		"schoolCode":     "20090820",
-		"platform":       "WECHAT_H5",
+		"subappid":       school.SubAppId,
+		"schoolCode":     school.Code,
+		"platform":       school.Platform,
 		"sessionId":      sessionId,
 		"ymId":           ymId,
 	}, &r)
@@ -95,18 +99,18 @@ func RechargeOnCard(money, openId, sessionId, ymId string) (string, error) {
 	return r.Data.(string), err
 }
 
-func SignPayCheck(tranNo string) (string, error) {
+func SignPayCheck(ctx context.Context, tranNo string) (string, error) {
 	var r XfbResponse
-	_, err := Post(XfbPay+"/pay/sign/signPayCheck", "", map[string]any{
+	_, err := Post(ctx, XfbPay+"/pay/sign/signPayCheck", "", map[string]any{
 		"tranNo":  tranNo,
 		"payType": "WXPAY",
 	}, &r)
 	return r.Message, err
 }
 
-func GetSignUrl(tranNo string) (applyId string, jumpUrl string, err error) {
+func GetSignUrl(ctx context.Context, tranNo string) (applyId string, jumpUrl string, err error) {
 	var r XfbResponse
-	_, err = Post(XfbPay+"/h5/pay/sign/getSignUrl", "", map[string]any{
+	_, err = Post(ctx, XfbPay+"/h5/pay/sign/getSignUrl", "", map[string]any{
 		"payType":     "WXPAY",
 		"tranNo":      tranNo,
 		"signCashier": 0,
@@ -121,9 +125,9 @@ func GetSignUrl(tranNo string) (applyId string, jumpUrl string, err error) {
 	return
 }
 
-func QuerySignApplyById(applyId string) (int, error) {
+func QuerySignApplyById(ctx context.Context, applyId string) (int, error) {
 	var r XfbResponse
-	_, err := Post(XfbPay+"/h5/pay/sign/querySignApplyById", "", map[string]any{
+	_, err := Post(ctx, XfbPay+"/h5/pay/sign/querySignApplyById", "", map[string]any{
 		"applyId": applyId,
 	}, &r)
 	if err != nil {
@@ -142,9 +146,9 @@ func QuerySignApplyById(applyId string) (int, error) {
 	return s, fmt.Errorf("unknown status: %d", s)
 }
 
-func PayChoose(tranNo string) error {
+func PayChoose(ctx context.Context, tranNo string) error {
 	var r XfbResponse
-	_, err := Post(XfbPay+"/pay/unified/choose.shtml", "", map[string]any{
+	_, err := Post(ctx, XfbPay+"/pay/unified/choose.shtml", "", map[string]any{
 		"tranNo":    tranNo,
 		"payType":   "WXPAY",
 		"bussiCode": "WXSIGN",
@@ -152,9 +156,9 @@ func PayChoose(tranNo string) error {
 	return err
 }
 
-func DoPay(tranNo string) error {
+func DoPay(ctx context.Context, tranNo string) error {
 	var r XfbResponse
-	_, err := Post(XfbPay+"/pay/doPay", "", map[string]any{
+	_, err := Post(ctx, XfbPay+"/pay/doPay", "", map[string]any{
 		"tranNo": tranNo,
 	}, &r)
 	return err
@@ -0,0 +1,43 @@
+package xfb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCardQuerynoPageDay(t *testing.T) {
+	days := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		days <- body["queryTime"].(string)
+		w.Write([]byte(`{"statusCode":0,"total":0,"rows":[]}`))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	orig := client.Transport
+	client.Transport = redirectTransport{host: u.Host}
+	defer func() { client.Transport = orig }()
+
+	for _, tc := range []struct {
+		at   time.Time
+		want string
+	}{
+		// 07:30 in Location, still the previous day in UTC
+		{time.Date(2024, 5, 5, 23, 30, 0, 0, time.UTC), "20240506"},
+		{time.Date(2024, 5, 6, 16, 30, 0, 0, time.UTC), "20240507"},
+		{time.Date(2024, 5, 6, 23, 59, 0, 0, Location), "20240506"},
+	} {
+		if _, _, err := CardQuerynoPage(context.Background(), "sid", "ym", tc.at); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-days; got != tc.want {
+			t.Errorf("%v: queryTime = %s, want %s", tc.at, got, tc.want)
+		}
+	}
+}
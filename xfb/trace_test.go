@@ -0,0 +1,66 @@
+package xfb
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	providerOnce sync.Once
+	recorder     *tracetest.SpanRecorder
+	provider     *sdktrace.TracerProvider
+)
+
+// recordSpans installs a provider recording every span of the test
+// binary. telemetry.Tracer delegates to the first provider ever set.
+func recordSpans() (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	providerOnce.Do(func() {
+		recorder = tracetest.NewSpanRecorder()
+		provider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		otel.SetTracerProvider(provider)
+	})
+	return provider, recorder
+}
+
+func TestUpstreamSpan(t *testing.T) {
+	tp, rec := recordSpans()
+
+	fakeUpstream(t, 200, `{"statusCode":500,"message":"系统繁忙"}`)
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "poll")
+	var res XfbResponse
+	PostForm(ctx, XfbWebApp+"/trace-test?sessionId=secret", "sid", url.Values{}, &res)
+	parent.End()
+
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.SpanContext().TraceID() == parent.SpanContext().TraceID() {
+			spans = append(spans, s)
+		}
+	}
+	if len(spans) != 2 {
+		t.Fatalf("%d spans", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "xfb /trace-test" || s.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span %q, kind %v", s.Name(), s.SpanKind())
+	}
+	if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("not a child of the caller's span")
+	}
+	if s.Status().Code != codes.Error {
+		t.Errorf("status %v", s.Status())
+	}
+	for _, a := range s.Attributes() {
+		if a.Key == "xfb.status_code" && a.Value.AsInt64() != 500 {
+			t.Errorf("xfb.status_code = %v", a.Value)
+		}
+	}
+}